@@ -0,0 +1,247 @@
+package relayer
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Offense is a kind of client misbehavior counted by [WithAbuseDetection].
+type Offense string
+
+const (
+	// OffenseMalformed is a message that can't be parsed as a nostr message or event.
+	OffenseMalformed Offense = "malformed"
+	// OffenseInvalidID is an event whose id doesn't match its contents.
+	OffenseInvalidID Offense = "invalid_id"
+	// OffenseInvalidSignature is an event with a bad signature.
+	OffenseInvalidSignature Offense = "invalid_signature"
+	// OffenseRejected is an event rejected by the ban list, [Relay.AcceptEvent] or,
+	// for deletions, for targeting someone else's events.
+	OffenseRejected Offense = "rejected"
+)
+
+// AbuseConfig configures [WithAbuseDetection]. Zero fields take their defaults.
+type AbuseConfig struct {
+	// Strikes is how many strikes each offense is worth; offenses not in it are worth 1.
+	Strikes map[Offense]int
+	// Threshold is how many strikes within Window get a client banned. Defaults to 10.
+	Threshold int
+	// Window is how long strikes are remembered for. Defaults to 10 minutes.
+	Window time.Duration
+	// BanDuration is how long the ban lasts. Defaults to 1 hour.
+	BanDuration time.Duration
+}
+
+// WithAbuseDetection gives strikes to websocket clients sending malformed messages,
+// events with wrong ids or signatures and events that end up rejected. Strikes are
+// counted both per IP and per NIP-42 authenticated pubkey, never against the authors
+// of the events sent, who may not be the ones sending them, and an IP or pubkey
+// reaching the threshold gets a temporary [Ban], which also disconnects the offending
+// client.
+//
+// Server errors and "auth-required:" rejections don't count, and neither do events
+// published in-process. See [Server.AbuseStats] for the counters.
+func WithAbuseDetection(cfg AbuseConfig) Option {
+	return func(o *Options) {
+		if cfg.Threshold <= 0 {
+			cfg.Threshold = 10
+		}
+		if cfg.Window <= 0 {
+			cfg.Window = 10 * time.Minute
+		}
+		if cfg.BanDuration <= 0 {
+			cfg.BanDuration = time.Hour
+		}
+		o.abuse = &cfg
+	}
+}
+
+// Offender is an IP or pubkey with strikes.
+type Offender struct {
+	Type        BanType   `json:"type"`
+	Value       string    `json:"value"`
+	Strikes     int       `json:"strikes"`
+	LastOffense time.Time `json:"last_offense"`
+}
+
+// AbuseStats is returned by [Server.AbuseStats].
+type AbuseStats struct {
+	// Offenses counts the offenses seen since the server started, by kind.
+	Offenses map[Offense]int64 `json:"offenses"`
+	// Bans counts the bans given for reaching the threshold.
+	Bans int64 `json:"bans"`
+	// Offenders are the IPs and pubkeys with strikes in the current window, worst first.
+	Offenders []Offender `json:"offenders"`
+}
+
+type abuseTracker struct {
+	cfg AbuseConfig
+
+	mu        sync.Mutex
+	entries   map[banKey]*abuseEntry
+	offenses  map[Offense]int64
+	bans      int64
+	lastSweep time.Time
+}
+
+type abuseEntry struct {
+	strikes     int
+	windowStart time.Time
+	lastOffense time.Time
+}
+
+func newAbuseTracker(cfg *AbuseConfig) *abuseTracker {
+	if cfg == nil {
+		return nil
+	}
+	return &abuseTracker{
+		cfg:       *cfg,
+		entries:   make(map[banKey]*abuseEntry),
+		offenses:  make(map[Offense]int64),
+		lastSweep: time.Now(),
+	}
+}
+
+// record counts offense against each of keys and returns the ones that reached the
+// threshold, which start over with no strikes.
+func (at *abuseTracker) record(offense Offense, keys []banKey, now time.Time) []banKey {
+	strikes, ok := at.cfg.Strikes[offense]
+	if !ok {
+		strikes = 1
+	}
+
+	at.mu.Lock()
+	defer at.mu.Unlock()
+
+	at.offenses[offense]++
+
+	// forget about old strikes so memory stays bounded
+	if now.Sub(at.lastSweep) > at.cfg.Window {
+		for key, entry := range at.entries {
+			if now.Sub(entry.windowStart) > at.cfg.Window {
+				delete(at.entries, key)
+			}
+		}
+		at.lastSweep = now
+	}
+
+	var reached []banKey
+	for _, key := range keys {
+		entry, ok := at.entries[key]
+		if !ok || now.Sub(entry.windowStart) > at.cfg.Window {
+			entry = &abuseEntry{windowStart: now}
+			at.entries[key] = entry
+		}
+		entry.strikes += strikes
+		entry.lastOffense = now
+		if entry.strikes >= at.cfg.Threshold {
+			delete(at.entries, key)
+			at.bans++
+			reached = append(reached, key)
+		}
+	}
+	return reached
+}
+
+func (at *abuseTracker) stats(now time.Time) AbuseStats {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+
+	stats := AbuseStats{
+		Offenses:  make(map[Offense]int64, len(at.offenses)),
+		Bans:      at.bans,
+		Offenders: make([]Offender, 0, len(at.entries)),
+	}
+	for offense, n := range at.offenses {
+		stats.Offenses[offense] = n
+	}
+	for key, entry := range at.entries {
+		if now.Sub(entry.windowStart) <= at.cfg.Window {
+			stats.Offenders = append(stats.Offenders, Offender{
+				Type:        key.typ,
+				Value:       key.value,
+				Strikes:     entry.strikes,
+				LastOffense: entry.lastOffense,
+			})
+		}
+	}
+	slices.SortFunc(stats.Offenders, func(a, b Offender) int {
+		if a.Strikes != b.Strikes {
+			return b.Strikes - a.Strikes
+		}
+		return b.LastOffense.Compare(a.LastOffense)
+	})
+	return stats
+}
+
+// AbuseStats returns the counters kept by [WithAbuseDetection], which are empty when
+// it is not enabled.
+func (s *Server) AbuseStats() AbuseStats {
+	if s.abuse == nil {
+		return AbuseStats{Offenses: map[Offense]int64{}, Offenders: []Offender{}}
+	}
+	return s.abuse.stats(time.Now())
+}
+
+// strike records offense by the websocket client ctx comes from, against its IP and
+// its authenticated pubkey, if any. Nothing happens for other contexts.
+func (s *Server) strike(ctx context.Context, offense Offense) {
+	if s.abuse == nil {
+		return
+	}
+	ws, ok := ctx.Value(AUTH_CONTEXT_KEY).(*WebSocket)
+	if !ok {
+		return
+	}
+
+	keys := []banKey{{BanTypeIP, ws.ip}}
+	if authed := ws.AuthedPubkey(); authed != "" {
+		keys = append(keys, banKey{BanTypePubkey, authed})
+	}
+
+	for _, key := range s.abuse.record(offense, keys, time.Now()) {
+		s.abuseBan(ws, key, offense)
+	}
+}
+
+// strikeRejection is strike for an event rejected with reason, skipping reasons that
+// aren't the client's fault.
+func (s *Server) strikeRejection(ctx context.Context, reason string) {
+	if strings.HasPrefix(reason, "error: ") || strings.HasPrefix(reason, "auth-required: ") {
+		return
+	}
+	s.strike(ctx, OffenseRejected)
+}
+
+// abuseBan bans key for the configured duration and disconnects ws, leaving alone
+// any ban already in place for it.
+func (s *Server) abuseBan(ws *WebSocket, key banKey, offense Offense) {
+	var existing Ban
+	var banned bool
+	if key.typ == BanTypeIP {
+		existing, banned = s.bans.ip(key.value)
+	} else {
+		existing, banned = s.bans.pubkey(key.value)
+	}
+	if banned {
+		ws.Disconnect(existing.message())
+		return
+	}
+
+	ban := Ban{
+		Type:      key.typ,
+		Value:     key.value,
+		Reason:    "too many bad messages",
+		ExpiresAt: nostr.Timestamp(time.Now().Add(s.abuse.cfg.BanDuration).Unix()),
+	}
+	s.Log.Warningf("banning %s %s until %s (last offense: %s)", key.typ, key.value, ban.ExpiresAt.Time().Format(time.RFC3339), offense)
+	if err := s.Ban(ban); err != nil {
+		s.Log.Errorf("failed to ban %s %s: %v", key.typ, key.value, err)
+	}
+	ws.Disconnect(ban.message())
+}
@@ -0,0 +1,92 @@
+package relayer
+
+import (
+	"context"
+	"testing"
+
+	"github.com/fasthttp/websocket"
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestAbuseDetection(t *testing.T) {
+	relay := &testRelay{
+		storage: &slicestore.SliceStore{},
+		acceptEvent: func(ctx context.Context, evt *nostr.Event) (bool, string) {
+			if evt.Kind == nostr.KindReaction {
+				return false, "blocked: no reactions"
+			}
+			return true, ""
+		},
+	}
+	srv, err := NewServer(relay, WithAbuseDetection(AbuseConfig{
+		Strikes:   map[Offense]int{OffenseRejected: 2},
+		Threshold: 4,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan bool)
+	go srv.Start("127.0.0.1", 0, started)
+	<-started
+	defer srv.Shutdown(context.Background())
+
+	// someone else's events, which could be replayed by anyone
+	victim := nostr.GeneratePrivateKey()
+	conn := dialTestRelay(t, srv)
+	defer conn.Close()
+
+	// one malformed message and a rejected event are 3 strikes
+	conn.WriteJSON([]any{"EVENT"})
+	readLabel(t, conn, "NOTICE")
+	reaction := &nostr.Event{Kind: nostr.KindReaction, CreatedAt: nostr.Now(), Content: "+"}
+	reaction.Sign(victim)
+	conn.WriteJSON([]any{"EVENT", reaction})
+	readLabel(t, conn, "OK")
+
+	stats := srv.AbuseStats()
+	if len(stats.Offenders) != 1 || stats.Offenders[0].Strikes != 3 || stats.Offenders[0].Type != BanTypeIP {
+		t.Errorf("offenders: %+v", stats.Offenders)
+	}
+
+	// the next rejection is one too many
+	note := signedNote("accepted events don't count")
+	conn.WriteJSON([]any{"EVENT", note})
+	readLabel(t, conn, "OK")
+	reaction = &nostr.Event{Kind: nostr.KindReaction, CreatedAt: nostr.Now(), Content: "-"}
+	reaction.Sign(victim)
+	conn.WriteJSON([]any{"EVENT", reaction})
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+				t.Errorf("offender connection: got %v", err)
+			}
+			break
+		}
+	}
+
+	stats = srv.AbuseStats()
+	if stats.Offenses[OffenseMalformed] != 1 || stats.Offenses[OffenseRejected] != 2 || stats.Bans != 1 {
+		t.Errorf("stats: %+v", stats)
+	}
+	bans := srv.Bans()
+	if len(bans) != 1 || bans[0].ExpiresAt == 0 {
+		t.Fatalf("bans: %+v", bans)
+	}
+	if _, banned := srv.bans.pubkey(reaction.PubKey); banned {
+		t.Error("the author of the rejected events was banned")
+	}
+	if _, _, err := websocket.DefaultDialer.Dial("ws://"+srv.Addr, nil); err == nil {
+		t.Error("offending ip could connect again")
+	}
+
+	// in-process publishing is never scored
+	for i := 0; i < 5; i++ {
+		evt := &nostr.Event{Kind: nostr.KindReaction, CreatedAt: nostr.Now(), Content: "+"}
+		evt.Sign(nostr.GeneratePrivateKey())
+		srv.Publish(context.Background(), evt, PublishOptions{})
+	}
+	if stats := srv.AbuseStats(); stats.Offenses[OffenseRejected] != 2 {
+		t.Errorf("in-process rejections counted: %+v", stats.Offenses)
+	}
+}
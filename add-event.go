@@ -12,32 +12,106 @@ import (
 var nip20prefixmatcher = regexp.MustCompile(`^\w+: `)
 
 // AddEvent has a business rule to add an event to the relayer
+//
+// When ctx comes from a [Server], either because the server gave it to a relay method
+// or because it was made with [ContextWithServer], this is the same as calling
+// [Server.AddEvent] on it, ban list included. Otherwise it goes through one of the
+// running servers of relay the same way, and is also broadcast by the others. With no server running, evt is only passed through [Relay.AcceptEvent] and
+// stored.
 func AddEvent(ctx context.Context, relay Relay, evt *nostr.Event) (accepted bool, message string) {
+	if s := serverFromContext(ctx); s != nil {
+		return s.AddEvent(ctx, evt)
+	}
+
+	running := relayServers(relay)
+	if len(running) == 0 {
+		return storeEvent(ctx, relay, relay.AcceptEvent, evt, saveEvent, func(*nostr.Event) {})
+	}
+	accepted, message = running[0].AddEvent(ContextWithServer(ctx, running[0]), evt)
+	if accepted {
+		for _, s := range running[1:] {
+			s.eventStored(evt)
+		}
+	}
+	return accepted, message
+}
+
+// AddEvent passes evt through the structural checks set with [WithEventLimits] and
+// [WithKindRule], the ban list and [Relay.AcceptEvent], saves it to the relay storage
+// and broadcasts it to the live subscriptions of this server. It trusts the id and
+// signature of evt as they are; use [Server.Publish] to also verify them and handle
+// deletions.
+func (s *Server) AddEvent(ctx context.Context, evt *nostr.Event) (accepted bool, message string) {
 	if evt == nil {
 		return false, ""
 	}
+	if reason := s.validateEvent(evt); reason != "" {
+		s.strikeRejection(ctx, reason)
+		return false, reason
+	}
+	return s.addEvent(ctx, evt)
+}
+
+// addEvent is AddEvent for events already validated.
+func (s *Server) addEvent(ctx context.Context, evt *nostr.Event) (accepted bool, message string) {
+	if ban, banned := s.bans.event(evt); banned {
+		s.strikeRejection(ctx, ban.message())
+		return false, ban.message()
+	}
 
-	store := relay.Storage(ctx)
-	wrapper := &eventstore.RelayWrapper{
-		Store: store,
+	save := saveEvent
+	if s.batcher != nil {
+		save = s.batcher.save
 	}
+	accepted, message = storeEvent(ctx, s.relay, s.acceptEvent, evt, save, s.eventStored)
+	if !accepted {
+		s.strikeRejection(ctx, message)
+	}
+	return accepted, message
+}
+
+// eventStored updates the read cache for evt, which was just stored, and broadcasts it.
+func (s *Server) eventStored(evt *nostr.Event) {
+	s.readCache.invalidate(evt)
+	s.notifyListeners(evt)
+}
+
+// storeEvent does everything AddEvent does, deciding whether evt is accepted with accept,
+// saving it with save and passing it to broadcast once stored, if it is new.
+func storeEvent(ctx context.Context, relay Relay, accept EventPolicy, evt *nostr.Event, save saveFunc, broadcast func(*nostr.Event)) (accepted bool, message string) {
+	if evt == nil {
+		return false, ""
+	}
+
+	store := relay.Storage(ctx)
 	advancedSaver, _ := store.(AdvancedSaver)
 
-	if ok, msg := relay.AcceptEvent(ctx, evt); !ok {
+	adm := &admission{}
+	if ok, msg := accept(context.WithValue(ctx, admissionContextKey{}, adm), evt); !ok {
 		if msg == "" {
 			msg = "blocked: event blocked by relay"
 		}
 		return false, msg
 	}
+	if adm.shadowRejected {
+		return true, ""
+	}
 
 	if 20000 <= evt.Kind && evt.Kind < 30000 {
 		// do not store ephemeral events
+		broadcast(evt)
 	} else {
 		if advancedSaver != nil {
 			advancedSaver.BeforeSave(ctx, evt)
 		}
 
-		if saveErr := wrapper.Publish(ctx, *evt); saveErr != nil {
+		saved := func() {
+			if advancedSaver != nil {
+				advancedSaver.AfterSave(evt)
+			}
+			broadcast(evt)
+		}
+		if saveErr := save(ctx, store, evt, saved); saveErr != nil {
 			switch saveErr {
 			case eventstore.ErrDupEvent:
 				return true, saveErr.Error()
@@ -50,13 +124,27 @@ func AddEvent(ctx context.Context, relay Relay, evt *nostr.Event) (accepted bool
 				}
 			}
 		}
-
-		if advancedSaver != nil {
-			advancedSaver.AfterSave(evt)
-		}
 	}
 
-	notifyListeners(evt)
-
 	return true, ""
 }
+
+// saveFunc saves evt to store, calling saved once it is stored, in the order events are
+// stored, which for batched saves may be after returning. It returns
+// eventstore.ErrDupEvent for events already stored.
+type saveFunc func(ctx context.Context, store eventstore.Store, evt *nostr.Event, saved func()) error
+
+// saveEvent is like eventstore.RelayWrapper.Publish, but regular events are saved
+// directly so duplicates are reported with eventstore.ErrDupEvent.
+func saveEvent(ctx context.Context, store eventstore.Store, evt *nostr.Event, saved func()) error {
+	var err error
+	if nostr.IsRegularKind(evt.Kind) {
+		err = store.SaveEvent(ctx, evt)
+	} else {
+		err = eventstore.RelayWrapper{Store: store}.Publish(ctx, *evt)
+	}
+	if err == nil {
+		saved()
+	}
+	return err
+}
@@ -0,0 +1,194 @@
+package relayer
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// WithAdmin serves an admin API and dashboard under path on [Server.Router], for
+// looking at live connections and acting on them. Every API request must carry a
+// NIP-98 Authorization header signed by one of pubkeys, with a payload tag when it
+// has a body. Each signed event is only accepted once.
+//
+// The API has these endpoints, relative to path, all returning JSON:
+//
+//	GET    /connections                          list connections and their subscriptions
+//	POST   /connections/{id}/kick                disconnect a connection
+//	POST   /connections/{id}/subscriptions/{sub}/close
+//	                                             close a subscription with a CLOSED message
+//	GET    /bans                                 list bans
+//	POST   /bans                                 add a ban, given as a JSON [Ban]
+//	DELETE /bans/{type}/{value}                  lift a ban
+//	GET    /abuse                                abuse counters and offenders, see [Server.AbuseStats]
+//	GET    /retention                            the last retention pass, see [Server.LastRetentionReport]
+//
+// The dashboard at path itself is a static page that calls the API, signing requests
+// with a NIP-07 browser extension.
+func WithAdmin(path string, pubkeys ...string) Option {
+	return func(o *Options) {
+		o.adminPath = "/" + strings.Trim(path, "/")
+		o.adminPubkeys = pubkeys
+	}
+}
+
+// the largest request body the admin API reads.
+const maxAdminBody = 64 << 10
+
+//go:embed admin.html
+var adminDashboard []byte
+
+// AdminConnection describes a connection in the admin API.
+type AdminConnection struct {
+	ID               string                   `json:"id"`
+	IP               string                   `json:"ip"`
+	UserAgent        string                   `json:"user_agent"`
+	Authed           string                   `json:"authed,omitempty"`
+	ConnectedAt      time.Time                `json:"connected_at"`
+	MessagesReceived int64                    `json:"messages_received"`
+	EventsReceived   int64                    `json:"events_received"`
+	EventsSent       int64                    `json:"events_sent"`
+	Subscriptions    map[string]nostr.Filters `json:"subscriptions"`
+}
+
+func (s *Server) registerAdmin() {
+	prefix := s.options.adminPath
+	if prefix == "/" {
+		prefix = ""
+	}
+
+	if prefix != "" {
+		s.serveMux.Handle("GET "+prefix, http.RedirectHandler(prefix+"/", http.StatusMovedPermanently))
+	}
+	s.serveMux.HandleFunc("GET "+prefix+"/{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(adminDashboard)
+	})
+	s.serveMux.HandleFunc("GET "+prefix+"/connections", s.adminOnly(s.adminListConnections))
+	s.serveMux.HandleFunc("POST "+prefix+"/connections/{id}/kick", s.adminOnly(s.adminKick))
+	s.serveMux.HandleFunc("POST "+prefix+"/connections/{id}/subscriptions/{sub}/close", s.adminOnly(s.adminCloseSubscription))
+	s.serveMux.HandleFunc("GET "+prefix+"/bans", s.adminOnly(s.adminListBans))
+	s.serveMux.HandleFunc("POST "+prefix+"/bans", s.adminOnly(s.adminBan))
+	s.serveMux.HandleFunc("DELETE "+prefix+"/bans/{type}/{value...}", s.adminOnly(s.adminUnban))
+	s.serveMux.HandleFunc("GET "+prefix+"/abuse", s.adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, s.AbuseStats())
+	}))
+	s.serveMux.HandleFunc("GET "+prefix+"/retention", s.adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		report, _ := s.LastRetentionReport()
+		writeAdminJSON(w, report)
+	}))
+}
+
+// adminOnly wraps h so it is only called for requests with a valid NIP-98 header
+// signed by an admin. The request body is available to h as usual.
+func (s *Server) adminOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxAdminBody))
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, "failed to read body")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		pubkey, err := s.validateNIP98(r, body)
+		if err != nil {
+			writeAdminError(w, http.StatusUnauthorized, "unauthorized: "+err.Error())
+			return
+		}
+		if !slices.Contains(s.options.adminPubkeys, pubkey) {
+			writeAdminError(w, http.StatusForbidden, "forbidden: not an admin")
+			return
+		}
+
+		s.Log.Infof("admin %s: %s %s", pubkey, r.Method, r.URL.Path)
+		h(w, r)
+	}
+}
+
+func (s *Server) adminListConnections(w http.ResponseWriter, r *http.Request) {
+	conns := s.Connections()
+	list := make([]AdminConnection, 0, len(conns))
+	for _, ws := range conns {
+		list = append(list, AdminConnection{
+			ID:               ws.id,
+			IP:               ws.ip,
+			UserAgent:        ws.userAgent,
+			Authed:           ws.AuthedPubkey(),
+			ConnectedAt:      ws.connectedAt,
+			MessagesReceived: ws.messagesReceived.Load(),
+			EventsReceived:   ws.eventsReceived.Load(),
+			EventsSent:       ws.eventsSent.Load(),
+			Subscriptions:    s.listenerFilters(ws),
+		})
+	}
+	slices.SortFunc(list, func(a, b AdminConnection) int { return a.ConnectedAt.Compare(b.ConnectedAt) })
+	writeAdminJSON(w, list)
+}
+
+func (s *Server) adminKick(w http.ResponseWriter, r *http.Request) {
+	ws := s.Connection(r.PathValue("id"))
+	if ws == nil {
+		writeAdminError(w, http.StatusNotFound, "no such connection")
+		return
+	}
+	ws.Disconnect("kicked by relay admin")
+	writeAdminJSON(w, map[string]bool{"ok": true})
+}
+
+func (s *Server) adminCloseSubscription(w http.ResponseWriter, r *http.Request) {
+	ws := s.Connection(r.PathValue("id"))
+	if ws == nil {
+		writeAdminError(w, http.StatusNotFound, "no such connection")
+		return
+	}
+	id := r.PathValue("sub")
+	if !slices.Contains(s.listenerIds(ws), id) {
+		writeAdminError(w, http.StatusNotFound, "no such subscription")
+		return
+	}
+	s.CloseSubscription(ws, id, "blocked: closed by relay admin")
+	writeAdminJSON(w, map[string]bool{"ok": true})
+}
+
+func (s *Server) adminListBans(w http.ResponseWriter, r *http.Request) {
+	writeAdminJSON(w, s.Bans())
+}
+
+func (s *Server) adminBan(w http.ResponseWriter, r *http.Request) {
+	var ban Ban
+	if err := json.NewDecoder(r.Body).Decode(&ban); err != nil {
+		writeAdminError(w, http.StatusBadRequest, "invalid ban: "+err.Error())
+		return
+	}
+	if err := s.Ban(ban); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeAdminJSON(w, map[string]bool{"ok": true})
+}
+
+func (s *Server) adminUnban(w http.ResponseWriter, r *http.Request) {
+	if err := s.Unban(BanType(r.PathValue("type")), r.PathValue("value")); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeAdminJSON(w, map[string]bool{"ok": true})
+}
+
+func writeAdminJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
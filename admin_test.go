@@ -0,0 +1,122 @@
+package relayer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fasthttp/websocket"
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// adminRequest builds a request to the test server signed with NIP-98 by sk.
+func adminRequest(sk, method, path, body string) *http.Request {
+	tags := nostr.Tags{{"u", "http://example.com" + path}, {"method", method}}
+	if body != "" {
+		hash := sha256.Sum256([]byte(body))
+		tags = append(tags, nostr.Tag{"payload", hex.EncodeToString(hash[:])})
+	}
+	evt := nostr.Event{Kind: nostr.KindHTTPAuth, CreatedAt: nostr.Now(), Tags: tags}
+	evt.Sign(sk)
+	raw, _ := json.Marshal(evt)
+
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Authorization", "Nostr "+base64.StdEncoding.EncodeToString(raw))
+	return r
+}
+
+func TestAdminAPI(t *testing.T) {
+	admin := nostr.GeneratePrivateKey()
+	adminPubkey, _ := nostr.GetPublicKey(admin)
+
+	srv, err := NewServer(&testRelay{storage: &slicestore.SliceStore{}}, WithAdmin("/admin", adminPubkey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan bool)
+	go srv.Start("127.0.0.1", 0, started)
+	<-started
+	defer srv.Shutdown(context.Background())
+
+	conn := dialTestRelay(t, srv)
+	defer conn.Close()
+	conn.WriteJSON([]any{"REQ", "sub1", nostr.Filter{Kinds: []int{1}}})
+	readLabel(t, conn, "EOSE")
+
+	serve := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := serve(httptest.NewRequest("GET", "/admin/connections", nil)); w.Code != http.StatusUnauthorized {
+		t.Errorf("unsigned request: got %d", w.Code)
+	}
+	if w := serve(adminRequest(nostr.GeneratePrivateKey(), "GET", "/admin/connections", "")); w.Code != http.StatusForbidden {
+		t.Errorf("request by non-admin: got %d", w.Code)
+	}
+	wrongURL := adminRequest(admin, "GET", "/admin/bans", "")
+	wrongURL.URL.Path, wrongURL.RequestURI = "/admin/connections", "/admin/connections"
+	if w := serve(wrongURL); w.Code != http.StatusUnauthorized {
+		t.Errorf("request signed for another url: got %d", w.Code)
+	}
+	replayed := adminRequest(admin, "GET", "/admin/bans", "")
+	serve(replayed)
+	again := httptest.NewRequest("GET", "/admin/bans", nil)
+	again.Header = replayed.Header
+	if w := serve(again); w.Code != http.StatusUnauthorized {
+		t.Errorf("replayed request: got %d", w.Code)
+	}
+	unsignedBody := adminRequest(admin, "POST", "/admin/bans", "")
+	withBody := httptest.NewRequest("POST", "/admin/bans", strings.NewReader(`{"type":"ip","value":"10.0.0.1"}`))
+	withBody.Header = unsignedBody.Header
+	if w := serve(withBody); w.Code != http.StatusUnauthorized {
+		t.Errorf("body without payload tag: got %d", w.Code)
+	}
+	spoofed := adminRequest(admin, "GET", "/admin/abuse", "")
+	spoofed.Header.Set("X-Forwarded-Proto", "https")
+	if w := serve(spoofed); w.Code != http.StatusOK {
+		t.Errorf("X-Forwarded-Proto from an untrusted peer was used: got %d", w.Code)
+	}
+	if w := serve(httptest.NewRequest("GET", "/admin/", nil)); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<html>") {
+		t.Errorf("dashboard: got %d", w.Code)
+	}
+
+	w := serve(adminRequest(admin, "GET", "/admin/connections", ""))
+	var conns []AdminConnection
+	if err := json.Unmarshal(w.Body.Bytes(), &conns); err != nil || len(conns) != 1 {
+		t.Fatalf("connections: %v: %s", err, w.Body)
+	}
+	c := conns[0]
+	if c.IP != "127.0.0.1" || c.MessagesReceived != 1 || len(c.Subscriptions["sub1"]) != 1 {
+		t.Errorf("connection: %+v", c)
+	}
+
+	if w := serve(adminRequest(admin, "POST", "/admin/connections/"+c.ID+"/subscriptions/sub1/close", "")); w.Code != http.StatusOK {
+		t.Errorf("close subscription: got %d: %s", w.Code, w.Body)
+	}
+	readLabel(t, conn, "CLOSED")
+
+	if w := serve(adminRequest(admin, "POST", "/admin/bans", `{"type":"ip","value":"127.0.0.0/8","reason":"spam"}`)); w.Code != http.StatusOK {
+		t.Errorf("ban: got %d: %s", w.Code, w.Body)
+	}
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Errorf("banned connection: got %v", err)
+	}
+	if _, resp, err := websocket.DefaultDialer.Dial("ws://"+srv.Addr, nil); err == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("connecting from a banned ip: got %v", err)
+	}
+	if w := serve(adminRequest(admin, "DELETE", "/admin/bans/ip/127.0.0.0/8", "")); w.Code != http.StatusOK {
+		t.Errorf("unban: got %d: %s", w.Code, w.Body)
+	}
+	if bans := srv.Bans(); len(bans) != 0 {
+		t.Errorf("bans left: %v", bans)
+	}
+}
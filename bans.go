@@ -0,0 +1,370 @@
+package relayer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// BanType is what a [Ban] applies to.
+type BanType string
+
+const (
+	// BanTypePubkey bans an author: their events are rejected and no longer served,
+	// and clients authenticated as them are disconnected.
+	BanTypePubkey BanType = "pubkey"
+	// BanTypeEvent bans a single event id.
+	BanTypeEvent BanType = "event"
+	// BanTypeIP bans an IP address or, given in CIDR notation, a network.
+	// Clients from it can't connect and the ones already connected are disconnected.
+	BanTypeIP BanType = "ip"
+	// BanTypeKind bans all events of a kind, given as a decimal number.
+	BanTypeKind BanType = "kind"
+)
+
+// Ban is an entry in the ban list of a [Server]. See [Server.Ban].
+type Ban struct {
+	Type   BanType `json:"type"`
+	Value  string  `json:"value"`
+	Reason string  `json:"reason,omitempty"`
+
+	CreatedAt nostr.Timestamp `json:"created_at"`
+	// ExpiresAt is when the ban is lifted, or zero for permanent bans.
+	ExpiresAt nostr.Timestamp `json:"expires_at,omitempty"`
+}
+
+func (b Ban) expired() bool {
+	return b.ExpiresAt != 0 && b.ExpiresAt <= nostr.Now()
+}
+
+// message is the rejection reason given to clients.
+func (b Ban) message() string {
+	if b.Reason == "" {
+		return "blocked: banned"
+	}
+	return "blocked: banned: " + b.Reason
+}
+
+// normalize validates b and puts its value in canonical form.
+func (b *Ban) normalize() error {
+	switch b.Type {
+	case BanTypePubkey, BanTypeEvent:
+		b.Value = strings.ToLower(b.Value)
+		if !nostr.IsValid32ByteHex(b.Value) {
+			return fmt.Errorf("invalid %s %q", b.Type, b.Value)
+		}
+	case BanTypeIP:
+		if _, network, err := net.ParseCIDR(b.Value); err == nil {
+			b.Value = network.String()
+		} else if ip := net.ParseIP(b.Value); ip != nil {
+			b.Value = ip.String()
+		} else {
+			return fmt.Errorf("invalid ip or network %q", b.Value)
+		}
+	case BanTypeKind:
+		kind, err := strconv.Atoi(b.Value)
+		if err != nil || kind < 0 {
+			return fmt.Errorf("invalid kind %q", b.Value)
+		}
+		b.Value = strconv.Itoa(kind)
+	default:
+		return fmt.Errorf("unknown ban type %q", b.Type)
+	}
+	return nil
+}
+
+// BanStore persists the ban list of a [Server]. See [FileBanStore] and [WithBanStore].
+type BanStore interface {
+	// LoadBans returns all bans, called once by NewServer.
+	LoadBans() ([]Ban, error)
+	// SaveBan adds ban or replaces the one with the same type and value.
+	SaveBan(ban Ban) error
+	// DeleteBan removes the ban with the given type and value, if any.
+	DeleteBan(typ BanType, value string) error
+}
+
+// WithBanStore makes the server load its ban list from store and save changes to it.
+// Without a store, bans only last until the process exits.
+func WithBanStore(store BanStore) Option {
+	return func(o *Options) {
+		o.banStore = store
+	}
+}
+
+// WithBanFile is WithBanStore with a [FileBanStore] at path.
+func WithBanFile(path string) Option {
+	return WithBanStore(&FileBanStore{Path: path})
+}
+
+// FileBanStore keeps bans in a JSON file, which is created if it doesn't exist.
+type FileBanStore struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+func (fs *FileBanStore) LoadBans() ([]Ban, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.read()
+}
+
+func (fs *FileBanStore) SaveBan(ban Ban) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	bans, err := fs.read()
+	if err != nil {
+		return err
+	}
+	bans = slices.DeleteFunc(bans, func(b Ban) bool { return b.Type == ban.Type && b.Value == ban.Value })
+	return fs.write(append(bans, ban))
+}
+
+func (fs *FileBanStore) DeleteBan(typ BanType, value string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	bans, err := fs.read()
+	if err != nil {
+		return err
+	}
+	return fs.write(slices.DeleteFunc(bans, func(b Ban) bool { return b.Type == typ && b.Value == value }))
+}
+
+func (fs *FileBanStore) read() ([]Ban, error) {
+	data, err := os.ReadFile(fs.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var bans []Ban
+	if err := json.Unmarshal(data, &bans); err != nil {
+		return nil, fmt.Errorf("%s: %w", fs.Path, err)
+	}
+	return bans, nil
+}
+
+// write replaces the file atomically, dropping expired bans on the way.
+func (fs *FileBanStore) write(bans []Ban) error {
+	bans = slices.DeleteFunc(bans, Ban.expired)
+	data, err := json.MarshalIndent(bans, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(fs.Path), filepath.Base(fs.Path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fs.Path)
+}
+
+type banKey struct {
+	typ   BanType
+	value string
+}
+
+// banList is the in-memory index of the bans of a server.
+type banList struct {
+	mu       sync.RWMutex
+	bans     map[banKey]Ban
+	networks map[string]*net.IPNet
+}
+
+func newBanList() *banList {
+	return &banList{
+		bans:     make(map[banKey]Ban),
+		networks: make(map[string]*net.IPNet),
+	}
+}
+
+func (bl *banList) add(ban Ban) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	bl.pruneLocked()
+	bl.bans[banKey{ban.Type, ban.Value}] = ban
+	if ban.Type == BanTypeIP {
+		if _, network, err := net.ParseCIDR(ban.Value); err == nil {
+			bl.networks[ban.Value] = network
+		}
+	}
+}
+
+func (bl *banList) remove(typ BanType, value string) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	delete(bl.bans, banKey{typ, value})
+	if typ == BanTypeIP {
+		delete(bl.networks, value)
+	}
+}
+
+// pruneLocked forgets expired bans. Must be called with mu held for writing.
+func (bl *banList) pruneLocked() {
+	for key, ban := range bl.bans {
+		if ban.expired() {
+			delete(bl.bans, key)
+			if key.typ == BanTypeIP {
+				delete(bl.networks, key.value)
+			}
+		}
+	}
+}
+
+func (bl *banList) list() []Ban {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	bl.pruneLocked()
+	list := make([]Ban, 0, len(bl.bans))
+	for _, ban := range bl.bans {
+		list = append(list, ban)
+	}
+	slices.SortFunc(list, func(a, b Ban) int { return int(a.CreatedAt - b.CreatedAt) })
+	return list
+}
+
+func (bl *banList) lookup(typ BanType, value string) (Ban, bool) {
+	ban, ok := bl.bans[banKey{typ, value}]
+	if !ok || ban.expired() {
+		return Ban{}, false
+	}
+	return ban, true
+}
+
+// ip returns the ban covering ip, if any.
+func (bl *banList) ip(ip string) (Ban, bool) {
+	bl.mu.RLock()
+	defer bl.mu.RUnlock()
+
+	if ban, ok := bl.lookup(BanTypeIP, ip); ok {
+		return ban, true
+	}
+	if len(bl.networks) > 0 {
+		if parsed := net.ParseIP(ip); parsed != nil {
+			for value, network := range bl.networks {
+				if network.Contains(parsed) {
+					if ban, ok := bl.lookup(BanTypeIP, value); ok {
+						return ban, true
+					}
+				}
+			}
+		}
+	}
+	return Ban{}, false
+}
+
+func (bl *banList) pubkey(pubkey string) (Ban, bool) {
+	bl.mu.RLock()
+	defer bl.mu.RUnlock()
+	return bl.lookup(BanTypePubkey, pubkey)
+}
+
+// event returns the ban covering evt by its author, id or kind, if any.
+func (bl *banList) event(evt *nostr.Event) (Ban, bool) {
+	bl.mu.RLock()
+	defer bl.mu.RUnlock()
+
+	if len(bl.bans) == 0 {
+		return Ban{}, false
+	}
+	if ban, ok := bl.lookup(BanTypePubkey, evt.PubKey); ok {
+		return ban, true
+	}
+	if ban, ok := bl.lookup(BanTypeEvent, evt.ID); ok {
+		return ban, true
+	}
+	return bl.lookup(BanTypeKind, strconv.Itoa(evt.Kind))
+}
+
+// Ban adds ban to the ban list, saving it to the [BanStore] if there is one, and
+// applies it right away: connections from a banned IP or authenticated as a banned
+// pubkey are disconnected, and events covered by it are no longer accepted nor served.
+// CreatedAt is set to the current time if zero.
+func (s *Server) Ban(ban Ban) error {
+	if err := ban.normalize(); err != nil {
+		return err
+	}
+	if ban.CreatedAt == 0 {
+		ban.CreatedAt = nostr.Now()
+	}
+	if store := s.options.banStore; store != nil {
+		if err := store.SaveBan(ban); err != nil {
+			return fmt.Errorf("failed to save ban: %w", err)
+		}
+	}
+	s.bans.add(ban)
+
+	for _, ws := range s.Connections() {
+		if matched, banned := s.bans.ip(ws.ip); banned {
+			ws.Disconnect(matched.message())
+		} else if pubkey := ws.AuthedPubkey(); pubkey != "" {
+			if matched, banned := s.bans.pubkey(pubkey); banned {
+				ws.Disconnect(matched.message())
+			}
+		}
+	}
+	return nil
+}
+
+// Unban removes the ban with the given type and value.
+func (s *Server) Unban(typ BanType, value string) error {
+	ban := Ban{Type: typ, Value: value}
+	if err := ban.normalize(); err != nil {
+		return err
+	}
+	if store := s.options.banStore; store != nil {
+		if err := store.DeleteBan(ban.Type, ban.Value); err != nil {
+			return fmt.Errorf("failed to delete ban: %w", err)
+		}
+	}
+	s.bans.remove(ban.Type, ban.Value)
+	return nil
+}
+
+// Bans returns the bans in effect, oldest first.
+func (s *Server) Bans() []Ban {
+	return s.bans.list()
+}
+
+// loadBans fills the ban list from the ban store, if any.
+func (s *Server) loadBans() error {
+	store := s.options.banStore
+	if store == nil {
+		return nil
+	}
+	bans, err := store.LoadBans()
+	if err != nil {
+		return err
+	}
+	for _, ban := range bans {
+		if err := ban.normalize(); err != nil {
+			s.Log.Warningf("ignoring ban: %v", err)
+			continue
+		}
+		s.bans.add(ban)
+	}
+	return nil
+}
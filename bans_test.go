@@ -0,0 +1,121 @@
+package relayer
+
+import (
+	"context"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestBans(t *testing.T) {
+	store := &slicestore.SliceStore{}
+	srv, err := NewServer(&testRelay{storage: store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Shutdown(context.Background())
+	ctx := context.Background()
+
+	spammer := nostr.GeneratePrivateKey()
+	spam := &nostr.Event{Kind: nostr.KindTextNote, CreatedAt: nostr.Now(), Content: "spam"}
+	spam.Sign(spammer)
+	if res := srv.Publish(ctx, spam, PublishOptions{}); !res.Accepted {
+		t.Fatalf("publish before ban: %+v", res)
+	}
+
+	if err := srv.Ban(Ban{Type: BanTypePubkey, Value: spam.PubKey, Reason: "spam"}); err != nil {
+		t.Fatal(err)
+	}
+	again := &nostr.Event{Kind: nostr.KindTextNote, CreatedAt: nostr.Now(), Content: "more spam"}
+	again.Sign(spammer)
+	if res := srv.Publish(ctx, again, PublishOptions{}); res.Accepted || res.Reason != "blocked: banned: spam" {
+		t.Errorf("publish by banned pubkey: %+v", res)
+	}
+	if ok, _ := AddEvent(ContextWithServer(ctx, srv), srv.relay, again); ok {
+		t.Error("package-level AddEvent accepted an event by a banned pubkey")
+	}
+
+	// events stored before the ban are no longer served
+	ch, cancel := srv.Subscribe(ctx, nostr.Filters{{Kinds: []int{nostr.KindTextNote}}}, SubscribeReplay())
+	if evt := receive(t, ch); !IsEOSE(evt) {
+		t.Errorf("replayed %v from a banned pubkey", evt)
+	}
+	cancel()
+
+	if err := srv.Ban(Ban{Type: BanTypeKind, Value: strconv.Itoa(nostr.KindReaction)}); err != nil {
+		t.Fatal(err)
+	}
+	reaction := &nostr.Event{Kind: nostr.KindReaction, CreatedAt: nostr.Now(), Content: "+"}
+	reaction.Sign(nostr.GeneratePrivateKey())
+	if res := srv.Publish(ctx, reaction, PublishOptions{}); res.Accepted || res.Reason != "blocked: banned" {
+		t.Errorf("publish of banned kind: %+v", res)
+	}
+
+	// expired bans are ignored
+	expired := Ban{Type: BanTypeEvent, Value: signedNote("x").ID, ExpiresAt: nostr.Now() - 1}
+	if err := srv.Ban(expired); err != nil {
+		t.Fatal(err)
+	}
+	if len(srv.Bans()) != 2 {
+		t.Errorf("bans: %v", srv.Bans())
+	}
+	if n := len(srv.bans.bans); n != 2 {
+		t.Errorf("%d bans kept in memory", n)
+	}
+
+	if err := srv.Unban(BanTypePubkey, spam.PubKey); err != nil {
+		t.Fatal(err)
+	}
+	if res := srv.Publish(ctx, again, PublishOptions{}); !res.Accepted {
+		t.Errorf("publish after unban: %+v", res)
+	}
+
+	for _, ban := range []Ban{
+		{Type: BanTypePubkey, Value: "npub"},
+		{Type: BanTypeIP, Value: "300.0.0.1"},
+		{Type: BanTypeKind, Value: "-1"},
+		{Type: "country", Value: "xx"},
+	} {
+		if err := srv.Ban(ban); err == nil {
+			t.Errorf("%+v accepted", ban)
+		}
+	}
+}
+
+func TestBanFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.json")
+
+	srv, err := NewServer(&testRelay{storage: &slicestore.SliceStore{}}, WithBanFile(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Ban(Ban{Type: BanTypeIP, Value: "10.1.2.3/16", Reason: "abuse"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Ban(Ban{Type: BanTypeIP, Value: "192.0.2.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Unban(BanTypeIP, "192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	srv.Shutdown(context.Background())
+
+	srv, err = NewServer(&testRelay{storage: &slicestore.SliceStore{}}, WithBanFile(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Shutdown(context.Background())
+
+	if bans := srv.Bans(); len(bans) != 1 || bans[0].Value != "10.1.0.0/16" {
+		t.Fatalf("loaded bans: %v", bans)
+	}
+	if ban, banned := srv.bans.ip("10.1.200.7"); !banned || ban.Reason != "abuse" {
+		t.Error("ip in a banned network not banned")
+	}
+	if _, banned := srv.bans.ip("10.2.0.1"); banned {
+		t.Error("ip outside the banned network banned")
+	}
+}
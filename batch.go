@@ -0,0 +1,165 @@
+package relayer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/relayer/v2/internal/storeutil"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// WithWriteBatching groups the saves of events arriving at about the same time, up to
+// maxSize events or for at most maxDelay, and saves them together using SaveEvents
+// when the storage is a [BatchSaver], or one by one otherwise. Every event still gets
+// its own OK result, and events are broadcast in the order they were stored.
+func WithWriteBatching(maxSize int, maxDelay time.Duration) Option {
+	return func(o *Options) {
+		o.batchSize = maxSize
+		o.batchDelay = maxDelay
+	}
+}
+
+type writeBatcher struct {
+	maxSize  int
+	maxDelay time.Duration
+
+	mu      sync.Mutex
+	pending *writeBatch
+	last    *writeBatch // the batch saved before pending
+}
+
+// writeBatch is a group of events saved together. The first event to arrive makes its
+// goroutine the leader, which waits for the batch to fill up or for maxDelay and then
+// saves everything, while the others wait for it. The others return as soon as the
+// events are stored, while the leader goes on to call the saved callbacks.
+type writeBatch struct {
+	store  eventstore.Store
+	events []*nostr.Event
+	saved  []func()
+	errs   []error
+
+	full        chan struct{} // closed when the batch can't take more events
+	prev        *writeBatch   // the previous batch, which must be saved and broadcast first, until it is
+	stored      chan struct{} // closed after the batch is saved
+	broadcasted chan struct{} // closed after the saved callbacks are called
+}
+
+func newWriteBatcher(maxSize int, maxDelay time.Duration) *writeBatcher {
+	if maxSize <= 1 {
+		return nil
+	}
+	last := &writeBatch{stored: make(chan struct{}), broadcasted: make(chan struct{})}
+	close(last.stored)
+	close(last.broadcasted)
+	return &writeBatcher{maxSize: maxSize, maxDelay: maxDelay, last: last}
+}
+
+// save is a saveFunc that saves evt as part of a batch.
+func (wb *writeBatcher) save(ctx context.Context, store eventstore.Store, evt *nostr.Event, saved func()) error {
+	wb.mu.Lock()
+	b := wb.pending
+	if b != nil && !storeutil.SameValue(b.store, store) {
+		// another storage, only possible with relays choosing it by context
+		wb.seal(b)
+		b = nil
+	}
+	leader := b == nil
+	if leader {
+		b = &writeBatch{
+			store:       store,
+			full:        make(chan struct{}),
+			prev:        wb.last,
+			stored:      make(chan struct{}),
+			broadcasted: make(chan struct{}),
+		}
+		wb.pending = b
+		wb.last = b
+	}
+	i := len(b.events)
+	b.events = append(b.events, evt)
+	b.saved = append(b.saved, saved)
+	if len(b.events) >= wb.maxSize {
+		wb.seal(b)
+	}
+	wb.mu.Unlock()
+
+	if leader {
+		timer := time.NewTimer(wb.maxDelay)
+		select {
+		case <-timer.C:
+		case <-b.full:
+		}
+		timer.Stop()
+
+		wb.mu.Lock()
+		wb.seal(b)
+		wb.mu.Unlock()
+
+		<-b.prev.stored
+		b.flush(context.WithoutCancel(ctx))
+		close(b.stored)
+
+		<-b.prev.broadcasted
+		// only the leader uses prev, forget it so saved batches don't pile up behind the last one
+		b.prev = nil
+		for j, err := range b.errs {
+			if err == nil {
+				b.saved[j]()
+			}
+		}
+		close(b.broadcasted)
+	}
+
+	<-b.stored
+	return b.errs[i]
+}
+
+// seal stops b from taking more events. Must be called with mu held.
+func (wb *writeBatcher) seal(b *writeBatch) {
+	if wb.pending == b {
+		wb.pending = nil
+		close(b.full)
+	}
+}
+
+// flush saves all events in the batch in the order they arrived, the runs of regular
+// events with SaveEvents when the storage is a BatchSaver.
+func (b *writeBatch) flush(ctx context.Context) {
+	b.errs = make([]error, len(b.events))
+	bs, _ := b.store.(BatchSaver)
+
+	var run []int // regular events waiting to be saved together
+	saveRun := func() {
+		if len(run) == 0 {
+			return
+		}
+		events := make([]*nostr.Event, len(run))
+		for j, i := range run {
+			events[j] = b.events[i]
+		}
+		errs := bs.SaveEvents(ctx, events)
+		if len(errs) != len(events) {
+			errs = make([]error, len(events))
+			for j := range errs {
+				errs[j] = errors.New("error: storage returned a wrong number of results")
+			}
+		}
+		for j, i := range run {
+			b.errs[i] = errs[j]
+		}
+		run = run[:0]
+	}
+
+	for i, evt := range b.events {
+		if bs != nil && nostr.IsRegularKind(evt.Kind) {
+			run = append(run, i)
+			continue
+		}
+		saveRun()
+		b.errs[i] = saveEvent(ctx, b.store, evt, func() {})
+	}
+	saveRun()
+}
@@ -0,0 +1,135 @@
+package relayer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+type batchStore struct {
+	slicestore.SliceStore
+
+	mu      sync.Mutex
+	batches int
+	order   []string
+}
+
+func (bs *batchStore) SaveEvents(ctx context.Context, events []*nostr.Event) []error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	bs.batches++
+	errs := make([]error, len(events))
+	for i, evt := range events {
+		errs[i] = bs.SaveEvent(ctx, evt)
+		if errs[i] == nil {
+			bs.order = append(bs.order, evt.ID)
+		}
+	}
+	return errs
+}
+
+func (bs *batchStore) ReplaceEvent(ctx context.Context, evt *nostr.Event) error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	err := bs.SliceStore.ReplaceEvent(ctx, evt)
+	if err == nil {
+		bs.order = append(bs.order, evt.ID)
+	}
+	return err
+}
+
+func TestWriteBatching(t *testing.T) {
+	ctx := context.Background()
+	store := &batchStore{}
+	store.Init()
+	srv, _ := NewServer(&testRelay{storage: store}, WithWriteBatching(10, 50*time.Millisecond))
+	defer srv.Shutdown(ctx)
+
+	live, cancel := srv.Subscribe(ctx, nostr.Filters{{Kinds: []int{nostr.KindProfileMetadata, nostr.KindTextNote}}})
+	defer cancel()
+	for len(srv.GetListeningFilters()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	events := make([]*nostr.Event, 25)
+	for i := range events {
+		events[i] = signedNote("batched")
+		if i%4 == 1 {
+			// replaceable events are saved apart from the batches, but in order
+			events[i].Kind = nostr.KindProfileMetadata
+			events[i].Content = "{}"
+			events[i].Sign(nostr.GeneratePrivateKey())
+		}
+	}
+	events = append(events, events[0]) // a duplicate in the same flood
+
+	results := make([]PublishResult, len(events))
+	var wg sync.WaitGroup
+	for i, evt := range events {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = srv.Publish(ctx, evt, PublishOptions{SkipSignatureCheck: true})
+		}()
+	}
+	wg.Wait()
+
+	duplicates := 0
+	for i, res := range results {
+		if !res.Accepted {
+			t.Errorf("event %d: %+v", i, res)
+		}
+		if res.Duplicate {
+			duplicates++
+		}
+	}
+	if duplicates != 1 {
+		t.Errorf("got %d duplicates, want 1", duplicates)
+	}
+	if store.batches >= 25 || store.batches < 3 {
+		t.Errorf("saved in %d batches", store.batches)
+	}
+
+	for i, id := range store.order {
+		if evt := receive(t, live); evt.ID != id {
+			t.Fatalf("broadcast %d is %s, stored %s", i, evt.ID, id)
+		}
+	}
+}
+
+func TestWriteBatchChain(t *testing.T) {
+	ctx := context.Background()
+	store := &batchStore{}
+	store.Init()
+	wb := newWriteBatcher(4, time.Millisecond)
+
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wb.save(ctx, store, signedNote(fmt.Sprint(i)), func() {})
+		}()
+		if i%10 == 0 {
+			wg.Wait()
+		}
+	}
+	wg.Wait()
+
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	n := 0
+	for b := wb.last; b != nil; b = b.prev {
+		n++
+	}
+	if n != 1 {
+		t.Errorf("%d batches reachable after all were saved, want 1", n)
+	}
+}
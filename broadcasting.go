@@ -4,6 +4,18 @@ import (
 	"github.com/nbd-wtf/go-nostr"
 )
 
+// BroadcastEvent sends evt to the matching live subscriptions of every running [Server].
+//
+// Deprecated: use [Server.BroadcastEvent], which only reaches the subscriptions
+// of a single server.
 func BroadcastEvent(evt *nostr.Event) {
-	notifyListeners(evt)
+	for _, s := range runningServers() {
+		s.notifyListeners(evt)
+	}
+}
+
+// BroadcastEvent sends evt to the matching live subscriptions of this server,
+// without storing it.
+func (s *Server) BroadcastEvent(evt *nostr.Event) {
+	s.notifyListeners(evt)
 }
@@ -0,0 +1,346 @@
+// Package composite implements an [eventstore.Store] made of several other stores,
+// so a relay can, for instance, keep recent events in a fast local store while
+// archiving everything in postgres, or keep some kinds apart from the rest:
+//
+//	store := composite.New(
+//		composite.Route{Store: lmdb},
+//		composite.Route{Store: postgres},
+//		composite.Route{Store: badger, Kinds: []int{nostr.KindReaction}},
+//	)
+//
+// Events are written to every store with a route matching them. Queries go to the
+// stores with routes that can match the filter, all at once, and their results are
+// merged. Counts are added up from the stores, exact only when their routes can't
+// share events.
+package composite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/relayer/v2"
+	"github.com/fiatjaf/relayer/v2/internal/storeutil"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ErrNoRoute is returned when saving an event no route matches.
+var ErrNoRoute = errors.New("blocked: this relay does not store this kind of event")
+
+var (
+	_ eventstore.Store           = (*Store)(nil)
+	_ relayer.ApproximateCounter = (*Store)(nil)
+	_ relayer.AdvancedSaver      = (*Store)(nil)
+	_ relayer.AdvancedDeleter    = (*Store)(nil)
+)
+
+// WriteError is returned when writing an event failed in some of the stores it goes
+// to. The stores that didn't fail keep the write.
+type WriteError struct {
+	Failed int // how many stores failed
+	Stores int // how many stores the event went to
+	Err    error
+}
+
+func (e *WriteError) Error() string {
+	return fmt.Sprintf("failed in %d of %d stores: %v", e.Failed, e.Stores, e.Err)
+}
+
+func (e *WriteError) Unwrap() error {
+	return e.Err
+}
+
+// Route says which events are kept in Store. Empty Kinds or Authors match everything.
+type Route struct {
+	Store   eventstore.Store
+	Kinds   []int
+	Authors []string
+
+	// Match, if set, must also return true for the event. As it can't be checked
+	// against filters, queries always go to stores with a Match function.
+	Match func(*nostr.Event) bool
+}
+
+func (r Route) matchesEvent(evt *nostr.Event) bool {
+	return (len(r.Kinds) == 0 || slices.Contains(r.Kinds, evt.Kind)) &&
+		(len(r.Authors) == 0 || slices.Contains(r.Authors, evt.PubKey)) &&
+		(r.Match == nil || r.Match(evt))
+}
+
+func (r Route) matchesFilter(filter nostr.Filter) bool {
+	return intersects(r.Kinds, filter.Kinds) && intersects(r.Authors, filter.Authors)
+}
+
+// overlaps tells if an event matching filter could be matched by both r and other.
+func (r Route) overlaps(other Route, filter nostr.Filter) bool {
+	return intersects(r.Kinds, other.Kinds, filter.Kinds) && intersects(r.Authors, other.Authors, filter.Authors)
+}
+
+// intersects tells if lists, each matching anything when empty, have something in
+// common.
+func intersects[T comparable](lists ...[]T) bool {
+	lists = slices.DeleteFunc(lists, func(list []T) bool { return len(list) == 0 })
+	if len(lists) <= 1 {
+		return true
+	}
+	for _, v := range lists[0] {
+		if !slices.ContainsFunc(lists[1:], func(list []T) bool { return !slices.Contains(list, v) }) {
+			return true
+		}
+	}
+	return false
+}
+
+// Store routes events to other stores. It implements [relayer.ApproximateCounter],
+// [relayer.AdvancedSaver] and [relayer.AdvancedDeleter], passing calls on to the stores
+// that implement them.
+type Store struct {
+	routes []Route
+}
+
+// New returns a Store writing to and reading from the stores of routes. The same
+// store can be in several routes.
+func New(routes ...Route) *Store {
+	return &Store{routes: routes}
+}
+
+// Init initializes all stores.
+func (s *Store) Init() error {
+	for _, store := range s.stores(func(Route) bool { return true }) {
+		if err := store.Init(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes all stores.
+func (s *Store) Close() {
+	for _, store := range s.stores(func(Route) bool { return true }) {
+		store.Close()
+	}
+}
+
+// SaveEvent saves evt to all stores with a route matching it. It returns
+// [eventstore.ErrDupEvent] only if all of them already had it, and a [*WriteError] if
+// some of them failed.
+func (s *Store) SaveEvent(ctx context.Context, evt *nostr.Event) error {
+	return s.write(evt, func(store eventstore.Store) error { return store.SaveEvent(ctx, evt) })
+}
+
+// ReplaceEvent replaces evt in all stores with a route matching it, returning a
+// [*WriteError] if some of them failed.
+func (s *Store) ReplaceEvent(ctx context.Context, evt *nostr.Event) error {
+	return s.write(evt, func(store eventstore.Store) error { return store.ReplaceEvent(ctx, evt) })
+}
+
+// DeleteEvent deletes evt from all stores with a route matching it, returning a
+// [*WriteError] if some of them failed.
+func (s *Store) DeleteEvent(ctx context.Context, evt *nostr.Event) error {
+	_, err := writeAll(s.eventStores(evt), func(store eventstore.Store) error { return store.DeleteEvent(ctx, evt) })
+	return err
+}
+
+func (s *Store) write(evt *nostr.Event, write func(eventstore.Store) error) error {
+	stores := s.eventStores(evt)
+	if len(stores) == 0 {
+		return ErrNoRoute
+	}
+	dups, err := writeAll(stores, write)
+	if err == nil && dups == len(stores) {
+		return eventstore.ErrDupEvent
+	}
+	return err
+}
+
+// writeAll calls write for each of stores, even when it fails for some, and returns
+// how many of them already had the event.
+func writeAll(stores []eventstore.Store, write func(eventstore.Store) error) (dups int, err error) {
+	var errs []error
+	for i, store := range stores {
+		if err := write(store); err == eventstore.ErrDupEvent {
+			dups++
+		} else if err != nil {
+			errs = append(errs, fmt.Errorf("store %d: %w", i, err))
+		}
+	}
+	if len(errs) > 0 {
+		return dups, &WriteError{Failed: len(errs), Stores: len(stores), Err: errors.Join(errs...)}
+	}
+	return dups, nil
+}
+
+// QueryEvents queries all stores with a route that can match filter at the same time,
+// returning their events without duplicates, newest first. Only the newest version of
+// replaceable and addressable events is kept, in case a store has an outdated one.
+func (s *Store) QueryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	events, err := s.query(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan *nostr.Event, len(events))
+	for _, evt := range events {
+		ch <- evt
+	}
+	close(ch)
+	return ch, nil
+}
+
+// CountEvents adds up the counts of the stores with a route that can match filter,
+// see CountEventsApproximate.
+func (s *Store) CountEvents(ctx context.Context, filter nostr.Filter) (int64, error) {
+	count, _, err := s.CountEventsApproximate(ctx, filter)
+	return count, err
+}
+
+// CountEventsApproximate adds up the counts of the stores with a route that can match
+// filter. The count is approximate if the routes of these stores can share events,
+// which are then counted more than once, or if some of them don't implement
+// [relayer.EventCounter] and have their events queried instead, up to their limit.
+func (s *Store) CountEventsApproximate(ctx context.Context, filter nostr.Filter) (count int64, approximate bool, err error) {
+	if filter.LimitZero {
+		return 0, false, nil
+	}
+	for i, store := range s.filterStores(filter) {
+		var n int64
+		if counter, ok := store.(relayer.EventCounter); ok {
+			n, err = counter.CountEvents(ctx, filter)
+		} else {
+			var events []*nostr.Event
+			events, err = storeutil.Collect(ctx, store, filter)
+			n, approximate = int64(len(events)), true
+		}
+		if err != nil {
+			return 0, false, fmt.Errorf("store %d: %w", i, err)
+		}
+		count += n
+	}
+	return count, approximate || s.shared(filter), nil
+}
+
+// BeforeSave is passed on to the stores evt is saved to.
+func (s *Store) BeforeSave(ctx context.Context, evt *nostr.Event) {
+	for _, store := range s.eventStores(evt) {
+		if saver, ok := store.(relayer.AdvancedSaver); ok {
+			saver.BeforeSave(ctx, evt)
+		}
+	}
+}
+
+// AfterSave is passed on to the stores evt was saved to.
+func (s *Store) AfterSave(evt *nostr.Event) {
+	for _, store := range s.eventStores(evt) {
+		if saver, ok := store.(relayer.AdvancedSaver); ok {
+			saver.AfterSave(evt)
+		}
+	}
+}
+
+// BeforeDelete is passed on to all stores, as the event being deleted isn't known.
+func (s *Store) BeforeDelete(ctx context.Context, id string, pubkey string) {
+	for _, store := range s.stores(func(Route) bool { return true }) {
+		if deleter, ok := store.(relayer.AdvancedDeleter); ok {
+			deleter.BeforeDelete(ctx, id, pubkey)
+		}
+	}
+}
+
+// AfterDelete is passed on to all stores, as the deleted event isn't known.
+func (s *Store) AfterDelete(id string, pubkey string) {
+	for _, store := range s.stores(func(Route) bool { return true }) {
+		if deleter, ok := store.(relayer.AdvancedDeleter); ok {
+			deleter.AfterDelete(id, pubkey)
+		}
+	}
+}
+
+func (s *Store) query(ctx context.Context, filter nostr.Filter) ([]*nostr.Event, error) {
+	if filter.LimitZero {
+		return nil, nil
+	}
+	stores := s.filterStores(filter)
+
+	results := make([][]*nostr.Event, len(stores))
+	errs := make([]error, len(stores))
+	var wg sync.WaitGroup
+	for i, store := range stores {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = storeutil.Collect(ctx, store, filter)
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("store %d: %w", i, err)
+		}
+	}
+
+	events := merge(results)
+	if filter.Limit > 0 && len(events) > filter.Limit {
+		events = events[:filter.Limit]
+	}
+	return events, nil
+}
+
+// stores returns the distinct stores of the routes matching match.
+func (s *Store) stores(match func(Route) bool) []eventstore.Store {
+	var stores []eventstore.Store
+	for _, route := range s.routes {
+		if match(route) && !slices.ContainsFunc(stores, func(store eventstore.Store) bool {
+			return storeutil.SameValue(store, route.Store)
+		}) {
+			stores = append(stores, route.Store)
+		}
+	}
+	return stores
+}
+
+func (s *Store) eventStores(evt *nostr.Event) []eventstore.Store {
+	return s.stores(func(r Route) bool { return r.matchesEvent(evt) })
+}
+
+func (s *Store) filterStores(filter nostr.Filter) []eventstore.Store {
+	return s.stores(func(r Route) bool { return r.matchesFilter(filter) })
+}
+
+// shared tells if an event matching filter could be in more than one store.
+func (s *Store) shared(filter nostr.Filter) bool {
+	for i, a := range s.routes {
+		for _, b := range s.routes[i+1:] {
+			if a.matchesFilter(filter) && b.matchesFilter(filter) &&
+				!storeutil.SameValue(a.Store, b.Store) && a.overlaps(b, filter) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// merge sorts events by created_at descending then id, dropping repeated ids and
+// outdated versions of replaceable and addressable events.
+func merge(results [][]*nostr.Event) []*nostr.Event {
+	merged := storeutil.Merge(results)
+
+	seen := make(map[string]bool)
+	return slices.DeleteFunc(merged, func(evt *nostr.Event) bool {
+		var address string
+		switch {
+		case nostr.IsReplaceableKind(evt.Kind):
+			address = fmt.Sprintf("%d:%s", evt.Kind, evt.PubKey)
+		case nostr.IsAddressableKind(evt.Kind):
+			address = fmt.Sprintf("%d:%s:%s", evt.Kind, evt.PubKey, evt.Tags.GetD())
+		default:
+			return false
+		}
+		if seen[address] {
+			return true
+		}
+		seen[address] = true
+		return false
+	})
+}
@@ -0,0 +1,182 @@
+package composite
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// hookStore records the calls made to its optional interfaces.
+type hookStore struct {
+	slicestore.SliceStore
+	calls []string
+}
+
+func (h *hookStore) BeforeSave(context.Context, *nostr.Event) {
+	h.calls = append(h.calls, "BeforeSave")
+}
+
+func (h *hookStore) AfterSave(*nostr.Event) {
+	h.calls = append(h.calls, "AfterSave")
+}
+
+func (h *hookStore) BeforeDelete(context.Context, string, string) {
+	h.calls = append(h.calls, "BeforeDelete")
+}
+
+func (h *hookStore) AfterDelete(string, string) {
+	h.calls = append(h.calls, "AfterDelete")
+}
+
+func (h *hookStore) CountEvents(ctx context.Context, filter nostr.Filter) (int64, error) {
+	h.calls = append(h.calls, "CountEvents")
+	return h.SliceStore.CountEvents(ctx, filter)
+}
+
+func event(sk string, kind int, createdAt nostr.Timestamp, tags ...nostr.Tag) *nostr.Event {
+	evt := &nostr.Event{Kind: kind, CreatedAt: createdAt, Tags: tags}
+	evt.Sign(sk)
+	return evt
+}
+
+func query(t *testing.T, store eventstore.Store, filter nostr.Filter) []*nostr.Event {
+	t.Helper()
+	ch, err := store.QueryEvents(context.Background(), filter)
+	if err != nil {
+		t.Fatalf("query %s: %v", filter, err)
+	}
+	var events []*nostr.Event
+	for evt := range ch {
+		events = append(events, evt)
+	}
+	return events
+}
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	local, archive, reactions := &hookStore{}, &hookStore{}, &hookStore{}
+	store := New(
+		Route{Store: local, Kinds: []int{0, 1}},
+		Route{Store: archive},
+		Route{Store: reactions, Kinds: []int{7}},
+		Route{Store: archive, Kinds: []int{7}}, // listed twice, used once
+	)
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	sk := nostr.GeneratePrivateKey()
+	note := event(sk, 1, 100)
+	reaction := event(sk, 7, 200, nostr.Tag{"e", note.ID})
+	for _, evt := range []*nostr.Event{note, reaction} {
+		store.BeforeSave(ctx, evt)
+		if err := store.SaveEvent(ctx, evt); err != nil {
+			t.Fatalf("saving kind %d: %v", evt.Kind, err)
+		}
+		store.AfterSave(evt)
+	}
+	if err := store.SaveEvent(ctx, note); err != eventstore.ErrDupEvent {
+		t.Errorf("saving again: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		store *hookStore
+		ids   []string
+		calls int
+	}{
+		{"local", local, []string{note.ID}, 2},
+		{"archive", archive, []string{reaction.ID, note.ID}, 4},
+		{"reactions", reactions, []string{reaction.ID}, 2},
+	} {
+		got := query(t, tc.store, nostr.Filter{})
+		if len(got) != len(tc.ids) {
+			t.Errorf("%s has %d events, want %d", tc.name, len(got), len(tc.ids))
+		}
+		if len(tc.store.calls) != tc.calls {
+			t.Errorf("%s got calls %v", tc.name, tc.store.calls)
+		}
+	}
+
+	// an outdated profile in the archive is hidden by the one in the local store
+	oldProfile, profile := event(sk, 0, 50), event(sk, 0, 150)
+	archive.SaveEvent(ctx, oldProfile)
+	local.SaveEvent(ctx, profile)
+
+	got := query(t, store, nostr.Filter{Authors: []string{note.PubKey}})
+	want := []string{reaction.ID, profile.ID, note.ID}
+	if len(got) != len(want) {
+		t.Fatalf("got %d events, want %d", len(got), len(want))
+	}
+	for i, evt := range got {
+		if evt.ID != want[i] {
+			t.Errorf("event %d is kind %d at %d", i, evt.Kind, evt.CreatedAt)
+		}
+	}
+	if got := query(t, store, nostr.Filter{Limit: 1}); len(got) != 1 || got[0].ID != reaction.ID {
+		t.Errorf("limited query: %v", got)
+	}
+
+	local.calls, archive.calls, reactions.calls = nil, nil, nil
+	// the note is in both the local store and the archive
+	if n, approximate, _ := store.CountEventsApproximate(ctx, nostr.Filter{Kinds: []int{1}}); n != 2 || !approximate {
+		t.Errorf("counted %d notes across stores sharing them, approximate: %v", n, approximate)
+	}
+	if len(local.calls) != 1 || len(archive.calls) != 1 {
+		t.Errorf("count not passed on: %v %v", local.calls, archive.calls)
+	}
+	disjoint := New(Route{Store: local, Kinds: []int{0, 1}}, Route{Store: reactions, Kinds: []int{7}})
+	if n, approximate, _ := disjoint.CountEventsApproximate(ctx, nostr.Filter{Authors: []string{note.PubKey}}); n != 3 || approximate {
+		t.Errorf("counted %d events across stores not sharing them, approximate: %v", n, approximate)
+	}
+
+	store.BeforeDelete(ctx, note.ID, note.PubKey)
+	if err := store.DeleteEvent(ctx, note); err != nil {
+		t.Fatal(err)
+	}
+	store.AfterDelete(note.ID, note.PubKey)
+	if got := query(t, store, nostr.Filter{IDs: []string{note.ID}}); len(got) != 0 {
+		t.Errorf("deleted note still found in %d stores", len(got))
+	}
+	if len(reactions.calls) != 3 {
+		t.Errorf("reactions store got calls %v", reactions.calls)
+	}
+}
+
+// failingStore fails all writes.
+type failingStore struct {
+	slicestore.SliceStore
+}
+
+func (*failingStore) SaveEvent(context.Context, *nostr.Event) error {
+	return errors.New("disk full")
+}
+
+func TestPartialWrite(t *testing.T) {
+	ctx := context.Background()
+	working := &slicestore.SliceStore{}
+	store := New(Route{Store: &failingStore{}}, Route{Store: working})
+	store.Init()
+
+	note := event(nostr.GeneratePrivateKey(), 1, 100)
+	var werr *WriteError
+	if err := store.SaveEvent(ctx, note); !errors.As(err, &werr) || werr.Failed != 1 || werr.Stores != 2 {
+		t.Fatalf("saving to a failing store: %v", err)
+	}
+	if got := query(t, working, nostr.Filter{}); len(got) != 1 {
+		t.Errorf("the working store has %d events", len(got))
+	}
+}
+
+func TestNoRoute(t *testing.T) {
+	store := New(Route{Store: &slicestore.SliceStore{}, Kinds: []int{7}})
+	store.Init()
+	if err := store.SaveEvent(context.Background(), event(nostr.GeneratePrivateKey(), 1, 100)); err != ErrNoRoute {
+		t.Errorf("saved a note with no route for it: %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+package relayer
+
+import (
+	"context"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ID returns a random identifier of the connection, unique within the server.
+func (ws *WebSocket) ID() string {
+	return ws.id
+}
+
+// IP returns the client IP address, as described in [GetClientIP].
+func (ws *WebSocket) IP() string {
+	return ws.ip
+}
+
+// ConnectedAt returns when the client connected.
+func (ws *WebSocket) ConnectedAt() time.Time {
+	return ws.connectedAt
+}
+
+// AuthedPubkey returns the pubkey the client authenticated as with NIP-42, if any.
+func (ws *WebSocket) AuthedPubkey() string {
+	ws.authMu.RLock()
+	defer ws.authMu.RUnlock()
+	return ws.authed
+}
+
+// SendNotice sends a NOTICE message to the client.
+func (ws *WebSocket) SendNotice(message string) error {
+	return ws.WriteJSON(nostr.NoticeEnvelope(message))
+}
+
+// SendAuthChallenge sends the NIP-42 AUTH challenge of this connection to the client,
+// asking it to authenticate.
+func (ws *WebSocket) SendAuthChallenge() error {
+	return ws.WriteJSON(nostr.AuthEnvelope{Challenge: &ws.challenge})
+}
+
+// SendEvent sends evt to the client on subscription id.
+func (ws *WebSocket) SendEvent(id string, evt *nostr.Event) error {
+	return ws.send(id, evt)
+}
+
+// Disconnect closes the connection with a websocket close frame carrying reason,
+// cut to the 123 bytes that fit in it.
+func (ws *WebSocket) Disconnect(reason string) {
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	closeMessage := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason)
+	ws.conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
+	ws.conn.Close()
+}
+
+// Connections returns all the websocket clients currently connected to the server.
+func (s *Server) Connections() []*WebSocket {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+
+	list := make([]*WebSocket, 0, len(s.clients))
+	for _, ws := range s.clients {
+		list = append(list, ws)
+	}
+	return list
+}
+
+// Connection returns the connected client with the given [WebSocket.ID], or nil.
+func (s *Server) Connection(id string) *WebSocket {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+
+	for _, ws := range s.clients {
+		if ws.id == id {
+			return ws
+		}
+	}
+	return nil
+}
+
+// ConnectionsByPubkey returns the connected clients authenticated as pubkey with NIP-42.
+// There can be several, as the same user may connect from many devices.
+func (s *Server) ConnectionsByPubkey(pubkey string) []*WebSocket {
+	var list []*WebSocket
+	for _, ws := range s.Connections() {
+		if ws.AuthedPubkey() == pubkey {
+			list = append(list, ws)
+		}
+	}
+	return list
+}
+
+// CloseSubscription ends subscription id of ws, telling the client why with a
+// CLOSED message. reason should start with a NIP-01 prefix like "blocked: ".
+func (s *Server) CloseSubscription(ws *WebSocket, id string, reason string) error {
+	s.removeListenerId(s.clientContext(context.Background(), ws), ws, id)
+	return ws.WriteJSON(nostr.ClosedEnvelope{SubscriptionID: id, Reason: reason})
+}
@@ -0,0 +1,105 @@
+package relayer
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/fasthttp/websocket"
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/nbd-wtf/go-nostr"
+	"go.uber.org/goleak"
+)
+
+type authTestRelay struct {
+	testRelay
+}
+
+func (*authTestRelay) ServiceURL() string { return "ws://relay.test" }
+
+// authenticate answers the AUTH challenge sent by srv on connection, signing with sk.
+func authenticate(t *testing.T, conn *websocket.Conn, sk string) {
+	t.Helper()
+	var challenge string
+	json.Unmarshal(readLabel(t, conn, "AUTH")[1], &challenge)
+
+	evt := nostr.Event{
+		Kind:      22242,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"relay", "ws://relay.test"}, {"challenge", challenge}},
+	}
+	evt.Sign(sk)
+	conn.WriteJSON([]any{"AUTH", evt})
+
+	var ok bool
+	json.Unmarshal(readLabel(t, conn, "OK")[2], &ok)
+	if !ok {
+		t.Fatal("authentication failed")
+	}
+}
+
+func TestTargetedMessaging(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	srv, err := NewServer(&authTestRelay{testRelay{storage: &slicestore.SliceStore{}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan bool)
+	go srv.Start("127.0.0.1", 0, started)
+	<-started
+	defer srv.Shutdown(context.Background())
+
+	sk := nostr.GeneratePrivateKey()
+	pk, _ := nostr.GetPublicKey(sk)
+	conn := dialTestRelay(t, srv)
+	defer conn.Close()
+	authenticate(t, conn, sk)
+	other := dialTestRelay(t, srv)
+	defer other.Close()
+	readLabel(t, other, "AUTH")
+
+	if n := len(srv.Connections()); n != 2 {
+		t.Fatalf("%d connections; want 2", n)
+	}
+	found := srv.ConnectionsByPubkey(pk)
+	if len(found) != 1 {
+		t.Fatalf("found %d connections for pubkey; want 1", len(found))
+	}
+	ws := found[0]
+	if srv.Connection(ws.ID()) != ws {
+		t.Error("connection not found by id")
+	}
+
+	ws.SendNotice("your subscription expires tomorrow")
+	var notice string
+	json.Unmarshal(readLabel(t, conn, "NOTICE")[1], &notice)
+	if notice != "your subscription expires tomorrow" {
+		t.Errorf("got notice %q", notice)
+	}
+
+	conn.WriteJSON([]any{"REQ", "feed", nostr.Filter{Kinds: []int{1}}})
+	readLabel(t, conn, "EOSE")
+	ws.SendEvent("feed", signedNote("just for you"))
+	var evt nostr.Event
+	json.Unmarshal(readLabel(t, conn, "EVENT")[2], &evt)
+	if evt.Content != "just for you" {
+		t.Errorf("got event %q", evt.Content)
+	}
+
+	srv.CloseSubscription(ws, "feed", "blocked: subscription expired")
+	var reason string
+	json.Unmarshal(readLabel(t, conn, "CLOSED")[2], &reason)
+	if reason != "blocked: subscription expired" {
+		t.Errorf("got CLOSED reason %q", reason)
+	}
+	if n := len(srv.GetListeningFilters()); n != 0 {
+		t.Errorf("%d filters left after CloseSubscription", n)
+	}
+
+	ws.Disconnect("banned")
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Errorf("got %v after Disconnect; want a policy violation close", err)
+	}
+}
@@ -0,0 +1,175 @@
+package relayer
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// QueryBudget is how much each REQ or COUNT can cost, as estimated by a
+// [CostEstimator], summing all its filters. Zero budgets are unlimited.
+type QueryBudget struct {
+	// Unauthenticated is the budget of clients that haven't authenticated with NIP-42.
+	Unauthenticated float64 `json:"unauthenticated,omitempty"`
+	// Authenticated is the budget of authenticated clients.
+	Authenticated float64 `json:"authenticated,omitempty"`
+
+	// Degrade makes the server narrow down queries over budget instead of rejecting
+	// them: each expensive filter gets its limit lowered and, if that is not enough,
+	// its since moved forward until it fits. Subscriptions still get all new events
+	// matching the original filters, and COUNT replies are marked as approximate.
+	Degrade bool `json:"-"`
+}
+
+// WithQueryBudget rejects or degrades REQ and COUNT messages estimated to cost more
+// than budget. Also reported as query_budget in the NIP-11 limitation object.
+func WithQueryBudget(budget QueryBudget) Option {
+	return func(o *Options) {
+		o.queryBudget = &budget
+	}
+}
+
+// WithCostEstimator sets the estimator used by WithQueryBudget, taking precedence
+// over the storage one, if any.
+func WithCostEstimator(estimator CostEstimator) Option {
+	return func(o *Options) {
+		o.costEstimator = estimator
+	}
+}
+
+// CostEstimatorFunc is a function implementing [CostEstimator].
+type CostEstimatorFunc func(ctx context.Context, filter nostr.Filter) float64
+
+func (f CostEstimatorFunc) EstimateCost(ctx context.Context, filter nostr.Filter) float64 {
+	return f(ctx, filter)
+}
+
+// DefaultCostEstimator scores filters by selectivity, time range and limit, assuming
+// a storage indexed by id, author, tag, kind and created_at:
+//
+//   - a lookup by id costs 1 per id;
+//   - a filter with nothing selective scans everything, costing 100000;
+//   - authors and tag values narrow that down to 1000 per value, and kinds to a
+//     tenth of it per kind;
+//   - a time range under 30 days costs proportionally less;
+//   - the cost never exceeds the limit, if there is one.
+var DefaultCostEstimator CostEstimator = CostEstimatorFunc(defaultCost)
+
+func defaultCost(ctx context.Context, f nostr.Filter) float64 {
+	if f.LimitZero {
+		return 0
+	}
+	if len(f.IDs) > 0 {
+		return float64(len(f.IDs))
+	}
+
+	cost := 100000.0
+	if n := len(f.Authors); n > 0 {
+		cost = min(cost, 1000*float64(n))
+	}
+	for _, values := range f.Tags {
+		cost = min(cost, 1000*float64(len(values)))
+	}
+	if n := len(f.Kinds); n > 0 {
+		cost *= min(1, float64(n)/10)
+	}
+	if f.Since != nil {
+		until := nostr.Now()
+		if f.Until != nil {
+			until = *f.Until
+		}
+		days := float64(until-*f.Since) / 86400
+		cost *= min(1, max(days, 1.0/24)/30)
+	}
+	if f.Limit > 0 {
+		cost = min(cost, float64(f.Limit))
+	}
+	return max(cost, 1)
+}
+
+// costEstimator returns the estimator for queries to store.
+func (s *Server) costEstimator(store eventstore.Store) CostEstimator {
+	if s.options.costEstimator != nil {
+		return s.options.costEstimator
+	}
+	if estimator, ok := store.(CostEstimator); ok {
+		return estimator
+	}
+	return DefaultCostEstimator
+}
+
+// checkCost checks filters against the query budget of a client authenticated as
+// authed, if at all. It returns the filters to query the storage with, which are
+// degraded if they didn't fit and the budget allows it, or a rejection reason.
+func (s *Server) checkCost(ctx context.Context, store eventstore.Store, filters nostr.Filters, authed string) (query nostr.Filters, degraded bool, reason string) {
+	qb := s.options.queryBudget
+	if qb == nil {
+		return filters, false, ""
+	}
+	budget := qb.Unauthenticated
+	if authed != "" {
+		budget = qb.Authenticated
+	}
+	if budget <= 0 {
+		return filters, false, ""
+	}
+
+	estimator := s.costEstimator(store)
+	total := 0.0
+	for _, filter := range filters {
+		total += estimator.EstimateCost(ctx, filter)
+	}
+	if total <= budget {
+		return filters, false, ""
+	}
+	rejection := fmt.Sprintf("blocked: query too expensive (estimated cost %.0f, budget %.0f)", total, budget)
+	if !qb.Degrade {
+		return nil, false, rejection
+	}
+
+	// each filter gets an equal share of the budget
+	share := budget / float64(len(filters))
+	query = make(nostr.Filters, len(filters))
+	for i, filter := range filters {
+		var ok bool
+		if query[i], ok = degradeFilter(ctx, estimator, filter, share); !ok {
+			return nil, false, rejection
+		}
+	}
+	return query, true, ""
+}
+
+// degradeFilter lowers the limit of filter and then moves its since forward, halving
+// the time range each time, until its cost is at most budget.
+func degradeFilter(ctx context.Context, estimator CostEstimator, filter nostr.Filter, budget float64) (nostr.Filter, bool) {
+	if estimator.EstimateCost(ctx, filter) <= budget {
+		return filter, true
+	}
+
+	if limit := int(math.Max(1, budget)); filter.Limit == 0 || filter.Limit > limit {
+		filter.Limit = limit
+		if estimator.EstimateCost(ctx, filter) <= budget {
+			return filter, true
+		}
+	}
+
+	until := nostr.Now()
+	if filter.Until != nil {
+		until = *filter.Until
+	}
+	window := nostr.Timestamp(30 * 24 * 60 * 60)
+	if filter.Since != nil && until-*filter.Since < window {
+		window = until - *filter.Since
+	}
+	for ; window >= 60*60; window /= 2 {
+		since := until - window
+		filter.Since = &since
+		if estimator.EstimateCost(ctx, filter) <= budget {
+			return filter, true
+		}
+	}
+	return filter, false
+}
@@ -0,0 +1,86 @@
+package relayer
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestDefaultCostEstimator(t *testing.T) {
+	ctx := context.Background()
+	cost := func(f nostr.Filter) float64 { return DefaultCostEstimator.EstimateCost(ctx, f) }
+	day := nostr.Now() - 86400
+	pubkey := strings.Repeat("ab", 32)
+
+	openEnded := cost(nostr.Filter{})
+	kinds := cost(nostr.Filter{Kinds: []int{1}})
+	lastDay := cost(nostr.Filter{Kinds: []int{1}, Since: &day})
+	author := cost(nostr.Filter{Authors: []string{pubkey}})
+	if !(openEnded > kinds && kinds > lastDay && openEnded > author) {
+		t.Errorf("costs not ordered by selectivity: open-ended %v, kinds %v, last day %v, author %v", openEnded, kinds, lastDay, author)
+	}
+	if c := cost(nostr.Filter{Limit: 20}); c != 20 {
+		t.Errorf("limited filter costs %v", c)
+	}
+	if c := cost(nostr.Filter{IDs: []string{pubkey}}); c != 1 {
+		t.Errorf("id lookup costs %v", c)
+	}
+}
+
+type costlyStore struct {
+	slicestore.SliceStore
+}
+
+func (*costlyStore) EstimateCost(ctx context.Context, filter nostr.Filter) float64 {
+	if filter.Limit > 0 {
+		return float64(filter.Limit)
+	}
+	return 1e9
+}
+
+func TestQueryBudget(t *testing.T) {
+	ctx := context.Background()
+	srv, _ := NewServer(&testRelay{storage: &costlyStore{}}, WithQueryBudget(QueryBudget{Unauthenticated: 100, Authenticated: 1000}))
+	defer srv.Shutdown(ctx)
+	store := srv.relay.Storage(ctx)
+
+	open := nostr.Filters{{Kinds: []int{1}}}
+	if _, _, reason := srv.checkCost(ctx, store, open, ""); !strings.HasPrefix(reason, "blocked: query too expensive") {
+		t.Errorf("open-ended filter: got %q", reason)
+	}
+	limited := nostr.Filters{{Kinds: []int{1}, Limit: 500}}
+	if _, _, reason := srv.checkCost(ctx, store, limited, ""); reason == "" {
+		t.Error("filter over the unauthenticated budget accepted")
+	}
+	if _, _, reason := srv.checkCost(ctx, store, limited, "somebody"); reason != "" {
+		t.Errorf("filter within the authenticated budget: got %q", reason)
+	}
+
+	srv.options.queryBudget.Degrade = true
+	query, degraded, reason := srv.checkCost(ctx, store, append(open, limited...), "")
+	if reason != "" || !degraded || query[0].Limit != 50 || query[1].Limit != 50 {
+		t.Errorf("degraded: %v %v %q", query, degraded, reason)
+	}
+	if open[0].Limit != 0 {
+		t.Error("original filter modified")
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept", "application/nostr+json")
+	srv.ServeHTTP(w, r)
+	var info struct {
+		Limitation struct {
+			QueryBudget QueryBudget `json:"query_budget"`
+		} `json:"limitation"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &info)
+	if b := info.Limitation.QueryBudget; b.Unauthenticated != 100 || b.Authenticated != 1000 {
+		t.Errorf("NIP-11 query_budget: %s", w.Body)
+	}
+}
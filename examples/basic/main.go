@@ -34,27 +34,17 @@ func (r *Relay) Init() error {
 		return fmt.Errorf("couldn't process envconfig: %w", err)
 	}
 
-	// every hour, delete all very old events
-	go func() {
-		db := r.Storage(context.TODO()).(*postgresql.PostgresBackend)
-
-		for {
-			time.Sleep(60 * time.Minute)
-			db.DB.Exec(`DELETE FROM event WHERE created_at < $1`, time.Now().AddDate(0, -3, 0).Unix()) // 3 months
-		}
-	}()
-
 	return nil
 }
 
-func (r *Relay) AcceptEvent(ctx context.Context, evt *nostr.Event) bool {
+func (r *Relay) AcceptEvent(ctx context.Context, evt *nostr.Event) (bool, string) {
 	// block events that are too large
 	jsonb, _ := json.Marshal(evt)
 	if len(jsonb) > 10000 {
-		return false
+		return false, "invalid: event too large"
 	}
 
-	return true
+	return true, ""
 }
 
 func main() {
@@ -64,7 +54,9 @@ func main() {
 		return
 	}
 	r.storage = &postgresql.PostgresBackend{DatabaseURL: r.PostgresDatabase}
-	server, err := relayer.NewServer(&r)
+	// every hour, delete events older than 3 months
+	server, err := relayer.NewServer(&r,
+		relayer.WithRetention(time.Hour, relayer.RetentionRule{MaxAge: 90 * 24 * time.Hour}))
 	if err != nil {
 		log.Fatalf("failed to create server: %v", err)
 	}
@@ -36,32 +36,22 @@ func (r *Relay) Storage(ctx context.Context) eventstore.Store {
 }
 
 func (r *Relay) Init() error {
-	// every hour, delete all very old events
-	go func() {
-		db := r.Storage(context.TODO()).(*postgresql.PostgresBackend)
-
-		for {
-			time.Sleep(60 * time.Minute)
-			db.DB.Exec(`DELETE FROM event WHERE created_at < $1`, time.Now().AddDate(0, -3, 0).Unix()) // 6 months
-		}
-	}()
-
 	return nil
 }
 
-func (r *Relay) AcceptEvent(ctx context.Context, evt *nostr.Event) bool {
+func (r *Relay) AcceptEvent(ctx context.Context, evt *nostr.Event) (bool, string) {
 	// only accept they have a good preimage for a paid invoice for their public key
 	if !checkInvoicePaidOk(evt.PubKey) {
-		return false
+		return false, "restricted: pay for a ticket first"
 	}
 
 	// block events that are too large
 	jsonb, _ := json.Marshal(evt)
 	if len(jsonb) > 100000 {
-		return false
+		return false, "invalid: event too large"
 	}
 
-	return true
+	return true, ""
 }
 
 func main() {
@@ -71,7 +61,9 @@ func main() {
 		return
 	}
 	r.storage = &postgresql.PostgresBackend{DatabaseURL: r.PostgresDatabase}
-	server, err := relayer.NewServer(&r)
+	// every hour, delete events older than 3 months
+	server, err := relayer.NewServer(&r,
+		relayer.WithRetention(time.Hour, relayer.RetentionRule{MaxAge: 90 * 24 * time.Hour}))
 	if err != nil {
 		log.Fatalf("failed to create server: %v", err)
 	}
@@ -26,6 +26,7 @@ type Relay struct {
 
 	updates     chan nostr.Event
 	lastEmitted sync.Map
+	lastChecked sync.Map // feed url -> time.Time
 	db          *pebble.DB
 }
 
@@ -45,50 +46,78 @@ func (relay *Relay) Init() error {
 		relay.db = db
 	}
 
-	go func() {
-		time.Sleep(20 * time.Minute)
+	return nil
+}
 
-		filters := relayer.GetListeningFilters()
-		log.Printf("checking for updates; %d filters active", len(filters))
+// OnSubscribe checks the feeds of the authors a client just subscribed to for new items.
+func (relay *Relay) OnSubscribe(ctx context.Context, id string, filters nostr.Filters) {
+	go relay.checkUpdates(filters)
+}
 
-		for _, filter := range filters {
-			if filter.Kinds == nil || slices.Contains(filter.Kinds, nostr.KindTextNote) {
-				for _, pubkey := range filter.Authors {
-					if val, closer, err := relay.db.Get([]byte(pubkey)); err == nil {
-						defer closer.Close()
+func (relay *Relay) OnUnsubscribe(ctx context.Context, id string) {}
+func (relay *Relay) OnDisconnect(ctx context.Context)             {}
 
-						var entity Entity
-						if err := json.Unmarshal(val, &entity); err != nil {
-							log.Printf("got invalid json from db at key %s: %v", pubkey, err)
-							continue
-						}
+// a feed isn't fetched again sooner than this, however many clients subscribe to it.
+const minRefreshInterval = 5 * time.Minute
 
-						feed, err := parseFeed(entity.URL)
-						if err != nil {
-							log.Printf("failed to parse feed at url %q: %v", entity.URL, err)
-							continue
-						}
+// claimCheck tells if the feed at url is due for a check, marking it as checked now.
+func (relay *Relay) claimCheck(url string) bool {
+	now := time.Now()
+	for {
+		last, loaded := relay.lastChecked.LoadOrStore(url, now)
+		if !loaded {
+			return true
+		}
+		if now.Sub(last.(time.Time)) < minRefreshInterval {
+			return false
+		}
+		if relay.lastChecked.CompareAndSwap(url, last, now) {
+			return true
+		}
+	}
+}
+
+func (relay *Relay) checkUpdates(filters nostr.Filters) {
+	log.Printf("checking for updates; %d filters", len(filters))
+
+	for _, filter := range filters {
+		if filter.Kinds == nil || slices.Contains(filter.Kinds, nostr.KindTextNote) {
+			for _, pubkey := range filter.Authors {
+				if val, closer, err := relay.db.Get([]byte(pubkey)); err == nil {
+					defer closer.Close()
+
+					var entity Entity
+					if err := json.Unmarshal(val, &entity); err != nil {
+						log.Printf("got invalid json from db at key %s: %v", pubkey, err)
+						continue
+					}
+					if !relay.claimCheck(entity.URL) {
+						continue
+					}
 
-						for _, item := range feed.Items {
-							evt := itemToTextNote(pubkey, item)
-							last, ok := relay.lastEmitted.Load(entity.URL)
-							if !ok || time.Unix(last.(int64), 0).Before(evt.CreatedAt.Time()) {
-								evt.Sign(entity.PrivateKey)
-								relay.updates <- evt
-								relay.lastEmitted.Store(entity.URL, last)
-							}
+					feed, err := parseFeed(entity.URL)
+					if err != nil {
+						log.Printf("failed to parse feed at url %q: %v", entity.URL, err)
+						continue
+					}
+
+					for _, item := range feed.Items {
+						evt := itemToTextNote(pubkey, item)
+						last, ok := relay.lastEmitted.Load(entity.URL)
+						if !ok || time.Unix(int64(last.(uint32)), 0).Before(evt.CreatedAt.Time()) {
+							evt.Sign(entity.PrivateKey)
+							relay.updates <- evt
+							relay.lastEmitted.Store(entity.URL, uint32(evt.CreatedAt))
 						}
 					}
 				}
 			}
 		}
-	}()
-
-	return nil
+	}
 }
 
-func (relay *Relay) AcceptEvent(ctx context.Context, _ *nostr.Event) bool {
-	return false
+func (relay *Relay) AcceptEvent(ctx context.Context, _ *nostr.Event) (bool, string) {
+	return false, "blocked: we don't accept any events"
 }
 
 func (relay *Relay) Storage(ctx context.Context) eventstore.Store {
@@ -105,6 +134,10 @@ func (b store) SaveEvent(ctx context.Context, _ *nostr.Event) error {
 	return errors.New("blocked: we don't accept any events")
 }
 
+func (b store) ReplaceEvent(ctx context.Context, _ *nostr.Event) error {
+	return errors.New("blocked: we don't accept any events")
+}
+
 func (b store) DeleteEvent(ctx context.Context, target *nostr.Event) error {
 	return errors.New("blocked: we can't delete any events")
 }
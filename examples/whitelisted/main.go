@@ -15,6 +15,7 @@ import (
 type Relay struct {
 	PostgresDatabase string   `envconfig:"POSTGRESQL_DATABASE"`
 	Whitelist        []string `envconfig:"WHITELIST"`
+	BanFile          string   `envconfig:"BAN_FILE" default:"bans.json"`
 
 	storage *postgresql.PostgresBackend
 }
@@ -31,7 +32,7 @@ func (r *Relay) Init() error {
 	return nil
 }
 
-func (r *Relay) AcceptEvent(ctx context.Context, evt *nostr.Event) bool {
+func (r *Relay) AcceptEvent(ctx context.Context, evt *nostr.Event) (bool, string) {
 	// disallow anything from non-authorized pubkeys
 	found := false
 	for _, pubkey := range r.Whitelist {
@@ -41,16 +42,16 @@ func (r *Relay) AcceptEvent(ctx context.Context, evt *nostr.Event) bool {
 		}
 	}
 	if !found {
-		return false
+		return false, "restricted: not on the whitelist"
 	}
 
 	// block events that are too large
 	jsonb, _ := json.Marshal(evt)
 	if len(jsonb) > 100000 {
-		return false
+		return false, "invalid: event too large"
 	}
 
-	return true
+	return true, ""
 }
 
 func main() {
@@ -60,7 +61,7 @@ func main() {
 		return
 	}
 	r.storage = &postgresql.PostgresBackend{DatabaseURL: r.PostgresDatabase}
-	server, err := relayer.NewServer(&r)
+	server, err := relayer.NewServer(&r, relayer.WithBanFile(r.BanFile))
 	if err != nil {
 		log.Fatalf("failed to create server: %v", err)
 	}
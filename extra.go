@@ -10,7 +10,53 @@ func GetAuthStatus(ctx context.Context) (pubkey string, ok bool) {
 		return "", false
 	}
 	if ws, ok := value.(*WebSocket); ok {
-		return ws.authed, true
+		return ws.AuthedPubkey(), true
 	}
 	return "", false
 }
+
+type serverContextKey struct{}
+
+// clientContext returns ctx carrying the client ws and the server s, as given to
+// relay methods called on behalf of a websocket client.
+func (s *Server) clientContext(ctx context.Context, ws *WebSocket) context.Context {
+	ctx = context.WithValue(ctx, AUTH_CONTEXT_KEY, ws)
+	return ContextWithServer(ctx, s)
+}
+
+// ContextWithServer returns ctx carrying s, so the package-level [AddEvent] called
+// with it stores and broadcasts events through s.
+func ContextWithServer(ctx context.Context, s *Server) context.Context {
+	return context.WithValue(ctx, serverContextKey{}, s)
+}
+
+// serverFromContext returns the Server handling the message ctx was created for, if any.
+func serverFromContext(ctx context.Context) *Server {
+	s, _ := ctx.Value(serverContextKey{}).(*Server)
+	return s
+}
+
+// GetClientIP returns the IP address of the client that sent the message ctx was
+// created for, if it came from a websocket connection.
+func GetClientIP(ctx context.Context) (ip string, ok bool) {
+	if ws, ok := ctx.Value(AUTH_CONTEXT_KEY).(*WebSocket); ok {
+		return ws.ip, true
+	}
+	return "", false
+}
+
+type admissionContextKey struct{}
+
+// admission carries decisions made by [Relay.AcceptEvent] that don't fit its return values.
+type admission struct {
+	shadowRejected bool
+}
+
+// ShadowReject can be called from [Relay.AcceptEvent] before returning true, so that
+// the client is told the event was accepted while it is in fact neither stored nor
+// broadcast. It does nothing when ctx doesn't come from [AddEvent].
+func ShadowReject(ctx context.Context) {
+	if a, ok := ctx.Value(admissionContextKey{}).(*admission); ok {
+		a.shadowRejected = true
+	}
+}
@@ -0,0 +1,274 @@
+package relayer
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// FilterChange is sent by [Server.WatchFilters] when a distinct filter starts or
+// stops being used by the live subscriptions of a server.
+type FilterChange struct {
+	Filter nostr.Filter
+
+	// Active is true when the first subscription using Filter was opened and
+	// false when the last one was closed.
+	Active bool
+}
+
+// filterIndex counts how many live subscriptions use each distinct filter, as
+// told apart by nostr.FilterEqual.
+type filterIndex struct {
+	filters map[string]*indexedFilter
+	order   []string // keys in insertion order, so results are stable
+}
+
+type indexedFilter struct {
+	filter nostr.Filter
+	refs   int
+}
+
+func newFilterIndex() *filterIndex {
+	return &filterIndex{filters: make(map[string]*indexedFilter)}
+}
+
+// add references filters, returning the changes that caused.
+func (idx *filterIndex) add(filters nostr.Filters) []FilterChange {
+	var changes []FilterChange
+	for _, filter := range filters {
+		key := filterKey(filter)
+		if f, ok := idx.filters[key]; ok {
+			f.refs++
+			continue
+		}
+		idx.filters[key] = &indexedFilter{filter: filter, refs: 1}
+		idx.order = append(idx.order, key)
+		changes = append(changes, FilterChange{Filter: filter, Active: true})
+	}
+	return changes
+}
+
+// remove dereferences filters, returning the changes that caused.
+func (idx *filterIndex) remove(filters nostr.Filters) []FilterChange {
+	var changes []FilterChange
+	for _, filter := range filters {
+		key := filterKey(filter)
+		f, ok := idx.filters[key]
+		if !ok {
+			continue
+		}
+		if f.refs--; f.refs > 0 {
+			continue
+		}
+		delete(idx.filters, key)
+		idx.order = slices.DeleteFunc(idx.order, func(k string) bool { return k == key })
+		changes = append(changes, FilterChange{Filter: f.filter, Active: false})
+	}
+	return changes
+}
+
+func (idx *filterIndex) list() nostr.Filters {
+	filters := make(nostr.Filters, 0, len(idx.order))
+	for _, key := range idx.order {
+		filters = append(filters, idx.filters[key].filter)
+	}
+	return filters
+}
+
+// filterKey returns the same string for filters nostr.FilterEqual considers equal.
+func filterKey(filter nostr.Filter) string {
+	var b strings.Builder
+
+	kinds := slices.Clone(filter.Kinds)
+	slices.Sort(kinds)
+	b.WriteString("k")
+	for _, kind := range kinds {
+		b.WriteString(":")
+		b.WriteString(strconv.Itoa(kind))
+	}
+
+	writeSorted := func(label string, values []string) {
+		values = slices.Clone(values)
+		slices.Sort(values)
+		b.WriteString("|")
+		b.WriteString(label)
+		for _, v := range values {
+			b.WriteString(":")
+			b.WriteString(strconv.Quote(v))
+		}
+	}
+	writeSorted("i", filter.IDs)
+	writeSorted("a", filter.Authors)
+
+	tags := make([]string, 0, len(filter.Tags))
+	for tag := range filter.Tags {
+		tags = append(tags, tag)
+	}
+	slices.Sort(tags)
+	for _, tag := range tags {
+		writeSorted("#"+strconv.Quote(tag), filter.Tags[tag])
+	}
+
+	if filter.Since != nil {
+		b.WriteString("|s:" + strconv.FormatInt(int64(*filter.Since), 10))
+	}
+	if filter.Until != nil {
+		b.WriteString("|u:" + strconv.FormatInt(int64(*filter.Until), 10))
+	}
+	if filter.Search != "" {
+		b.WriteString("|q:" + strconv.Quote(filter.Search))
+	}
+	if filter.LimitZero {
+		b.WriteString("|z")
+	}
+	return b.String()
+}
+
+// WatchFilters returns a channel getting a [FilterChange] every time a distinct filter
+// starts or stops being used by the live subscriptions of this server, starting with
+// the filters already in use. It is how relays that fetch events from elsewhere, like
+// bridges, learn what clients want.
+//
+// A watcher that doesn't take a change within 10 seconds is dropped and its channel
+// closed, as are the channels of all watchers when ctx is done or the server shuts down.
+func (s *Server) WatchFilters(ctx context.Context) <-chan FilterChange {
+	s.listenersMu.Lock()
+	s.watchersMu.Lock()
+	defer s.watchersMu.Unlock()
+	current := s.filterIndex.list()
+	s.listenersMu.Unlock()
+
+	w := &filterWatcher{
+		ctx:  ctx,
+		ch:   make(chan FilterChange, len(current)+defaultSubscribeBuffer),
+		done: make(chan struct{}),
+		wake: make(chan struct{}, 1),
+	}
+	for _, filter := range current {
+		w.ch <- FilterChange{Filter: filter, Active: true}
+	}
+	s.watchers[w] = struct{}{}
+	go s.runWatcher(w)
+
+	return w.ch
+}
+
+// filterWatcher is a channel returned by WatchFilters. Changes are queued for it
+// while listenersMu is handed over, keeping their order, and delivered by runWatcher
+// so a slow watcher doesn't hold up subscriptions.
+type filterWatcher struct {
+	ctx  context.Context
+	ch   chan FilterChange
+	done chan struct{}
+
+	mu    sync.Mutex
+	queue []FilterChange
+	wake  chan struct{}
+}
+
+func (w *filterWatcher) enqueue(changes []FilterChange) {
+	w.mu.Lock()
+	w.queue = append(w.queue, changes...)
+	w.mu.Unlock()
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// runWatcher delivers the changes queued for w until it is dropped, then closes its
+// channel.
+func (s *Server) runWatcher(w *filterWatcher) {
+	defer close(w.ch)
+	drop := func() {
+		s.watchersMu.Lock()
+		defer s.watchersMu.Unlock()
+		s.dropWatcher(w)
+	}
+
+	for {
+		select {
+		case <-w.wake:
+		case <-w.ctx.Done():
+			drop()
+			return
+		case <-w.done:
+			return
+		}
+
+		w.mu.Lock()
+		changes := w.queue
+		w.queue = nil
+		w.mu.Unlock()
+		for _, change := range changes {
+			if !w.send(change) {
+				drop()
+				return
+			}
+		}
+	}
+}
+
+func (w *filterWatcher) send(change FilterChange) bool {
+	select {
+	case w.ch <- change:
+		return true
+	default:
+	}
+
+	timer := time.NewTimer(writeWait)
+	defer timer.Stop()
+	select {
+	case w.ch <- change:
+		return true
+	case <-w.ctx.Done():
+		return false
+	case <-w.done:
+		return false
+	case <-timer.C:
+		return false
+	}
+}
+
+// unlockListeners releases listenersMu, but first queues the filter changes made while
+// it was held for the watchers, so they are delivered in order.
+func (s *Server) unlockListeners() {
+	changes := s.filterChanges
+	s.filterChanges = nil
+	if len(changes) == 0 {
+		s.listenersMu.Unlock()
+		return
+	}
+
+	s.watchersMu.Lock()
+	defer s.watchersMu.Unlock()
+	s.listenersMu.Unlock()
+
+	for w := range s.watchers {
+		w.enqueue(changes)
+	}
+}
+
+// dropWatcher stops w, making runWatcher close its channel. Must be called with
+// watchersMu held.
+func (s *Server) dropWatcher(w *filterWatcher) {
+	if _, ok := s.watchers[w]; ok {
+		delete(s.watchers, w)
+		close(w.done)
+	}
+}
+
+// closeFilterWatchers drops every watcher, for Server.Shutdown.
+func (s *Server) closeFilterWatchers() {
+	s.watchersMu.Lock()
+	defer s.watchersMu.Unlock()
+	for w := range s.watchers {
+		s.dropWatcher(w)
+	}
+}
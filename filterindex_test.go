@@ -0,0 +1,136 @@
+package relayer
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/nbd-wtf/go-nostr"
+	"go.uber.org/goleak"
+)
+
+func TestFilterKey(t *testing.T) {
+	since := nostr.Timestamp(100)
+	a := nostr.Filter{Kinds: []int{1, 7}, Authors: []string{"b", "a"}, Tags: nostr.TagMap{"e": {"x", "y"}, "p": {"z"}}, Since: &since}
+	b := nostr.Filter{Kinds: []int{7, 1}, Authors: []string{"a", "b"}, Tags: nostr.TagMap{"p": {"z"}, "e": {"y", "x"}}, Since: &since, Limit: 10}
+	c := nostr.Filter{Kinds: []int{1, 7}, Authors: []string{"a", "b"}, Tags: nostr.TagMap{"e": {"x", "y"}, "p": {"z"}}}
+
+	if !nostr.FilterEqual(a, b) || filterKey(a) != filterKey(b) {
+		t.Errorf("equal filters got different keys: %s, %s", filterKey(a), filterKey(b))
+	}
+	if nostr.FilterEqual(a, c) || filterKey(a) == filterKey(c) {
+		t.Errorf("different filters got the same key: %s", filterKey(a))
+	}
+}
+
+func TestFilterIndex(t *testing.T) {
+	idx := newFilterIndex()
+	notes := nostr.Filter{Kinds: []int{1}}
+	profiles := nostr.Filter{Kinds: []int{0}}
+
+	if changes := idx.add(nostr.Filters{notes, profiles}); len(changes) != 2 {
+		t.Errorf("first add: %v", changes)
+	}
+	if changes := idx.add(nostr.Filters{notes}); len(changes) != 0 {
+		t.Errorf("second add of the same filter: %v", changes)
+	}
+	if changes := idx.remove(nostr.Filters{notes}); len(changes) != 0 {
+		t.Errorf("filter still referenced was reported removed: %v", changes)
+	}
+	if changes := idx.remove(nostr.Filters{notes}); len(changes) != 1 || changes[0].Active {
+		t.Errorf("last reference removed: %v", changes)
+	}
+	if list := idx.list(); len(list) != 1 || !nostr.FilterEqual(list[0], profiles) {
+		t.Errorf("remaining filters: %v", list)
+	}
+}
+
+type observingRelay struct {
+	testRelay
+
+	mu     sync.Mutex
+	events []string
+}
+
+func (or *observingRelay) record(event string) {
+	or.mu.Lock()
+	defer or.mu.Unlock()
+	or.events = append(or.events, event)
+}
+
+func (or *observingRelay) OnSubscribe(ctx context.Context, id string, _ nostr.Filters) {
+	or.record("subscribe " + id)
+}
+
+func (or *observingRelay) OnUnsubscribe(ctx context.Context, id string) {
+	or.record("unsubscribe " + id)
+}
+
+func (or *observingRelay) OnDisconnect(ctx context.Context) {
+	if _, ok := GetClientIP(ctx); ok {
+		or.record("disconnect")
+	}
+}
+
+func (or *observingRelay) recorded() []string {
+	or.mu.Lock()
+	defer or.mu.Unlock()
+	return append([]string(nil), or.events...)
+}
+
+func TestSubscriptionObserver(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	rl := &observingRelay{testRelay: testRelay{storage: &slicestore.SliceStore{}}}
+	srv, err := NewServer(rl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan bool)
+	go srv.Start("127.0.0.1", 0, started)
+	<-started
+	defer srv.Shutdown(context.Background())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := srv.WatchFilters(ctx)
+
+	conn := dialTestRelay(t, srv)
+	conn.WriteJSON([]any{"REQ", "a", nostr.Filter{Kinds: []int{1}}})
+	readLabel(t, conn, "EOSE")
+	conn.WriteJSON([]any{"REQ", "b", nostr.Filter{Kinds: []int{1}}})
+	readLabel(t, conn, "EOSE")
+	conn.WriteJSON([]any{"CLOSE", "a"})
+
+	if change := <-changes; !change.Active || change.Filter.Kinds[0] != 1 {
+		t.Errorf("first change: %+v", change)
+	}
+
+	// messages are handled concurrently, so wait for CLOSE before disconnecting
+	for len(rl.recorded()) < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	conn.Close()
+	select {
+	case change := <-changes:
+		if change.Active {
+			t.Errorf("change after disconnect: %+v", change)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no change after disconnect")
+	}
+
+	want := []string{"subscribe a", "subscribe b", "unsubscribe a", "disconnect"}
+	got := rl.recorded()
+	if len(got) != len(want) {
+		t.Fatalf("observed %v; want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("observed %v; want %v", got, want)
+			break
+		}
+	}
+}
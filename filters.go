@@ -0,0 +1,113 @@
+package relayer
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// tags whose values are event ids or pubkeys, and so must be 32-byte hex.
+var hexTags = []string{"e", "p"}
+
+// normalizeFilters validates filters and puts them in canonical form before they reach
+// the storage: hex values are lowercased, repeated values removed and filters that can
+// never match anything left out. If a filter is malformed, reason is an "invalid:"
+// message describing the problem.
+func normalizeFilters(filters nostr.Filters) (normalized nostr.Filters, reason string) {
+	normalized = make(nostr.Filters, 0, len(filters))
+	for _, filter := range filters {
+		matchable, reason := normalizeFilter(&filter)
+		if reason != "" {
+			return nil, reason
+		}
+		if matchable {
+			normalized = append(normalized, filter)
+		}
+	}
+	return normalized, ""
+}
+
+// normalizeFilter normalizes f in place, telling whether it can match any event.
+func normalizeFilter(f *nostr.Filter) (matchable bool, reason string) {
+	if f.Limit < 0 {
+		return false, "invalid: negative limit"
+	}
+	if f.Since != nil && f.Until != nil && *f.Since > *f.Until {
+		return false, ""
+	}
+
+	var ok bool
+	if f.IDs, ok = normalizeHex(f.IDs); !ok {
+		return false, "invalid: ids must be 64-character hex strings"
+	}
+	if f.Authors, ok = normalizeHex(f.Authors); !ok {
+		return false, "invalid: authors must be 64-character hex strings"
+	}
+	for _, kind := range f.Kinds {
+		if kind < 0 || kind > 65535 {
+			return false, fmt.Sprintf("invalid: kind %d out of range", kind)
+		}
+	}
+	if f.Kinds != nil {
+		slices.Sort(f.Kinds)
+		f.Kinds = slices.Compact(f.Kinds)
+	}
+
+	for name, values := range f.Tags {
+		if slices.Contains(hexTags, name) {
+			if f.Tags[name], ok = normalizeHex(values); !ok {
+				return false, fmt.Sprintf("invalid: #%s values must be 64-character hex strings", name)
+			}
+		} else {
+			f.Tags[name] = dedupe(values)
+		}
+	}
+
+	// a present but empty list matches nothing, see nostr.Filter.Matches
+	if (f.IDs != nil && len(f.IDs) == 0) ||
+		(f.Authors != nil && len(f.Authors) == 0) ||
+		(f.Kinds != nil && len(f.Kinds) == 0) {
+		return false, ""
+	}
+	for _, values := range f.Tags {
+		if len(values) == 0 {
+			return false, ""
+		}
+	}
+
+	// there can't be more events than requested ids
+	if len(f.IDs) > 0 && (f.Limit == 0 || f.Limit > len(f.IDs)) && !f.LimitZero {
+		f.Limit = len(f.IDs)
+	}
+
+	return true, ""
+}
+
+// normalizeHex lowercases and dedupes values, which must all be 32-byte hex.
+func normalizeHex(values []string) ([]string, bool) {
+	for i, value := range values {
+		value = strings.ToLower(value)
+		if !nostr.IsValid32ByteHex(value) {
+			return nil, false
+		}
+		values[i] = value
+	}
+	return dedupe(values), true
+}
+
+// dedupe removes repeated values, keeping the first of each. It keeps nil as nil.
+func dedupe(values []string) []string {
+	if len(values) < 2 {
+		return values
+	}
+	seen := make(map[string]struct{}, len(values))
+	return slices.DeleteFunc(values, func(v string) bool {
+		if _, ok := seen[v]; ok {
+			return true
+		}
+		seen[v] = struct{}{}
+		return false
+	})
+}
@@ -0,0 +1,80 @@
+package relayer
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestNormalizeFilters(t *testing.T) {
+	id := strings.Repeat("ab", 32)
+	upper := strings.ToUpper(id)
+	since, until := nostr.Timestamp(200), nostr.Timestamp(100)
+
+	for _, tc := range []struct {
+		name   string
+		filter nostr.Filter
+		want   string // filter after normalizing, empty if dropped
+		reason string
+	}{
+		{"unchanged", nostr.Filter{Kinds: []int{1}, Limit: 10}, `{"kinds":[1],"limit":10}`, ""},
+		{"hex lowercased and deduplicated",
+			nostr.Filter{IDs: []string{upper, id}, Authors: []string{id, id}, Tags: nostr.TagMap{"p": {upper}, "t": {"x", "x", "y"}}},
+			`{"ids":["` + id + `"],"authors":["` + id + `"],"#p":["` + id + `"],"#t":["x","y"],"limit":1}`, ""},
+		{"kinds sorted and deduplicated", nostr.Filter{Kinds: []int{7, 1, 7}}, `{"kinds":[1,7]}`, ""},
+		{"limit 0 kept", nostr.Filter{Kinds: []int{1}, LimitZero: true}, `{"kinds":[1],"limit":0}`, ""},
+		{"since after until", nostr.Filter{Since: &since, Until: &until}, "", ""},
+		{"empty kinds", nostr.Filter{Kinds: []int{}}, "", ""},
+		{"empty tag", nostr.Filter{Tags: nostr.TagMap{"t": {}}}, "", ""},
+		{"short id", nostr.Filter{IDs: []string{"abcd"}}, "", "invalid: ids must be 64-character hex strings"},
+		{"bad author", nostr.Filter{Authors: []string{strings.Repeat("zz", 32)}}, "", "invalid: authors must be 64-character hex strings"},
+		{"bad #e", nostr.Filter{Tags: nostr.TagMap{"e": {"note1"}}}, "", "invalid: #e values must be 64-character hex strings"},
+		{"negative limit", nostr.Filter{Limit: -1}, "", "invalid: negative limit"},
+		{"kind out of range", nostr.Filter{Kinds: []int{70000}}, "", "invalid: kind 70000 out of range"},
+	} {
+		filters, reason := normalizeFilters(nostr.Filters{tc.filter})
+		if reason != tc.reason {
+			t.Errorf("%s: got reason %q, want %q", tc.name, reason, tc.reason)
+			continue
+		}
+		if tc.want == "" {
+			if len(filters) != 0 {
+				t.Errorf("%s: got %s, want it dropped", tc.name, filters[0])
+			}
+			continue
+		}
+		var want nostr.Filter
+		json.Unmarshal([]byte(tc.want), &want)
+		if len(filters) != 1 || !nostr.FilterEqual(filters[0], want) || filters[0].Limit != want.Limit || filters[0].LimitZero != want.LimitZero {
+			t.Errorf("%s: got %v, want %s", tc.name, filters, tc.want)
+		}
+	}
+}
+
+func TestReqInvalidFilters(t *testing.T) {
+	srv := startTestRelay(t, &testRelay{storage: &slicestore.SliceStore{}})
+	defer srv.Shutdown(context.Background())
+
+	conn := dialTestRelay(t, srv)
+	defer conn.Close()
+
+	conn.WriteJSON([]any{"REQ", "bad", nostr.Filter{Kinds: []int{1}}, nostr.Filter{IDs: []string{"xyz"}}})
+	var reason string
+	json.Unmarshal(readLabel(t, conn, "CLOSED")[2], &reason)
+	if !strings.HasPrefix(reason, "invalid: ") {
+		t.Errorf("got CLOSED reason %q", reason)
+	}
+
+	// a REQ that can't match anything ends right away, replacing any open one
+	conn.WriteJSON([]any{"REQ", "never", nostr.Filter{Kinds: []int{1}}})
+	readLabel(t, conn, "EOSE")
+	conn.WriteJSON([]any{"REQ", "never", json.RawMessage(`{"kinds":[]}`)})
+	readLabel(t, conn, "EOSE")
+	if n := len(srv.GetListeningFilters()); n != 0 {
+		t.Errorf("%d filters listening", n)
+	}
+}
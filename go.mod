@@ -5,9 +5,9 @@ go 1.23.1
 require (
 	github.com/PuerkitoBio/goquery v1.10.1
 	github.com/cockroachdb/pebble v1.1.4
+	github.com/coder/websocket v1.8.12
 	github.com/fasthttp/websocket v1.5.12
 	github.com/fiatjaf/eventstore v0.16.0
-	github.com/gobwas/ws v1.4.0
 	github.com/grokify/html-strip-tags-go v0.1.0
 	github.com/jb55/lnsocket/go v0.0.0-20230807153023-0fad35b1352d
 	github.com/kelseyhightower/envconfig v1.4.0
@@ -18,6 +18,7 @@ require (
 	github.com/rs/cors v1.11.1
 	github.com/stevelacy/daz v0.1.4
 	github.com/tidwall/gjson v1.18.0
+	go.starlark.net v0.0.0-20250205221240-492d3672b3f4
 	go.uber.org/goleak v1.3.0
 	golang.org/x/exp v0.0.0-20250128182459-e0ece0dbea4c
 	golang.org/x/time v0.10.0
@@ -53,7 +54,6 @@ require (
 	github.com/cockroachdb/logtags v0.0.0-20241215232642-bb51bb14a506 // indirect
 	github.com/cockroachdb/redact v1.1.6 // indirect
 	github.com/cockroachdb/tokenbucket v0.0.0-20230807174530-cc333fc44b06 // indirect
-	github.com/coder/websocket v1.8.12 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/decred/dcrd/crypto/blake256 v1.1.0 // indirect
 	github.com/decred/dcrd/dcrec/secp256k1/v4 v4.3.0 // indirect
@@ -66,8 +66,6 @@ require (
 	github.com/go-errors/errors v1.5.1 // indirect
 	github.com/go-logr/logr v1.4.2 // indirect
 	github.com/go-logr/stdr v1.2.2 // indirect
-	github.com/gobwas/httphead v0.1.0 // indirect
-	github.com/gobwas/pool v0.2.1 // indirect
 	github.com/gogo/protobuf v1.3.2 // indirect
 	github.com/golang/snappy v0.0.4 // indirect
 	github.com/jessevdk/go-flags v1.6.1 // indirect
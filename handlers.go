@@ -3,7 +3,6 @@ package relayer
 import (
 	"context"
 	"crypto/rand"
-	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -32,6 +31,10 @@ const (
 
 	// Maximum message size allowed from peer.
 	maxMessageSize = 512000
+
+	// Maximum messages from the same peer handled at once. The peer isn't read from
+	// while they are, so slow or rate limited messages hold back the next ones.
+	maxConcurrentMessages = 32
 )
 
 // TODO: consider moving these to Server as config params
@@ -41,98 +44,37 @@ var upgrader = websocket.Upgrader{
 	CheckOrigin:     func(r *http.Request) bool { return true },
 }
 
-func challenge(conn *websocket.Conn) *WebSocket {
+func challenge(conn *websocket.Conn, ip string) *WebSocket {
 	// NIP-42 challenge
 	challenge := make([]byte, 8)
 	rand.Read(challenge)
 
+	id := make([]byte, 8)
+	rand.Read(id)
+
 	return &WebSocket{
-		conn:      conn,
-		challenge: hex.EncodeToString(challenge),
+		conn:        conn,
+		id:          hex.EncodeToString(id),
+		ip:          ip,
+		connectedAt: time.Now(),
+		challenge:   hex.EncodeToString(challenge),
 	}
 }
 
 func (s *Server) doEvent(ctx context.Context, ws *WebSocket, request []json.RawMessage, store eventstore.Store) string {
-	advancedDeleter, _ := store.(AdvancedDeleter)
 	latestIndex := len(request) - 1
 
+	ws.eventsReceived.Add(1)
+
 	// it's a new event
 	var evt nostr.Event
 	if err := json.Unmarshal(request[latestIndex], &evt); err != nil {
+		s.strike(ctx, OffenseMalformed)
 		return "failed to decode event: " + err.Error()
 	}
 
-	// check id
-	hash := sha256.Sum256(evt.Serialize())
-	if id := hex.EncodeToString(hash[:]); id != evt.ID {
-		reason := "invalid: event id is computed incorrectly"
-		ws.WriteJSON(nostr.OKEnvelope{EventID: evt.ID, OK: false, Reason: reason})
-		return ""
-	}
-
-	// check signature
-	if ok, err := evt.CheckSignature(); err != nil {
-		ws.WriteJSON(nostr.OKEnvelope{EventID: evt.ID, OK: false, Reason: "error: failed to verify signature"})
-		return ""
-	} else if !ok {
-		ws.WriteJSON(nostr.OKEnvelope{EventID: evt.ID, OK: false, Reason: "invalid: signature is invalid"})
-		return ""
-	}
-
-	if evt.Kind == 5 {
-		// event deletion -- nip09
-		for _, tag := range evt.Tags {
-			if len(tag) >= 2 && tag[0] == "e" {
-				ctx, cancel := context.WithTimeout(ctx, time.Millisecond*200)
-				defer cancel()
-
-				// fetch event to be deleted
-				res, err := s.relay.Storage(ctx).QueryEvents(ctx, nostr.Filter{IDs: []string{tag[1]}})
-				if err != nil {
-					ws.WriteJSON(nostr.OKEnvelope{EventID: evt.ID, OK: false, Reason: "failed to query for target event"})
-					return ""
-				}
-
-				var target *nostr.Event
-				exists := false
-				select {
-				case target, exists = <-res:
-				case <-ctx.Done():
-				}
-				if !exists {
-					// this will happen if event is not in the database
-					// or when when the query is taking too long, so we just give up
-					continue
-				}
-
-				// check if this can be deleted
-				if target.PubKey != evt.PubKey {
-					ws.WriteJSON(nostr.OKEnvelope{EventID: evt.ID, OK: false, Reason: "insufficient permissions"})
-					return ""
-				}
-
-				if advancedDeleter != nil {
-					advancedDeleter.BeforeDelete(ctx, tag[1], evt.PubKey)
-				}
-
-				if err := store.DeleteEvent(ctx, target); err != nil {
-					ws.WriteJSON(nostr.OKEnvelope{EventID: evt.ID, OK: false, Reason: fmt.Sprintf("error: %s", err.Error())})
-					return ""
-				}
-
-				if advancedDeleter != nil {
-					advancedDeleter.AfterDelete(tag[1], evt.PubKey)
-				}
-			}
-		}
-
-		notifyListeners(&evt)
-		ws.WriteJSON(nostr.OKEnvelope{EventID: evt.ID, OK: true})
-		return ""
-	}
-
-	ok, reason := AddEvent(ctx, s.relay, &evt)
-	ws.WriteJSON(nostr.OKEnvelope{EventID: evt.ID, OK: ok, Reason: reason})
+	res := s.Publish(ctx, &evt, PublishOptions{})
+	ws.WriteJSON(nostr.OKEnvelope{EventID: evt.ID, OK: res.Accepted, Reason: res.Reason})
 	return ""
 }
 
@@ -148,14 +90,36 @@ func (s *Server) doCount(ctx context.Context, ws *WebSocket, request []json.RawM
 		return "COUNT has no <id>"
 	}
 
-	total := int64(0)
+	authed := ws.AuthedPubkey()
+	if !s.limiters.allow(ctx, "COUNT", ws.ip, authed, 1) {
+		ws.WriteJSON(nostr.ClosedEnvelope{SubscriptionID: id, Reason: "rate-limited: slow down"})
+		return ""
+	}
+
 	filters := make(nostr.Filters, len(request)-2)
 	for i, filterReq := range request[2:] {
 		if err := json.Unmarshal(filterReq, &filters[i]); err != nil {
 			return "failed to decode filter"
 		}
+	}
+
+	reason := s.checkFilters(filters)
+	if reason == "" {
+		filters, reason = normalizeFilters(filters)
+	}
+	if reason != "" {
+		ws.WriteJSON(nostr.ClosedEnvelope{SubscriptionID: id, Reason: reason})
+		return ""
+	}
 
-		filter := filters[i]
+	filters, approximate, reason := s.checkCost(ctx, store, filters, authed)
+	if reason != "" {
+		ws.WriteJSON(nostr.ClosedEnvelope{SubscriptionID: id, Reason: reason})
+		return ""
+	}
+
+	total := int64(0)
+	for _, filter := range filters {
 
 		// prevent kind-4 events from being returned to unauthed users,
 		//   only when authentication is a thing
@@ -164,13 +128,13 @@ func (s *Server) doCount(ctx context.Context, ws *WebSocket, request []json.RawM
 				senders := filter.Authors
 				receivers, _ := filter.Tags["p"]
 				switch {
-				case ws.authed == "":
+				case authed == "":
 					// not authenticated
 					return "restricted: this relay does not serve kind-4 to unauthenticated users, does your client implement NIP-42?"
-				case len(senders) == 1 && len(receivers) < 2 && (senders[0] == ws.authed):
-					// allowed filter: ws.authed is sole sender (filter specifies one or all receivers)
-				case len(receivers) == 1 && len(senders) < 2 && (receivers[0] == ws.authed):
-					// allowed filter: ws.authed is sole receiver (filter specifies one or all senders)
+				case len(senders) == 1 && len(receivers) < 2 && (senders[0] == authed):
+					// allowed filter: the authed pubkey is sole sender (filter specifies one or all receivers)
+				case len(receivers) == 1 && len(senders) < 2 && (receivers[0] == authed):
+					// allowed filter: the authed pubkey is sole receiver (filter specifies one or all senders)
 				default:
 					// restricted filter: do not return any events,
 					//   even if other elements in filters array were not restricted).
@@ -180,7 +144,15 @@ func (s *Server) doCount(ctx context.Context, ws *WebSocket, request []json.RawM
 			}
 		}
 
-		count, err := counter.CountEvents(ctx, filter)
+		var count int64
+		var err error
+		if approximateCounter, ok := counter.(ApproximateCounter); ok {
+			var inexact bool
+			count, inexact, err = approximateCounter.CountEventsApproximate(ctx, filter)
+			approximate = approximate || inexact
+		} else {
+			count, err = counter.CountEvents(ctx, filter)
+		}
 		if err != nil {
 			s.Log.Errorf("store: %v", err)
 			continue
@@ -188,7 +160,11 @@ func (s *Server) doCount(ctx context.Context, ws *WebSocket, request []json.RawM
 		total += count
 	}
 
-	ws.WriteJSON([]interface{}{"COUNT", id, map[string]int64{"count": total}})
+	if approximate {
+		ws.WriteJSON([]interface{}{"COUNT", id, map[string]any{"count": total, "approximate": true}})
+	} else {
+		ws.WriteJSON([]interface{}{"COUNT", id, map[string]int64{"count": total}})
+	}
 	return ""
 }
 
@@ -199,6 +175,12 @@ func (s *Server) doReq(ctx context.Context, ws *WebSocket, request []json.RawMes
 		return "REQ has no <id>"
 	}
 
+	authed := ws.AuthedPubkey()
+	if !s.limiters.allow(ctx, "REQ", ws.ip, authed, 1) {
+		ws.WriteJSON(nostr.ClosedEnvelope{SubscriptionID: id, Reason: "rate-limited: slow down"})
+		return ""
+	}
+
 	filters := make(nostr.Filters, len(request)-2)
 	for i, filterReq := range request[2:] {
 		if err := json.Unmarshal(
@@ -209,8 +191,41 @@ func (s *Server) doReq(ctx context.Context, ws *WebSocket, request []json.RawMes
 		}
 	}
 
+	// caps first, so oversized filters are turned down before doing any work on them
+	reason := s.checkFilters(filters)
+	if reason == "" {
+		filters, reason = normalizeFilters(filters)
+	}
+	if reason != "" {
+		ws.WriteJSON(nostr.ClosedEnvelope{SubscriptionID: id, Reason: reason})
+		return ""
+	}
+
+	if max := s.options.maxSubscriptions; max > 0 {
+		if !s.reserveListener(ws, id, max) {
+			reason := fmt.Sprintf("blocked: too many open subscriptions (max %d)", max)
+			ws.WriteJSON(nostr.ClosedEnvelope{SubscriptionID: id, Reason: reason})
+			return ""
+		}
+		defer s.releaseListener(ws, id)
+	}
+
+	if len(filters) == 0 {
+		// none of the filters can match anything, now or later, which replaces any
+		// subscription with the same id
+		s.removeListenerId(ctx, ws, id)
+		ws.WriteJSON(nostr.EOSEEnvelope(id))
+		return ""
+	}
+
+	query, _, reason := s.checkCost(ctx, store, filters, authed)
+	if reason != "" {
+		ws.WriteJSON(nostr.ClosedEnvelope{SubscriptionID: id, Reason: reason})
+		return ""
+	}
+
 	if accepter, ok := s.relay.(ReqAccepter); ok {
-		if !accepter.AcceptReq(ctx, id, filters, ws.authed) {
+		if !accepter.AcceptReq(ctx, id, filters, authed) {
 			return "REQ filters are not accepted"
 		}
 	}
@@ -224,13 +239,13 @@ func (s *Server) doReq(ctx context.Context, ws *WebSocket, request []json.RawMes
 				senders := filter.Authors
 				receivers, _ := filter.Tags["p"]
 				switch {
-				case ws.authed == "":
+				case authed == "":
 					// not authenticated
 					return "restricted: this relay does not serve kind-4 to unauthenticated users, does your client implement NIP-42?"
-				case len(senders) == 1 && len(receivers) < 2 && (senders[0] == ws.authed):
-					// allowed filter: ws.authed is sole sender (filter specifies one or all receivers)
-				case len(receivers) == 1 && len(senders) < 2 && (receivers[0] == ws.authed):
-					// allowed filter: ws.authed is sole receiver (filter specifies one or all senders)
+				case len(senders) == 1 && len(receivers) < 2 && (senders[0] == authed):
+					// allowed filter: the authed pubkey is sole sender (filter specifies one or all receivers)
+				case len(receivers) == 1 && len(senders) < 2 && (receivers[0] == authed):
+					// allowed filter: the authed pubkey is sole receiver (filter specifies one or all senders)
 				default:
 					// restricted filter: do not return any events,
 					//   even if other elements in filters array were not restricted).
@@ -239,38 +254,23 @@ func (s *Server) doReq(ctx context.Context, ws *WebSocket, request []json.RawMes
 				}
 			}
 		}
-
-		events, err := store.QueryEvents(ctx, filter)
-		if err != nil {
-			s.Log.Errorf("store: %v", err)
-			continue
-		}
-
-		// ensures the client won't be bombarded with events in case Storage doesn't do limits right
-		if filter.Limit == 0 {
-			filter.Limit = 9999999999
-		}
-		i := 0
-		if events != nil {
-			for event := range events {
-				if s.options.skipEventFunc != nil && s.options.skipEventFunc(event) {
-					continue
-				}
-				ws.WriteJSON(nostr.EventEnvelope{SubscriptionID: &id, Event: *event})
-				i++
-				if i > filter.Limit {
-					break
-				}
-			}
-
-			// exhaust the channel (in case we broke out of it early) so it is closed by the storage
-			for range events {
-			}
-		}
 	}
 
+	complete := s.queryStored(ctx, store, query, func(event *nostr.Event) bool {
+		return ws.send(id, event) == nil
+	})
+
 	ws.WriteJSON(nostr.EOSEEnvelope(id))
-	setListener(id, ws, filters)
+	if !complete && s.options.queryTimeoutMode == QueryTimeoutClosed {
+		// the client is told the subscription is closed, including one it replaced
+		s.removeListenerId(ctx, ws, id)
+		ws.WriteJSON(nostr.ClosedEnvelope{SubscriptionID: id, Reason: "error: query timed out, results are partial"})
+		return ""
+	}
+	s.setListener(ctx, id, ws, filters)
+	if !complete {
+		return "query for subscription " + id + " timed out, results are partial"
+	}
 	return ""
 }
 
@@ -281,7 +281,7 @@ func (s *Server) doClose(ctx context.Context, ws *WebSocket, request []json.RawM
 		return "CLOSE has no <id>"
 	}
 
-	removeListenerId(ws, id)
+	s.removeListenerId(ctx, ws, id)
 	return ""
 }
 
@@ -292,7 +292,13 @@ func (s *Server) doAuth(ctx context.Context, ws *WebSocket, request []json.RawMe
 			return "failed to decode auth event: " + err.Error()
 		}
 		if pubkey, ok := nip42.ValidateAuthEvent(&evt, ws.challenge, auther.ServiceURL()); ok {
+			if ban, banned := s.bans.pubkey(pubkey); banned {
+				ws.WriteJSON(nostr.OKEnvelope{EventID: evt.ID, OK: false, Reason: ban.message()})
+				return ""
+			}
+			ws.authMu.Lock()
 			ws.authed = pubkey
+			ws.authMu.Unlock()
 			ws.WriteJSON(nostr.OKEnvelope{EventID: evt.ID, OK: true})
 		} else {
 			ws.WriteJSON(nostr.OKEnvelope{EventID: evt.ID, OK: false, Reason: "error: failed to authenticate"})
@@ -309,13 +315,17 @@ func (s *Server) handleMessage(ctx context.Context, ws *WebSocket, message []byt
 		}
 	}()
 
+	ctx = s.clientContext(ctx, ws)
+
 	var request []json.RawMessage
 	if err := json.Unmarshal(message, &request); err != nil {
 		// stop silently
+		s.strike(ctx, OffenseMalformed)
 		return
 	}
 
 	if len(request) < 2 {
+		s.strike(ctx, OffenseMalformed)
 		notice = "request has less than 2 parameters"
 		return
 	}
@@ -323,8 +333,6 @@ func (s *Server) handleMessage(ctx context.Context, ws *WebSocket, message []byt
 	var typ string
 	json.Unmarshal(request[0], &typ)
 
-	ctx = context.WithValue(ctx, AUTH_CONTEXT_KEY, ws)
-
 	switch typ {
 	case "EVENT":
 		notice = s.doEvent(ctx, ws, request, store)
@@ -346,26 +354,46 @@ func (s *Server) handleMessage(ctx context.Context, ws *WebSocket, message []byt
 }
 
 func (s *Server) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
+	ip := s.clientIP(r)
+
+	s.inflightMu.RLock()
+	closing := s.closing
+	s.inflightMu.RUnlock()
+	if closing {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	if ban, banned := s.bans.ip(ip); banned {
+		http.Error(w, ban.message(), http.StatusForbidden)
+		return
+	}
+
+	s.clientsMu.Lock()
+	acquired := s.acquireConnection(ip)
+	s.clientsMu.Unlock()
+	if !acquired {
+		http.Error(w, "too many connections", http.StatusTooManyRequests)
+		return
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
+		s.clientsMu.Lock()
+		s.releaseConnection(ip)
+		s.clientsMu.Unlock()
 		s.Log.Errorf("failed to upgrade websocket: %v", err)
 		return
 	}
 	s.clientsMu.Lock()
 	defer s.clientsMu.Unlock()
-	s.clients[conn] = struct{}{}
+	ws := challenge(conn, ip)
+	ws.userAgent = r.UserAgent()
+	s.clients[conn] = ws
 	ticker := time.NewTicker(pingPeriod)
 
-	ip := conn.RemoteAddr().String()
-	if realIP := r.Header.Get("X-Forwarded-For"); realIP != "" {
-		ip = realIP // possible to be multiple comma separated
-	} else if realIP := r.Header.Get("X-Real-Ip"); realIP != "" {
-		ip = realIP
-	}
 	s.Log.Infof("connected from %s", ip)
 
-	ws := challenge(conn)
-
 	if s.options.perConnectionLimiter != nil {
 		ws.limiter = rate.NewLimiter(
 			s.options.perConnectionLimiter.Limit(),
@@ -379,16 +407,22 @@ func (s *Server) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
 
 	// reader
 	go func() {
+		handling := make(chan struct{}, maxConcurrentMessages)
+
 		defer func() {
 			cancel()
 			ticker.Stop()
 			s.clientsMu.Lock()
-			if _, ok := s.clients[conn]; ok {
+			_, ok := s.clients[conn]
+			if ok {
 				conn.Close()
 				delete(s.clients, conn)
-				removeListener(ws)
+				s.releaseConnection(ip)
 			}
 			s.clientsMu.Unlock()
+			if ok {
+				s.removeListener(ws)
+			}
 			s.Log.Infof("disconnected from %s", ip)
 		}()
 
@@ -413,11 +447,13 @@ func (s *Server) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
 					websocket.CloseNoStatusReceived, // 1005
 					websocket.CloseAbnormalClosure,  // 1006
 				) {
-					s.Log.Warningf("unexpected close error from %s: %v", r.Header.Get("X-Forwarded-For"), err)
+					s.Log.Warningf("unexpected close error from %s: %v", ip, err)
 				}
 				break
 			}
 
+			ws.messagesReceived.Add(1)
+
 			if ws.limiter != nil {
 				// NOTE: Wait will throttle the requests.
 				// To reject requests exceeding the limit, use if !ws.limiter.Allow()
@@ -432,7 +468,19 @@ func (s *Server) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
 				continue
 			}
 
-			go s.handleMessage(ctx, ws, message, store)
+			handling <- struct{}{}
+			if !s.trackInflight() {
+				// shutting down
+				<-handling
+				continue
+			}
+			go func() {
+				defer func() {
+					<-handling
+					s.inflight.Done()
+				}()
+				s.handleMessage(ctx, ws, message, store)
+			}()
 		}
 	}()
 
@@ -488,5 +536,15 @@ func (s *Server) HandleNIP11(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	json.NewEncoder(w).Encode(info)
+	info.Limitation = s.limitation(info.Limitation)
+
+	json.NewEncoder(w).Encode(struct {
+		nip11.RelayInformationDocument
+		Limitation limitationDocument `json:"limitation"`
+	}{info, limitationDocument{
+		RelayLimitationDocument: info.Limitation,
+		CreatedAtLowerLimit:     int64(s.options.eventLimits.MaxPast.Seconds()),
+		CreatedAtUpperLimit:     int64(s.options.eventLimits.MaxFuture.Seconds()),
+		QueryBudget:             s.options.queryBudget,
+	}})
 }
@@ -22,6 +22,7 @@ type Relay interface {
 	// If the returned value is true, the event is passed on to [Storage.SaveEvent].
 	// Otherwise, the server responds with a negative and "blocked" message as described
 	// in NIP-20.
+	// See also [ShadowReject] and [WritePolicyPlugin].
 	AcceptEvent(context.Context, *nostr.Event) (bool, string)
 	// Storage returns the relay storage implementation.
 	Storage(context.Context) eventstore.Store
@@ -59,6 +60,20 @@ type CustomWebSocketHandler interface {
 	HandleUnknownType(ws *WebSocket, typ string, request []json.RawMessage)
 }
 
+// SubscriptionObserver, if implemented, is told when websocket clients open and close
+// live subscriptions, so the relay can react to what they want, for instance by
+// fetching events from elsewhere. The client is available through ctx, see
+// [GetAuthStatus] and [GetClientIP]. See also [Server.WatchFilters].
+type SubscriptionObserver interface {
+	// OnSubscribe is called after a REQ opens a subscription or replaces one with
+	// the same id.
+	OnSubscribe(ctx context.Context, id string, filters nostr.Filters)
+	// OnUnsubscribe is called when a client closes a subscription with CLOSE.
+	OnUnsubscribe(ctx context.Context, id string)
+	// OnDisconnect is called when a client goes away, closing all its subscriptions.
+	OnDisconnect(ctx context.Context)
+}
+
 // ShutdownAware is called during the server shutdown.
 // See [Server.Shutdown] for details.
 type ShutdownAware interface {
@@ -87,3 +102,27 @@ type AdvancedSaver interface {
 type EventCounter interface {
 	CountEvents(ctx context.Context, filter nostr.Filter) (int64, error)
 }
+
+// ApproximateCounter is an [EventCounter] that can't always count exactly. When the
+// storage implements it, COUNT replies with an approximate count are marked as such.
+type ApproximateCounter interface {
+	EventCounter
+	CountEventsApproximate(ctx context.Context, filter nostr.Filter) (count int64, approximate bool, err error)
+}
+
+// CostEstimator estimates how expensive it is to query the storage for a filter, in
+// units roughly equivalent to the number of events the storage has to look at. When
+// the storage of a relay implements it, it replaces [DefaultCostEstimator].
+// See [WithQueryBudget].
+type CostEstimator interface {
+	EstimateCost(ctx context.Context, filter nostr.Filter) float64
+}
+
+// BatchSaver is implemented by storages that can save several events at once, for
+// instance in a single transaction. It is used with [WithWriteBatching].
+type BatchSaver interface {
+	// SaveEvents saves events, all of them of regular kinds, returning an error for each
+	// of them, in the same order: nil if it was saved, eventstore.ErrDupEvent if it
+	// was already stored or any other error.
+	SaveEvents(ctx context.Context, events []*nostr.Event) []error
+}
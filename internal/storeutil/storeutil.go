@@ -0,0 +1,64 @@
+// Package storeutil has the helpers for working with stores shared by relayer and
+// its subpackages.
+package storeutil
+
+import (
+	"cmp"
+	"context"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// SameValue compares two interface values without panicking on non-comparable types.
+func SameValue(a, b any) bool {
+	typ := reflect.TypeOf(a)
+	if typ == nil || typ != reflect.TypeOf(b) || !typ.Comparable() {
+		return false
+	}
+	return a == b
+}
+
+// Collect returns all events from store matching filter. If ctx is done first, the
+// rest of the events are drained in the background.
+func Collect(ctx context.Context, store eventstore.Store, filter nostr.Filter) ([]*nostr.Event, error) {
+	events, err := store.QueryEvents(ctx, filter)
+	if err != nil || events == nil {
+		return nil, err
+	}
+	var result []*nostr.Event
+	for {
+		select {
+		case evt, ok := <-events:
+			if !ok {
+				return result, nil
+			}
+			result = append(result, evt)
+		case <-ctx.Done():
+			go Drain(events)
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Drain reads events until the channel is closed, so the store sending them can finish.
+func Drain(events chan *nostr.Event) {
+	for range events {
+	}
+}
+
+// Merge merges several lists of events into a single one sorted by created_at
+// descending, then by id as NIP-01 prescribes, with no repeated events.
+func Merge(results [][]*nostr.Event) []*nostr.Event {
+	merged := slices.Concat(results...)
+	slices.SortFunc(merged, func(a, b *nostr.Event) int {
+		if c := cmp.Compare(b.CreatedAt, a.CreatedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	return slices.CompactFunc(merged, func(a, b *nostr.Event) bool { return a.ID == b.ID })
+}
@@ -0,0 +1,144 @@
+package relayer
+
+import (
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
+)
+
+// WithMaxConnections caps the total number of simultaneous websocket connections.
+// Upgrade requests over the cap get an HTTP 429 response.
+func WithMaxConnections(n int) Option {
+	return func(o *Options) {
+		o.maxConnections = n
+	}
+}
+
+// WithMaxConnectionsPerIP caps the number of simultaneous websocket connections
+// from a single client IP. Upgrade requests over the cap get an HTTP 429 response.
+func WithMaxConnectionsPerIP(n int) Option {
+	return func(o *Options) {
+		o.maxConnectionsPerIP = n
+	}
+}
+
+// WithMaxSubscriptions caps the number of open subscriptions per connection.
+// Also reported as max_subscriptions in NIP-11.
+func WithMaxSubscriptions(n int) Option {
+	return func(o *Options) {
+		o.maxSubscriptions = n
+	}
+}
+
+// WithMaxFilters caps the number of filters in a single REQ or COUNT.
+// Also reported as max_filters in NIP-11.
+func WithMaxFilters(n int) Option {
+	return func(o *Options) {
+		o.maxFilters = n
+	}
+}
+
+// WithMaxFilterValues caps how many ids, authors and values of each tag a
+// single filter can have. A zero value leaves that field unlimited.
+func WithMaxFilterValues(ids, authors, tagValues int) Option {
+	return func(o *Options) {
+		o.maxFilterIDs = ids
+		o.maxFilterAuthors = authors
+		o.maxFilterTagValues = tagValues
+	}
+}
+
+// the max limit used unless WithMaxLimit is given.
+const defaultMaxLimit = 500
+
+// WithMaxLimit caps the number of stored events returned for each filter of a REQ,
+// for filters with a higher limit or none at all, and so all filters together get at
+// most ten times n. Defaults to 500. Also reported as max_limit in NIP-11.
+func WithMaxLimit(n int) Option {
+	return func(o *Options) {
+		o.maxLimit = n
+	}
+}
+
+// checkFilters returns a CLOSED reason if filters exceed any of the configured caps.
+func (s *Server) checkFilters(filters nostr.Filters) string {
+	if max := s.options.maxFilters; max > 0 && len(filters) > max {
+		return fmt.Sprintf("invalid: too many filters (max %d)", max)
+	}
+
+	for _, filter := range filters {
+		if max := s.options.maxFilterIDs; max > 0 && len(filter.IDs) > max {
+			return fmt.Sprintf("invalid: too many ids in filter (max %d)", max)
+		}
+		if max := s.options.maxFilterAuthors; max > 0 && len(filter.Authors) > max {
+			return fmt.Sprintf("invalid: too many authors in filter (max %d)", max)
+		}
+		if max := s.options.maxFilterTagValues; max > 0 {
+			for tag, values := range filter.Tags {
+				if len(values) > max {
+					return fmt.Sprintf("invalid: too many values for tag %q in filter (max %d)", tag, max)
+				}
+			}
+		}
+	}
+
+	return ""
+}
+
+// acquireConnection registers a new connection from ip, returning false if that
+// would go over the connection caps. Must be called with clientsMu held.
+func (s *Server) acquireConnection(ip string) bool {
+	if max := s.options.maxConnections; max > 0 && s.connections >= max {
+		return false
+	}
+	if max := s.options.maxConnectionsPerIP; max > 0 && s.ipConnections[ip] >= max {
+		return false
+	}
+	s.connections++
+	s.ipConnections[ip]++
+	return true
+}
+
+// releaseConnection undoes acquireConnection. Must be called with clientsMu held.
+func (s *Server) releaseConnection(ip string) {
+	s.connections--
+	if s.ipConnections[ip] <= 1 {
+		delete(s.ipConnections, ip)
+	} else {
+		s.ipConnections[ip]--
+	}
+}
+
+// limitationDocument is a NIP-11 limitation object with the fields go-nostr doesn't know about.
+type limitationDocument struct {
+	*nip11.RelayLimitationDocument
+	CreatedAtLowerLimit int64        `json:"created_at_lower_limit,omitempty"`
+	CreatedAtUpperLimit int64        `json:"created_at_upper_limit,omitempty"`
+	QueryBudget         *QueryBudget `json:"query_budget,omitempty"`
+}
+
+// limitation describes the configured caps in NIP-11 format, on top of the
+// limitation document given by the relay, if any.
+func (s *Server) limitation(base *nip11.RelayLimitationDocument) *nip11.RelayLimitationDocument {
+	var l nip11.RelayLimitationDocument
+	if base != nil {
+		l = *base
+	}
+	l.MaxMessageLength = maxMessageSize
+	for _, limit := range []struct {
+		field *int
+		value int
+	}{
+		{&l.MaxSubscriptions, s.options.maxSubscriptions},
+		{&l.MaxFilters, s.options.maxFilters},
+		{&l.MaxLimit, s.options.maxLimit},
+		{&l.MaxEventTags, s.options.eventLimits.MaxTags},
+		{&l.MaxContentLength, s.options.eventLimits.MaxContentLength},
+	} {
+		if limit.value > 0 {
+			*limit.field = limit.value
+		}
+	}
+	return &l
+}
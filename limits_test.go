@@ -0,0 +1,148 @@
+package relayer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/fasthttp/websocket"
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/nbd-wtf/go-nostr/nip11"
+)
+
+func TestMaxConnectionsPerIP(t *testing.T) {
+	srv, _ := NewServer(&testRelay{storage: &slicestore.SliceStore{}}, WithMaxConnectionsPerIP(1))
+	started := make(chan bool)
+	go srv.Start("127.0.0.1", 0, started)
+	<-started
+	defer srv.Shutdown(context.TODO())
+
+	conn := dialTestRelay(t, srv)
+	defer conn.Close()
+
+	_, resp, err := websocket.DefaultDialer.Dial("ws://"+srv.Addr, nil)
+	if err == nil {
+		t.Fatal("second connection from the same ip should have failed")
+	}
+	if resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("second connection response: %v; want 429", resp)
+	}
+}
+
+func TestSubscriptionAndFilterCaps(t *testing.T) {
+	srv, _ := NewServer(&testRelay{storage: &slicestore.SliceStore{}},
+		WithMaxSubscriptions(1),
+		WithMaxFilters(2),
+		WithMaxFilterValues(0, 1, 0),
+	)
+	started := make(chan bool)
+	go srv.Start("127.0.0.1", 0, started)
+	<-started
+	defer srv.Shutdown(context.TODO())
+
+	conn := dialTestRelay(t, srv)
+	defer conn.Close()
+
+	for _, tc := range []struct {
+		req    string
+		closed string
+	}{
+		{`["REQ","a",{}]`, ""},
+		{`["REQ","a",{"kinds":[1]}]`, ""}, // replacing the same id is fine
+		{`["REQ","b",{}]`, "blocked: too many open subscriptions"},
+		{`["REQ","c",{},{},{}]`, "invalid: too many filters"},
+		{`["REQ","d",{"authors":["aa","bb"]}]`, "invalid: too many authors"},
+	} {
+		conn.WriteMessage(websocket.TextMessage, []byte(tc.req))
+		msg := readMessage(t, conn)
+		var typ, reason string
+		json.Unmarshal(msg[0], &typ)
+		if tc.closed == "" {
+			if typ != "EOSE" {
+				t.Errorf("%s: got %s; want EOSE", tc.req, typ)
+			}
+			continue
+		}
+		json.Unmarshal(msg[len(msg)-1], &reason)
+		if typ != "CLOSED" || !strings.HasPrefix(reason, tc.closed) {
+			t.Errorf("%s: got %s %q; want CLOSED %q", tc.req, typ, reason, tc.closed)
+		}
+	}
+}
+
+type infoRelay struct{ testRelay }
+
+func (r *infoRelay) GetNIP11InformationDocument() nip11.RelayInformationDocument {
+	return nip11.RelayInformationDocument{
+		Name:       "info",
+		Limitation: &nip11.RelayLimitationDocument{AuthRequired: true, MaxFilters: 10},
+	}
+}
+
+func TestNIP11Limitation(t *testing.T) {
+	for _, relay := range []Relay{
+		&testRelay{storage: &slicestore.SliceStore{}},
+		&infoRelay{testRelay{storage: &slicestore.SliceStore{}}},
+	} {
+		srv, _ := NewServer(relay, WithMaxSubscriptions(7), WithMaxFilters(3))
+		started := make(chan bool)
+		go srv.Start("127.0.0.1", 0, started)
+		<-started
+
+		req, _ := http.NewRequest("GET", "http://"+srv.Addr, nil)
+		req.Header.Set("Accept", "application/nostr+json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET nip11: %v", err)
+		}
+
+		var info struct {
+			Limitation struct {
+				MaxSubscriptions int  `json:"max_subscriptions"`
+				MaxFilters       int  `json:"max_filters"`
+				MaxLimit         int  `json:"max_limit"`
+				AuthRequired     bool `json:"auth_required"`
+			} `json:"limitation"`
+		}
+		json.NewDecoder(resp.Body).Decode(&info)
+		resp.Body.Close()
+		srv.Shutdown(context.TODO())
+
+		if info.Limitation.MaxSubscriptions != 7 || info.Limitation.MaxFilters != 3 || info.Limitation.MaxLimit != defaultMaxLimit {
+			t.Errorf("%s: limitation = %+v; want max_subscriptions 7, max_filters 3 and the default max_limit", relay.Name(), info.Limitation)
+		}
+		if _, ok := relay.(Informationer); ok && !info.Limitation.AuthRequired {
+			t.Errorf("%s: the relay limitation was replaced: %+v", relay.Name(), info.Limitation)
+		}
+	}
+}
+
+func TestSubscriptionCapConcurrentReqs(t *testing.T) {
+	srv, _ := NewServer(&testRelay{storage: &slicestore.SliceStore{}}, WithMaxSubscriptions(2))
+	started := make(chan bool)
+	go srv.Start("127.0.0.1", 0, started)
+	<-started
+	defer srv.Shutdown(context.TODO())
+
+	conn := dialTestRelay(t, srv)
+	defer conn.Close()
+
+	const reqs = 20
+	for i := range reqs {
+		conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`["REQ","%d",{}]`, i)))
+	}
+	opened := 0
+	for range reqs {
+		var typ string
+		json.Unmarshal(readMessage(t, conn)[0], &typ)
+		if typ == "EOSE" {
+			opened++
+		}
+	}
+	if opened != 2 {
+		t.Errorf("%d subscriptions opened; want 2", opened)
+	}
+}
@@ -1,7 +1,7 @@
 package relayer
 
 import (
-	"sync"
+	"context"
 
 	"github.com/nbd-wtf/go-nostr"
 )
@@ -10,86 +10,231 @@ type Listener struct {
 	filters nostr.Filters
 }
 
-var (
-	listeners      = make(map[*WebSocket]map[string]*Listener)
-	listenersMutex = sync.Mutex{}
-)
+// subscriber is something live subscriptions can be attached to: a websocket client
+// or an in-process subscription created by [Server.Subscribe].
+type subscriber interface {
+	// send delivers evt to subscription id, giving up after writeWait.
+	send(id string, evt *nostr.Event) error
+
+	// drop disconnects a subscriber that failed to keep up.
+	drop()
+}
 
+// GetListeningFilters returns all the distinct filters currently active across
+// the live subscriptions of every running [Server].
+//
+// Deprecated: use [Server.GetListeningFilters], which only looks at the
+// subscriptions of a single server.
 func GetListeningFilters() nostr.Filters {
-	respfilters := make(nostr.Filters, 0, len(listeners)*2)
-
-	listenersMutex.Lock()
-	defer listenersMutex.Unlock()
-
-	// here we go through all the existing listeners
-	for _, connlisteners := range listeners {
-		for _, listener := range connlisteners {
-			for _, listenerfilter := range listener.filters {
-				for _, respfilter := range respfilters {
-					// check if this filter specifically is already added to respfilters
-					if nostr.FilterEqual(listenerfilter, respfilter) {
-						goto nextconn
-					}
-				}
-
-				// field not yet present on respfilters, add it
-				respfilters = append(respfilters, listenerfilter)
-
-				// continue to the next filter
-			nextconn:
-				continue
+	respfilters := make(nostr.Filters, 0)
+	seen := make(map[string]struct{})
+	for _, s := range runningServers() {
+		for _, filter := range s.GetListeningFilters() {
+			key := filterKey(filter)
+			if _, ok := seen[key]; !ok {
+				seen[key] = struct{}{}
+				respfilters = append(respfilters, filter)
 			}
 		}
 	}
-
-	// respfilters will be a slice with all the distinct filter we currently have active
 	return respfilters
 }
 
-func setListener(id string, ws *WebSocket, filters nostr.Filters) {
-	listenersMutex.Lock()
-	defer listenersMutex.Unlock()
+// GetListeningFilters returns all the distinct filters currently active across
+// the live subscriptions of this server. See also [Server.WatchFilters].
+func (s *Server) GetListeningFilters() nostr.Filters {
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+	return s.filterIndex.list()
+}
 
-	subs, ok := listeners[ws]
+// listenLocked adds or replaces subscription id of sub. Must be called with
+// listenersMu held, releasing it with unlockListeners.
+func (s *Server) listenLocked(sub subscriber, id string, filters nostr.Filters) {
+	subs, ok := s.listeners[sub]
 	if !ok {
 		subs = make(map[string]*Listener)
-		listeners[ws] = subs
+		s.listeners[sub] = subs
 	}
 
+	old := subs[id]
 	subs[id] = &Listener{filters: filters}
+	s.filterChanges = append(s.filterChanges, s.filterIndex.add(filters)...)
+	if old != nil {
+		s.filterChanges = append(s.filterChanges, s.filterIndex.remove(old.filters)...)
+	}
 }
 
-// Remove a specific subscription id from listeners for a given ws client
-func removeListenerId(ws *WebSocket, id string) {
-	listenersMutex.Lock()
-	defer listenersMutex.Unlock()
-
-	if subs, ok := listeners[ws]; ok {
-		delete(listeners[ws], id)
-		if len(subs) == 0 {
-			delete(listeners, ws)
+// unlistenLocked removes subscription id of sub, returning false if there was none.
+// Must be called with listenersMu held, releasing it with unlockListeners.
+func (s *Server) unlistenLocked(sub subscriber, id string) bool {
+	subs, ok := s.listeners[sub]
+	if !ok {
+		return false
+	}
+	listener, ok := subs[id]
+	if !ok {
+		return false
+	}
+
+	delete(subs, id)
+	if len(subs) == 0 {
+		delete(s.listeners, sub)
+	}
+	s.filterChanges = append(s.filterChanges, s.filterIndex.remove(listener.filters)...)
+	return true
+}
+
+// unlistenAllLocked removes every subscription of sub. Must be called with
+// listenersMu held, releasing it with unlockListeners.
+func (s *Server) unlistenAllLocked(sub subscriber) {
+	for _, listener := range s.listeners[sub] {
+		s.filterChanges = append(s.filterChanges, s.filterIndex.remove(listener.filters)...)
+	}
+	delete(s.listeners, sub)
+}
+
+func (s *Server) setListener(ctx context.Context, id string, ws *WebSocket, filters nostr.Filters) {
+	s.listenersMu.Lock()
+	s.listenLocked(ws, id, filters)
+	s.unlockListeners()
+
+	if observer, ok := s.relay.(SubscriptionObserver); ok {
+		observer.OnSubscribe(ctx, id, filters)
+	}
+}
+
+// reserveListener claims one of the max subscriptions ws can have open for id, not
+// counting one with the same id, which would be replaced. Claims are counted until
+// given back with releaseListener, so concurrent REQs can't all get past the cap
+// before any of them is listening.
+func (s *Server) reserveListener(ws *WebSocket, id string, max int) bool {
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+
+	subs := s.listeners[ws]
+	pending := s.pendingListeners[ws]
+	open := 0
+	for sid := range subs {
+		if sid != id {
+			open++
+		}
+	}
+	for pid := range pending {
+		if _, ok := subs[pid]; !ok && pid != id {
+			open++
 		}
 	}
+	if open >= max {
+		return false
+	}
+
+	if pending == nil {
+		pending = make(map[string]int)
+		s.pendingListeners[ws] = pending
+	}
+	pending[id]++
+	return true
+}
+
+// releaseListener gives back a claim made with reserveListener.
+func (s *Server) releaseListener(ws *WebSocket, id string) {
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+
+	pending := s.pendingListeners[ws]
+	if pending[id]--; pending[id] <= 0 {
+		delete(pending, id)
+	}
+	if len(pending) == 0 {
+		delete(s.pendingListeners, ws)
+	}
+}
+
+// listenerIds returns the ids of all subscriptions ws has open.
+func (s *Server) listenerIds(ws *WebSocket) []string {
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+
+	ids := make([]string, 0, len(s.listeners[ws]))
+	for id := range s.listeners[ws] {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// listenerFilters returns the filters of every subscription ws has open, by id.
+func (s *Server) listenerFilters(ws *WebSocket) map[string]nostr.Filters {
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+
+	filters := make(map[string]nostr.Filters, len(s.listeners[ws]))
+	for id, listener := range s.listeners[ws] {
+		filters[id] = listener.filters
+	}
+	return filters
+}
+
+// Remove a specific subscription id from listeners for a given ws client
+func (s *Server) removeListenerId(ctx context.Context, ws *WebSocket, id string) {
+	s.listenersMu.Lock()
+	removed := s.unlistenLocked(ws, id)
+	s.unlockListeners()
+
+	if observer, ok := s.relay.(SubscriptionObserver); ok && removed {
+		observer.OnUnsubscribe(ctx, id)
+	}
 }
 
 // Remove WebSocket conn from listeners
-func removeListener(ws *WebSocket) {
-	listenersMutex.Lock()
-	defer listenersMutex.Unlock()
-	clear(listeners[ws])
-	delete(listeners, ws)
+func (s *Server) removeListener(ws *WebSocket) {
+	s.listenersMu.Lock()
+	s.unlistenAllLocked(ws)
+	s.unlockListeners()
+
+	if observer, ok := s.relay.(SubscriptionObserver); ok {
+		observer.OnDisconnect(s.clientContext(context.Background(), ws))
+	}
 }
 
-func notifyListeners(event *nostr.Event) {
-	listenersMutex.Lock()
-	defer listenersMutex.Unlock()
+// notifyListeners sends event to every matching subscription, unless it is banned.
+// Subscribers that can't take it within writeWait are dropped along with all their
+// subscriptions. Sends happen after listenersMu is released, so a slow subscriber
+// doesn't hold up the others opening and closing subscriptions.
+func (s *Server) notifyListeners(event *nostr.Event) {
+	if _, banned := s.bans.event(event); banned {
+		return
+	}
 
-	for ws, subs := range listeners {
+	type delivery struct {
+		sub subscriber
+		ids []string
+	}
+	var deliveries []delivery
+	s.listenersMu.Lock()
+	for sub, subs := range s.listeners {
+		var ids []string
 		for id, listener := range subs {
-			if !listener.filters.Match(event) {
-				continue
+			if listener.filters.Match(event) {
+				ids = append(ids, id)
+			}
+		}
+		if len(ids) > 0 {
+			deliveries = append(deliveries, delivery{sub, ids})
+		}
+	}
+	s.listenersMu.Unlock()
+
+	for _, d := range deliveries {
+		for _, id := range d.ids {
+			if err := d.sub.send(id, event); err != nil {
+				s.Log.Infof("dropping subscriber: %v", err)
+				s.listenersMu.Lock()
+				s.unlistenAllLocked(d.sub)
+				s.unlockListeners()
+				d.sub.drop()
+				break
 			}
-			ws.WriteJSON(nostr.EventEnvelope{SubscriptionID: &id, Event: *event})
 		}
 	}
 }
@@ -0,0 +1,152 @@
+package relayer
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Mux serves several relays from a single HTTP listener, routing each request
+// to one of many [Server]s by its Host header or by URL path prefix.
+//
+// Every Server keeps its own [Relay] implementation, storage, NIP-11 document and
+// live subscriptions; the Mux only shares the listener and the shutdown sequence.
+// Servers can be added and removed while the Mux is running.
+//
+// Host routes take precedence over path routes. Among path routes, the longest
+// matching prefix wins and is stripped before the request reaches [Server.Router].
+type Mux struct {
+	mu    sync.RWMutex
+	hosts map[string]*Server
+	paths map[string]*Server
+
+	// Start, StartTLS, StartUnix, StartSystemd and Serve; see also Addr
+	frontend
+}
+
+// NewMux returns an empty Mux. Add servers to it with HandleHost and HandlePath.
+func NewMux() *Mux {
+	m := &Mux{
+		hosts: make(map[string]*Server),
+		paths: make(map[string]*Server),
+	}
+	m.frontend.handler = m
+	return m
+}
+
+// HandleHost routes requests whose Host header is host (ignoring the port) to srv,
+// replacing any server previously registered for it.
+func (m *Mux) HandleHost(host string, srv *Server) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hosts[normalizeHost(host)] = srv
+}
+
+// HandlePath routes requests for prefix and everything under it to srv,
+// replacing any server previously registered for it.
+func (m *Mux) HandlePath(prefix string, srv *Server) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.paths["/"+strings.Trim(prefix, "/")] = srv
+}
+
+// Remove takes srv out of every route it is registered for and then shuts it down.
+// See [Server.Shutdown].
+func (m *Mux) Remove(ctx context.Context, srv *Server) {
+	m.mu.Lock()
+	for host, s := range m.hosts {
+		if s == srv {
+			delete(m.hosts, host)
+		}
+	}
+	for prefix, s := range m.paths {
+		if s == srv {
+			delete(m.paths, prefix)
+		}
+	}
+	m.mu.Unlock()
+
+	srv.Shutdown(ctx)
+}
+
+// Servers returns every distinct server currently routed to.
+func (m *Mux) Servers() []*Server {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	seen := make(map[*Server]struct{}, len(m.hosts)+len(m.paths))
+	list := make([]*Server, 0, len(m.hosts)+len(m.paths))
+	for _, routes := range []map[string]*Server{m.hosts, m.paths} {
+		for _, s := range routes {
+			if _, ok := seen[s]; !ok {
+				seen[s] = struct{}{}
+				list = append(list, s)
+			}
+		}
+	}
+	return list
+}
+
+// route finds the server for r, returning it along with the path prefix to strip.
+func (m *Mux) route(r *http.Request) (*Server, string) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if s, ok := m.hosts[normalizeHost(r.Host)]; ok {
+		return s, ""
+	}
+
+	var (
+		best   *Server
+		prefix string
+	)
+	for p, s := range m.paths {
+		matches := p == "/" || r.URL.Path == p || strings.HasPrefix(r.URL.Path, p+"/")
+		if matches && len(p) > len(prefix) {
+			best, prefix = s, p
+		}
+	}
+	if prefix == "/" {
+		prefix = ""
+	}
+	return best, prefix
+}
+
+// ServeHTTP implements http.Handler interface.
+func (m *Mux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s, prefix := m.route(r)
+	if s == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if prefix != "" {
+		http.StripPrefix(prefix, s).ServeHTTP(w, r)
+		return
+	}
+	s.ServeHTTP(w, r)
+}
+
+// Shutdown stops accepting connections and then shuts down every routed server
+// in parallel, as described in [Server.Shutdown].
+func (m *Mux) Shutdown(ctx context.Context) {
+	m.frontend.shutdown(ctx)
+
+	var wg sync.WaitGroup
+	for _, s := range m.Servers() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Shutdown(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
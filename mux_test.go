@@ -0,0 +1,94 @@
+package relayer
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/nbd-wtf/go-nostr"
+	"go.uber.org/goleak"
+)
+
+func TestMuxRouting(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	alpha, _ := NewServer(&testRelay{name: "alpha", storage: &slicestore.SliceStore{}})
+	beta, _ := NewServer(&testRelay{name: "beta", storage: &slicestore.SliceStore{}})
+	gamma, _ := NewServer(&testRelay{name: "gamma", storage: &slicestore.SliceStore{}})
+
+	mux := NewMux()
+	mux.HandleHost("alpha.example.com", alpha)
+	mux.HandlePath("/beta", beta)
+	mux.HandlePath("/", gamma)
+
+	started := make(chan bool)
+	go mux.Start("127.0.0.1", 0, started)
+	<-started
+	defer mux.Shutdown(context.TODO())
+
+	nip11Name := func(host, path string) string {
+		req, _ := http.NewRequest("GET", "http://"+mux.Addr+path, nil)
+		req.Host = host
+		req.Header.Set("Accept", "application/nostr+json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s%s: %v", host, path, err)
+		}
+		defer resp.Body.Close()
+		var info struct{ Name string }
+		json.NewDecoder(resp.Body).Decode(&info)
+		return info.Name
+	}
+	for _, tc := range []struct{ host, path, want string }{
+		{"alpha.example.com:80", "/", "alpha"},
+		{"alpha.example.com", "/beta", "alpha"},
+		{"other.example.com", "/beta", "beta"},
+		{"other.example.com", "/beta/", "beta"},
+		{"other.example.com", "/betamax", "gamma"},
+		{"other.example.com", "/", "gamma"},
+	} {
+		if got := nip11Name(tc.host, tc.path); got != tc.want {
+			t.Errorf("%s%s routed to %q; want %q", tc.host, tc.path, got, tc.want)
+		}
+	}
+
+	// subscriptions are not shared among servers
+	dial := func(path string) *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial("ws://"+mux.Addr+path, nil)
+		if err != nil {
+			t.Fatalf("dial %s: %v", path, err)
+		}
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		return conn
+	}
+	betaConn := dial("/beta")
+	defer betaConn.Close()
+	gammaConn := dial("/")
+	defer gammaConn.Close()
+
+	gammaConn.WriteJSON([]any{"REQ", "sub", nostr.Filter{}})
+	readLabel(t, gammaConn, "EOSE")
+	betaConn.WriteJSON([]any{"REQ", "sub", nostr.Filter{}})
+	readLabel(t, betaConn, "EOSE")
+
+	ev := nostr.Event{Kind: nostr.KindTextNote, CreatedAt: nostr.Now(), Content: "hello beta"}
+	ev.Sign(nostr.GeneratePrivateKey())
+	betaConn.WriteJSON([]any{"EVENT", ev})
+	readLabel(t, betaConn, "EVENT")
+
+	gammaConn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	var msg []json.RawMessage
+	if err := gammaConn.ReadJSON(&msg); err == nil {
+		t.Errorf("gamma got %s; want nothing", msg)
+	}
+
+	// removing a server at runtime
+	mux.Remove(context.TODO(), beta)
+	if got := nip11Name("other.example.com", "/beta"); got != "gamma" {
+		t.Errorf("/beta routed to %q after removal; want gamma", got)
+	}
+}
@@ -0,0 +1,113 @@
+package relayer
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// how far the created_at of a NIP-98 event can be from the current time.
+const nip98Window = 60 * time.Second
+
+// nip98Replays remembers the NIP-98 events already used until they are too old to be
+// accepted anyway, so a captured Authorization header can't be used again.
+type nip98Replays struct {
+	mu   sync.Mutex
+	seen map[string]time.Time // event id -> when it expires
+}
+
+// use records the event id, valid until expires, returning false if it was used before.
+func (nr *nip98Replays) use(id string, expires time.Time) bool {
+	nr.mu.Lock()
+	defer nr.mu.Unlock()
+
+	now := time.Now()
+	for seen, exp := range nr.seen {
+		if now.After(exp) {
+			delete(nr.seen, seen)
+		}
+	}
+	if _, ok := nr.seen[id]; ok {
+		return false
+	}
+	if nr.seen == nil {
+		nr.seen = make(map[string]time.Time)
+	}
+	nr.seen[id] = expires
+	return true
+}
+
+// validateNIP98 checks the NIP-98 HTTP auth event in the Authorization header of r,
+// whose body has already been read into body, and returns its pubkey. Every event
+// is only accepted once.
+func (s *Server) validateNIP98(r *http.Request, body []byte) (string, error) {
+	header := r.Header.Get("Authorization")
+	encoded, ok := strings.CutPrefix(header, "Nostr ")
+	if !ok {
+		return "", errors.New("missing Nostr authorization")
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", fmt.Errorf("invalid base64: %w", err)
+	}
+	var evt nostr.Event
+	if err := json.Unmarshal(raw, &evt); err != nil {
+		return "", fmt.Errorf("invalid event: %w", err)
+	}
+
+	if evt.Kind != nostr.KindHTTPAuth {
+		return "", fmt.Errorf("wrong kind %d", evt.Kind)
+	}
+	if d := time.Since(evt.CreatedAt.Time()); d > nip98Window || d < -nip98Window {
+		return "", errors.New("created_at too far from now")
+	}
+	if u := evt.Tags.GetFirst([]string{"u", ""}); u == nil || (*u)[1] != s.requestURL(r) {
+		return "", errors.New("u tag doesn't match the request url")
+	}
+	if m := evt.Tags.GetFirst([]string{"method", ""}); m == nil || !strings.EqualFold((*m)[1], r.Method) {
+		return "", errors.New("method tag doesn't match the request method")
+	}
+	if p := evt.Tags.GetFirst([]string{"payload", ""}); p == nil {
+		if len(body) > 0 {
+			return "", errors.New("missing payload tag for the request body")
+		}
+	} else {
+		hash := sha256.Sum256(body)
+		if (*p)[1] != hex.EncodeToString(hash[:]) {
+			return "", errors.New("payload tag doesn't match the request body")
+		}
+	}
+
+	if evt.ID != evt.GetID() {
+		return "", errors.New("event id is computed incorrectly")
+	}
+	if ok, err := evt.CheckSignature(); err != nil || !ok {
+		return "", errors.New("invalid signature")
+	}
+	if !s.nip98.use(evt.ID, evt.CreatedAt.Time().Add(nip98Window)) {
+		return "", errors.New("authorization already used")
+	}
+	return evt.PubKey, nil
+}
+
+// requestURL returns the absolute URL the client used for r, as it would appear in
+// a NIP-98 u tag, looking at the headers set by trusted reverse proxies.
+func (s *Server) requestURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" && s.fromTrustedProxy(r) {
+		scheme = strings.TrimSpace(strings.Split(proto, ",")[0])
+	}
+	return scheme + "://" + r.Host + r.RequestURI
+}
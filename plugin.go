@@ -0,0 +1,350 @@
+package relayer
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// PluginRequest is what a [WritePolicyPlugin] writes to the plugin standard input
+// for every event, one JSON object per line.
+type PluginRequest struct {
+	Type       string       `json:"type"` // always "new"
+	Event      *nostr.Event `json:"event"`
+	ReceivedAt int64        `json:"receivedAt"`
+	// SourceType is "websocket" for events sent by clients and "internal" for
+	// events added by the relay itself.
+	SourceType string `json:"sourceType"`
+	// SourceInfo is the client IP address, if any.
+	SourceInfo string `json:"sourceInfo"`
+	// Authed is the NIP-42 authenticated pubkey of the client, if any.
+	Authed string `json:"authed,omitempty"`
+}
+
+// PluginResponse is what the plugin must write to its standard output for every
+// [PluginRequest], one JSON object per line. Responses are matched to requests by
+// event id, so they may come in any order.
+type PluginResponse struct {
+	ID string `json:"id"`
+	// Action is one of "accept", "reject" or "shadowReject". See [ShadowReject].
+	Action string `json:"action"`
+	// Msg is sent back to the client on rejections. It should start with
+	// a NIP-01 prefix like "blocked: ".
+	Msg string `json:"msg,omitempty"`
+}
+
+// WritePolicyPlugin decides whether events are accepted by asking an external
+// program, so admission logic can be written in any language and replaced without
+// rebuilding the relay.
+//
+// The program is started on the first event and kept running, exchanging JSON lines
+// with the relay as described in [PluginRequest] and [PluginResponse]. If it exits
+// or doesn't answer within Timeout it is started again on the next event. Its standard
+// error goes to the relay's.
+//
+// Use it from [Relay.AcceptEvent]:
+//
+//	func (r *Relay) AcceptEvent(ctx context.Context, evt *nostr.Event) (bool, string) {
+//		return r.plugin.AcceptEvent(ctx, evt)
+//	}
+type WritePolicyPlugin struct {
+	// Command and Args are the program to run.
+	Command string
+	Args    []string
+
+	// Timeout is how long to wait for each decision before giving up on the program
+	// and restarting it. Defaults to 5 seconds.
+	Timeout time.Duration
+
+	// FailOpen makes events be accepted when the plugin can't be started, crashes
+	// or times out. By default they are rejected.
+	FailOpen bool
+
+	// Log defaults to a stdlib logger prefixed with "plugin: ".
+	Log Logger
+
+	mu          sync.Mutex
+	proc        *pluginProcess
+	lastStarted time.Time
+	closed      bool
+}
+
+// the plugin isn't restarted more often than this after crashing.
+const pluginRestartInterval = time.Second
+
+// NewWritePolicyPlugin returns a WritePolicyPlugin that runs command with args.
+func NewWritePolicyPlugin(command string, args ...string) *WritePolicyPlugin {
+	return &WritePolicyPlugin{Command: command, Args: args, Log: defaultLogger("plugin: ")}
+}
+
+// AcceptEvent sends evt to the plugin along with the client metadata found in ctx
+// and returns its decision, with the same semantics as [Relay.AcceptEvent].
+func (p *WritePolicyPlugin) AcceptEvent(ctx context.Context, evt *nostr.Event) (bool, string) {
+	resp, err := p.decide(ctx, evt)
+	if err != nil {
+		p.logger().Warningf("%s: %v", p.Command, err)
+		if p.FailOpen {
+			return true, ""
+		}
+		return false, "error: write policy unavailable"
+	}
+
+	switch resp.Action {
+	case "accept":
+		return true, ""
+	case "shadowReject":
+		ShadowReject(ctx)
+		return true, ""
+	case "reject":
+		if resp.Msg == "" {
+			resp.Msg = "blocked: rejected by write policy"
+		}
+		return false, resp.Msg
+	default:
+		p.logger().Warningf("%s: unknown action %q for %s", p.Command, resp.Action, evt.ID)
+		if p.FailOpen {
+			return true, ""
+		}
+		return false, "error: write policy returned an invalid response"
+	}
+}
+
+// Close stops the plugin program. AcceptEvent must not be called afterwards.
+func (p *WritePolicyPlugin) Close() {
+	p.mu.Lock()
+	p.closed = true
+	proc := p.proc
+	p.proc = nil
+	p.mu.Unlock()
+
+	if proc != nil {
+		proc.kill()
+	}
+}
+
+func (p *WritePolicyPlugin) logger() Logger {
+	if p.Log == nil {
+		return defaultLogger("plugin: ")
+	}
+	return p.Log
+}
+
+func (p *WritePolicyPlugin) decide(ctx context.Context, evt *nostr.Event) (*PluginResponse, error) {
+	proc, err := p.process()
+	if err != nil {
+		return nil, err
+	}
+
+	req := PluginRequest{
+		Type:       "new",
+		Event:      evt,
+		ReceivedAt: time.Now().Unix(),
+		SourceType: "internal",
+	}
+	if ip, ok := GetClientIP(ctx); ok {
+		req.SourceType = "websocket"
+		req.SourceInfo = ip
+	}
+	req.Authed, _ = GetAuthStatus(ctx)
+
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	return proc.roundtrip(ctx, evt.ID, req)
+}
+
+// process returns the running plugin process, starting it if needed.
+func (p *WritePolicyPlugin) process() (*pluginProcess, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil, errors.New("plugin closed")
+	}
+	if p.proc != nil && !p.proc.exited() {
+		return p.proc, nil
+	}
+	if time.Since(p.lastStarted) < pluginRestartInterval {
+		return nil, errors.New("plugin exited, waiting to restart")
+	}
+
+	p.lastStarted = time.Now()
+	proc, err := startPluginProcess(p.Command, p.Args, p.logger())
+	if err != nil {
+		return nil, fmt.Errorf("failed to start: %w", err)
+	}
+	p.proc = proc
+	return proc, nil
+}
+
+type pluginProcess struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	done  chan struct{}
+
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	pending map[string][]chan *PluginResponse
+}
+
+func startPluginProcess(command string, args []string, log Logger) (*pluginProcess, error) {
+	cmd := exec.Command(command, args...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	proc := &pluginProcess{
+		cmd:     cmd,
+		stdin:   stdin,
+		done:    make(chan struct{}),
+		pending: make(map[string][]chan *PluginResponse),
+	}
+
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		scanner.Buffer(make([]byte, 0, 4096), maxMessageSize)
+		for scanner.Scan() {
+			var resp PluginResponse
+			if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+				log.Warningf("%s: invalid output %q: %v", command, scanner.Text(), err)
+				continue
+			}
+			proc.deliver(&resp)
+		}
+
+		if err := cmd.Wait(); err != nil {
+			log.Warningf("%s: exited: %v", command, err)
+		}
+		close(proc.done)
+	}()
+
+	return proc, nil
+}
+
+func (proc *pluginProcess) exited() bool {
+	select {
+	case <-proc.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (proc *pluginProcess) roundtrip(ctx context.Context, id string, req PluginRequest) (*PluginResponse, error) {
+	line, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan *PluginResponse, 1)
+	proc.mu.Lock()
+	proc.pending[id] = append(proc.pending[id], ch)
+	proc.mu.Unlock()
+
+	// a plugin that stops reading its input would block writes forever
+	written := make(chan error, 1)
+	go func() {
+		proc.writeMu.Lock()
+		defer proc.writeMu.Unlock()
+		if err := ctx.Err(); err != nil {
+			written <- err
+			return
+		}
+		_, err := proc.stdin.Write(append(line, '\n'))
+		written <- err
+	}()
+
+	select {
+	case err := <-written:
+		if err != nil {
+			proc.forget(id, ch)
+			return nil, fmt.Errorf("failed to write: %w", err)
+		}
+	case <-ctx.Done():
+		proc.forget(id, ch)
+		proc.timedOut(ctx)
+		return nil, fmt.Errorf("failed to write %s: %w", id, ctx.Err())
+	}
+
+	select {
+	case resp := <-ch:
+		return resp, nil
+	case <-proc.done:
+		proc.forget(id, ch)
+		return nil, errors.New("plugin exited before answering")
+	case <-ctx.Done():
+		proc.forget(id, ch)
+		proc.timedOut(ctx)
+		return nil, fmt.Errorf("no answer for %s: %w", id, ctx.Err())
+	}
+}
+
+// timedOut kills the process if ctx hit the plugin timeout, as it is stuck or
+// too slow, so a new one is started for the next event.
+func (proc *pluginProcess) timedOut(ctx context.Context) {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		go proc.kill()
+	}
+}
+
+func (proc *pluginProcess) deliver(resp *PluginResponse) {
+	proc.mu.Lock()
+	defer proc.mu.Unlock()
+
+	waiting := proc.pending[resp.ID]
+	if len(waiting) == 0 {
+		return
+	}
+	waiting[0] <- resp
+	if len(waiting) == 1 {
+		delete(proc.pending, resp.ID)
+	} else {
+		proc.pending[resp.ID] = waiting[1:]
+	}
+}
+
+func (proc *pluginProcess) forget(id string, ch chan *PluginResponse) {
+	proc.mu.Lock()
+	defer proc.mu.Unlock()
+
+	waiting := proc.pending[id]
+	for i, c := range waiting {
+		if c == ch {
+			waiting = append(waiting[:i], waiting[i+1:]...)
+			break
+		}
+	}
+	if len(waiting) == 0 {
+		delete(proc.pending, id)
+	} else {
+		proc.pending[id] = waiting
+	}
+}
+
+func (proc *pluginProcess) kill() {
+	proc.stdin.Close()
+	proc.cmd.Process.Kill()
+	<-proc.done
+}
@@ -0,0 +1,109 @@
+package relayer
+
+import (
+	"context"
+	"encoding/json"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/nbd-wtf/go-nostr"
+	"go.uber.org/goleak"
+)
+
+// buildTestPlugin compiles testdata/writepolicy and returns the path to the binary.
+func buildTestPlugin(t *testing.T) string {
+	t.Helper()
+	bin := filepath.Join(t.TempDir(), "writepolicy")
+	if out, err := exec.Command("go", "build", "-o", bin, "./testdata/writepolicy").CombinedOutput(); err != nil {
+		t.Fatalf("building test plugin: %v\n%s", err, out)
+	}
+	return bin
+}
+
+func signedNote(content string) *nostr.Event {
+	ev := &nostr.Event{Kind: nostr.KindTextNote, CreatedAt: nostr.Now(), Content: content}
+	ev.Sign(nostr.GeneratePrivateKey())
+	return ev
+}
+
+func TestWritePolicyPlugin(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	plugin := NewWritePolicyPlugin(buildTestPlugin(t))
+	plugin.Timeout = 200 * time.Millisecond
+	defer plugin.Close()
+
+	ctx := context.Background()
+	if ok, msg := plugin.AcceptEvent(ctx, signedNote("hello")); !ok {
+		t.Errorf("plain note rejected: %s", msg)
+	}
+	if ok, msg := plugin.AcceptEvent(ctx, signedNote("buy spam")); ok || msg != "blocked: no spam" {
+		t.Errorf("spam: got %v %q; want rejection", ok, msg)
+	}
+	if ok, msg := plugin.AcceptEvent(ctx, signedNote("whoami")); ok || msg != "blocked: internal  " {
+		t.Errorf("metadata: got %v %q; want internal source", ok, msg)
+	}
+
+	// crashes are followed by a restart
+	if ok, _ := plugin.AcceptEvent(ctx, signedNote("crash")); ok {
+		t.Error("event that crashed the plugin was accepted")
+	}
+	time.Sleep(pluginRestartInterval)
+	if ok, msg := plugin.AcceptEvent(ctx, signedNote("back again")); !ok {
+		t.Errorf("plugin didn't restart after crashing: %s", msg)
+	}
+
+	// timeouts follow the fail-open setting and restart the plugin
+	if ok, _ := plugin.AcceptEvent(ctx, signedNote("slow")); ok {
+		t.Error("timed out event accepted with fail-closed plugin")
+	}
+	time.Sleep(pluginRestartInterval)
+	if ok, msg := plugin.AcceptEvent(ctx, signedNote("after timeout")); !ok {
+		t.Errorf("plugin didn't restart after timing out: %s", msg)
+	}
+	plugin.FailOpen = true
+	if ok, _ := plugin.AcceptEvent(ctx, signedNote("slow")); !ok {
+		t.Error("timed out event rejected with fail-open plugin")
+	}
+	plugin.FailOpen = false
+}
+
+func TestWritePolicyPluginShadowReject(t *testing.T) {
+	plugin := NewWritePolicyPlugin(buildTestPlugin(t))
+	defer plugin.Close()
+
+	store := &slicestore.SliceStore{}
+	store.Init()
+	srv := startTestRelay(t, &testRelay{
+		storage:     store,
+		acceptEvent: plugin.AcceptEvent,
+	})
+	defer srv.Shutdown(context.TODO())
+
+	conn := dialTestRelay(t, srv)
+	defer conn.Close()
+
+	for _, content := range []string{"shadow me", "keep me"} {
+		conn.WriteJSON([]any{"EVENT", signedNote(content)})
+		var ok bool
+		msg := readLabel(t, conn, "OK")
+		if err := json.Unmarshal(msg[2], &ok); err != nil || !ok {
+			t.Errorf("%q: got OK %s; want true", content, msg[2])
+		}
+	}
+
+	conn.WriteJSON([]any{"EVENT", signedNote("whoami")})
+	var reason string
+	json.Unmarshal(readLabel(t, conn, "OK")[3], &reason)
+	if reason != "blocked: websocket 127.0.0.1 " {
+		t.Errorf("plugin got metadata %q; want websocket source from 127.0.0.1", reason)
+	}
+
+	evs, _ := eventstore.RelayWrapper{Store: store}.QuerySync(context.Background(), nostr.Filter{})
+	if len(evs) != 1 || evs[0].Content != "keep me" {
+		t.Errorf("stored %v; want only the non shadow-rejected event", evs)
+	}
+}
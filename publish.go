@@ -0,0 +1,148 @@
+package relayer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/relayer/v2/internal/storeutil"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// PublishOptions tweaks the pipeline run by [Server.Publish].
+type PublishOptions struct {
+	// SkipSignatureCheck skips the id and signature verification, for events coming
+	// from trusted internal sources.
+	SkipSignatureCheck bool
+}
+
+// PublishResult is the outcome of [Server.Publish], which is what websocket clients
+// get in the OK message.
+type PublishResult struct {
+	Accepted bool
+
+	// Duplicate is set for accepted events that were already stored.
+	Duplicate bool
+
+	// Reason is a NIP-01 message like "blocked: no spam", usually set on rejections.
+	Reason string
+}
+
+// Prefix returns the machine-readable prefix of Reason, like "blocked" or "invalid",
+// or an empty string if it has none.
+func (r PublishResult) Prefix() string {
+	if !nip20prefixmatcher.MatchString(r.Reason) {
+		return ""
+	}
+	prefix, _, _ := strings.Cut(r.Reason, ": ")
+	return prefix
+}
+
+// Publish runs evt through exactly the same pipeline as an EVENT message sent by a
+// websocket client: rate limits (only when ctx comes from a client), structural
+// validation (see [WithEventLimits] and [WithKindRule]), id and signature checks,
+// NIP-09 deletions, [Relay.AcceptEvent], storage and the broadcast to live
+// subscriptions.
+//
+// Unlike [Server.AddEvent], it can be used for events from untrusted sources.
+func (s *Server) Publish(ctx context.Context, evt *nostr.Event, opts PublishOptions) PublishResult {
+	if serverFromContext(ctx) != s {
+		ctx = ContextWithServer(ctx, s)
+	}
+
+	ip, fromClient := GetClientIP(ctx)
+	authed, _ := GetAuthStatus(ctx)
+	cost := s.limiters.kindCost(evt.Kind)
+	if fromClient && !s.limiters.allow(ctx, "EVENT", ip, authed, cost) {
+		return PublishResult{Reason: "rate-limited: slow down"}
+	}
+
+	// events accepted a moment ago are often sent again by other clients, and there
+	// is no point in verifying them again, unless they were banned since
+	if s.verified.contains(evt.ID) {
+		if ban, banned := s.bans.event(evt); banned {
+			s.strikeRejection(ctx, ban.message())
+			return PublishResult{Reason: ban.message()}
+		}
+		return PublishResult{Accepted: true, Duplicate: true, Reason: eventstore.ErrDupEvent.Error()}
+	}
+
+	if reason := s.validateEvent(evt); reason != "" {
+		s.strikeRejection(ctx, reason)
+		return PublishResult{Reason: reason}
+	}
+
+	if !opts.SkipSignatureCheck {
+		if reason, offense := s.verifier.verify(ctx, evt); reason != "" {
+			if offense != "" {
+				s.strike(ctx, offense)
+			}
+			return PublishResult{Reason: reason}
+		}
+	}
+
+	// the author of unauthenticated events is only charged once we know the event
+	// is really theirs, so forged events can't use up someone else's budget
+	if fromClient && authed == "" && !s.limiters.allow(ctx, "EVENT", "", evt.PubKey, cost) {
+		return PublishResult{Reason: "rate-limited: slow down"}
+	}
+
+	if evt.Kind == 5 {
+		if reason := s.deleteTargets(ctx, evt); reason != "" {
+			s.strikeRejection(ctx, reason)
+			return PublishResult{Reason: reason}
+		}
+		s.verified.add(evt.ID)
+		s.notifyListeners(evt)
+		return PublishResult{Accepted: true}
+	}
+
+	ok, reason := s.addEvent(ctx, evt)
+	if ok && nostr.IsRegularKind(evt.Kind) {
+		// replaceable events can be replaced without going through deleteStored
+		s.verified.add(evt.ID)
+	}
+	return PublishResult{
+		Accepted:  ok,
+		Duplicate: ok && reason == eventstore.ErrDupEvent.Error(),
+		Reason:    reason,
+	}
+}
+
+// deleteTargets deletes the events referenced by the NIP-09 deletion evt, returning
+// a rejection reason if any of them can't be deleted.
+func (s *Server) deleteTargets(ctx context.Context, evt *nostr.Event) string {
+	store := s.relay.Storage(ctx)
+
+	for _, tag := range evt.Tags {
+		if len(tag) >= 2 && tag[0] == "e" {
+			ctx, cancel := context.WithTimeout(ctx, time.Millisecond*200)
+			defer cancel()
+
+			// fetch event to be deleted, reading the whole result so the query is done
+			// with the storage before deleting from it
+			targets, err := storeutil.Collect(ctx, store, nostr.Filter{IDs: []string{tag[1]}})
+			if err != nil && ctx.Err() == nil {
+				return "error: failed to query for target event"
+			}
+			if len(targets) == 0 {
+				// this will happen if event is not in the database
+				// or when when the query is taking too long, so we just give up
+				continue
+			}
+			target := targets[0]
+
+			// check if this can be deleted
+			if target.PubKey != evt.PubKey {
+				return "blocked: insufficient permissions"
+			}
+
+			if err := s.deleteStored(ctx, store, target); err != nil {
+				return fmt.Sprintf("error: %s", err.Error())
+			}
+		}
+	}
+	return ""
+}
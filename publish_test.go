@@ -0,0 +1,55 @@
+package relayer
+
+import (
+	"context"
+	"testing"
+
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestServerPublish(t *testing.T) {
+	store := &slicestore.SliceStore{}
+	srv, err := NewServer(&testRelay{storage: store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Shutdown(context.Background())
+
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+	note := &nostr.Event{Kind: nostr.KindTextNote, CreatedAt: nostr.Now(), Content: "hello"}
+	note.Sign(sk)
+
+	if res := srv.Publish(ctx, note, PublishOptions{}); !res.Accepted || res.Duplicate {
+		t.Errorf("first publish: %+v", res)
+	}
+	if res := srv.Publish(ctx, note, PublishOptions{}); !res.Accepted || !res.Duplicate || res.Prefix() != "duplicate" {
+		t.Errorf("second publish: %+v", res)
+	}
+
+	forged := *note
+	forged.Content = "forged"
+	forged.ID = forged.GetID()
+	if res := srv.Publish(ctx, &forged, PublishOptions{}); res.Accepted || res.Prefix() != "invalid" {
+		t.Errorf("forged event: %+v", res)
+	}
+	if res := srv.Publish(ctx, &forged, PublishOptions{SkipSignatureCheck: true}); !res.Accepted {
+		t.Errorf("forged event with SkipSignatureCheck: %+v", res)
+	}
+
+	// deletions by someone else are refused, by the author they go through
+	other := &nostr.Event{Kind: 5, CreatedAt: nostr.Now(), Tags: nostr.Tags{{"e", note.ID}}}
+	other.Sign(nostr.GeneratePrivateKey())
+	if res := srv.Publish(ctx, other, PublishOptions{}); res.Accepted || res.Prefix() != "blocked" {
+		t.Errorf("deletion by another key: %+v", res)
+	}
+	deletion := &nostr.Event{Kind: 5, CreatedAt: nostr.Now(), Tags: nostr.Tags{{"e", note.ID}}}
+	deletion.Sign(sk)
+	if res := srv.Publish(ctx, deletion, PublishOptions{}); !res.Accepted {
+		t.Errorf("deletion: %+v", res)
+	}
+	if n, _ := store.CountEvents(ctx, nostr.Filter{IDs: []string{note.ID}}); n != 0 {
+		t.Error("deleted event still stored")
+	}
+}
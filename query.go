@@ -0,0 +1,150 @@
+package relayer
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/relayer/v2/internal/storeutil"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// QueryTimeoutMode selects how clients are told that the stored events they got for
+// a REQ are partial because the query timed out. See [WithQueryTimeout].
+type QueryTimeoutMode int
+
+const (
+	// QueryTimeoutNotice sends a NOTICE after EOSE and keeps the subscription open.
+	QueryTimeoutNotice QueryTimeoutMode = iota
+	// QueryTimeoutClosed sends a CLOSED message after EOSE, so the client can reopen
+	// the subscription, maybe with narrower filters.
+	QueryTimeoutClosed
+)
+
+// WithQueryTimeout sets a deadline for the storage queries of a REQ. When it expires
+// the context given to [eventstore.Store.QueryEvents] is cancelled, the events found
+// so far are sent followed by EOSE, and the client is told with a NOTICE or CLOSED
+// message depending on mode. Queries that time out are logged along with their filter.
+func WithQueryTimeout(d time.Duration, mode QueryTimeoutMode) Option {
+	return func(o *Options) {
+		o.queryTimeout = d
+		o.queryTimeoutMode = mode
+	}
+}
+
+// WithSlowQueryLog logs the filters of storage queries taking longer than threshold.
+func WithSlowQueryLog(threshold time.Duration) Option {
+	return func(o *Options) {
+		o.slowQueryThreshold = threshold
+	}
+}
+
+// how many times the max limit all filters of a REQ can get together.
+const reqLimitFactor = 10
+
+// queryStored queries the stored events matching filters, all filters at once, and
+// calls send for each of them from newest to oldest, without repeating events matched
+// by more than one filter. It stops early if send returns false.
+//
+// Each filter gets at most its limit of events, or the one set with WithMaxLimit when
+// lower or when the filter has none, and only the newest ten times that are sent for
+// all of them together. complete is false if some query timed out, in which case the
+// events found until then are still sent.
+func (s *Server) queryStored(ctx context.Context, store eventstore.Store, filters nostr.Filters, send func(*nostr.Event) bool) (complete bool) {
+	if s.options.queryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.options.queryTimeout)
+		defer cancel()
+	}
+
+	maxLimit := s.options.maxLimit
+	if maxLimit <= 0 {
+		maxLimit = defaultMaxLimit
+	}
+	results := make([][]*nostr.Event, len(filters))
+	timedOut := make([]bool, len(filters))
+	var wg sync.WaitGroup
+	for i, filter := range filters {
+		if filter.LimitZero {
+			continue
+		}
+		if filter.Limit == 0 || filter.Limit > maxLimit {
+			filter.Limit = maxLimit
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], timedOut[i] = s.queryFilter(ctx, store, filter)
+		}()
+	}
+	wg.Wait()
+
+	merged := storeutil.Merge(results)
+	if total := reqLimitFactor * maxLimit; len(merged) > total {
+		merged = merged[:total]
+	}
+	for _, event := range merged {
+		if !send(event) {
+			break
+		}
+	}
+	return !slices.Contains(timedOut, true)
+}
+
+// queryFilter returns the stored events matching filter, up to its limit, leaving out
+// the ones skipped by WithSkipEventFunc or banned. If ctx hits its deadline first, it
+// returns the events found until then and timedOut is true.
+func (s *Server) queryFilter(ctx context.Context, store eventstore.Store, filter nostr.Filter) (result []*nostr.Event, timedOut bool) {
+	start := time.Now()
+	defer func() {
+		elapsed := time.Since(start)
+		if timedOut {
+			s.Log.Warningf("query timed out after %s with %d events: %s", elapsed.Round(time.Millisecond), len(result), filter)
+		} else if threshold := s.options.slowQueryThreshold; threshold > 0 && elapsed > threshold {
+			s.Log.Warningf("slow query took %s for %d events: %s", elapsed.Round(time.Millisecond), len(result), filter)
+		}
+	}()
+
+	events, cached, err := s.readCache.query(ctx, store, filter)
+	if !cached {
+		events, err = store.QueryEvents(ctx, filter)
+	}
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, true
+		}
+		s.Log.Errorf("store: %v", err)
+		return nil, false
+	}
+	if events == nil {
+		return nil, false
+	}
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return result, false
+			}
+			if s.options.skipEventFunc != nil && s.options.skipEventFunc(event) {
+				continue
+			}
+			if _, banned := s.bans.event(event); banned {
+				continue
+			}
+			result = append(result, event)
+			// ensures the client won't be bombarded with events in case Storage doesn't do limits right
+			if len(result) >= filter.Limit {
+				// exhaust the channel so it is closed by the storage
+				go storeutil.Drain(events)
+				return result, false
+			}
+		case <-ctx.Done():
+			go storeutil.Drain(events)
+			return result, errors.Is(ctx.Err(), context.DeadlineExceeded)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package relayer
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestQueryStoredMerge(t *testing.T) {
+	store := &slicestore.SliceStore{}
+	srv, err := NewServer(&testRelay{storage: store}, WithMaxLimit(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Shutdown(context.Background())
+
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	var notes, reactions []*nostr.Event
+	for i := 0; i < 5; i++ {
+		note := &nostr.Event{Kind: nostr.KindTextNote, CreatedAt: nostr.Timestamp(1000 + 10*i)}
+		note.Sign(sk)
+		reaction := &nostr.Event{Kind: nostr.KindReaction, CreatedAt: nostr.Timestamp(1005 + 10*i)}
+		reaction.Sign(sk)
+		srv.AddEvent(ctx, note)
+		srv.AddEvent(ctx, reaction)
+		notes = append(notes, note)
+		reactions = append(reactions, reaction)
+	}
+
+	query := func(filters ...nostr.Filter) []*nostr.Event {
+		var got []*nostr.Event
+		srv.queryStored(ctx, store, filters, func(evt *nostr.Event) bool {
+			got = append(got, evt)
+			return true
+		})
+		return got
+	}
+	expect := func(name string, got []*nostr.Event, want ...*nostr.Event) {
+		t.Helper()
+		if len(got) != len(want) {
+			t.Errorf("%s: got %d events, want %d", name, len(got), len(want))
+			return
+		}
+		for i := range want {
+			if got[i].ID != want[i].ID {
+				t.Errorf("%s: event %d is %d/%d, want %d/%d", name, i, got[i].Kind, got[i].CreatedAt, want[i].Kind, want[i].CreatedAt)
+			}
+		}
+	}
+
+	expect("exact limit",
+		query(nostr.Filter{Kinds: []int{nostr.KindTextNote}, Limit: 2}),
+		notes[4], notes[3])
+	expect("max limit",
+		query(nostr.Filter{Kinds: []int{nostr.KindTextNote}}),
+		notes[4], notes[3], notes[2])
+	expect("limit 0",
+		query(nostr.Filter{Kinds: []int{nostr.KindTextNote}, LimitZero: true}))
+	expect("merged and deduplicated",
+		query(
+			nostr.Filter{Kinds: []int{nostr.KindTextNote}, Limit: 2},
+			nostr.Filter{Authors: []string{pubkey}, Limit: 3},
+			nostr.Filter{Kinds: []int{nostr.KindReaction}, Limit: 1},
+		),
+		reactions[4], notes[4], reactions[3], notes[3])
+
+	// the REQ-wide cap keeps the newest events across all filters
+	var byAuthor []nostr.Filter
+	var newest []*nostr.Event
+	for i := 0; i < reqLimitFactor+5; i++ {
+		sk := nostr.GeneratePrivateKey()
+		pubkey, _ := nostr.GetPublicKey(sk)
+		for j := 0; j < 3; j++ {
+			evt := &nostr.Event{Kind: nostr.KindTextNote, CreatedAt: nostr.Timestamp(2000 + 10*i + j)}
+			evt.Sign(sk)
+			srv.AddEvent(ctx, evt)
+			if i >= 5 {
+				newest = append([]*nostr.Event{evt}, newest...)
+			}
+		}
+		byAuthor = append(byAuthor, nostr.Filter{Authors: []string{pubkey}})
+	}
+	expect("capped request", query(byAuthor...), newest...)
+}
+
+func TestReqOrdering(t *testing.T) {
+	srv := startTestRelay(t, &testRelay{storage: &slicestore.SliceStore{}})
+	defer srv.Shutdown(context.Background())
+
+	ctx := context.Background()
+	older := signedNote("older")
+	older.CreatedAt--
+	older.Sign(nostr.GeneratePrivateKey())
+	newer := signedNote("newer")
+	srv.AddEvent(ctx, older)
+	srv.AddEvent(ctx, newer)
+
+	conn := dialTestRelay(t, srv)
+	defer conn.Close()
+	conn.WriteJSON([]any{"REQ", "sub", nostr.Filter{IDs: []string{older.ID}}, nostr.Filter{Kinds: []int{nostr.KindTextNote}}})
+
+	var got []string
+	for {
+		msg := readMessage(t, conn)
+		var typ string
+		json.Unmarshal(msg[0], &typ)
+		if typ == "EOSE" {
+			break
+		}
+		var evt nostr.Event
+		json.Unmarshal(msg[2], &evt)
+		got = append(got, evt.Content)
+	}
+	if len(got) != 2 || got[0] != "newer" || got[1] != "older" {
+		t.Errorf("got %v; want [newer older]", got)
+	}
+}
+
+func TestQueryTimeout(t *testing.T) {
+	found := signedNote("found in time")
+	slowStore := &testStorage{
+		queryEvents: func(ctx context.Context, f nostr.Filter) (chan *nostr.Event, error) {
+			ch := make(chan *nostr.Event)
+			go func() {
+				defer close(ch)
+				ch <- found
+				<-ctx.Done()
+			}()
+			return ch, nil
+		},
+	}
+
+	for _, tc := range []struct {
+		mode  QueryTimeoutMode
+		label string
+	}{
+		{QueryTimeoutNotice, "NOTICE"},
+		{QueryTimeoutClosed, "CLOSED"},
+	} {
+		srv, _ := NewServer(&testRelay{storage: slowStore}, WithQueryTimeout(50*time.Millisecond, tc.mode))
+		started := make(chan bool)
+		go srv.Start("127.0.0.1", 0, started)
+		<-started
+
+		conn := dialTestRelay(t, srv)
+		conn.WriteJSON([]any{"REQ", "sub", nostr.Filter{Kinds: []int{nostr.KindTextNote}}})
+		if msg := readLabel(t, conn, "EVENT"); !strings.Contains(string(msg[2]), found.ID) {
+			t.Errorf("%s: got %s", tc.label, msg[2])
+		}
+		readLabel(t, conn, "EOSE")
+		readLabel(t, conn, tc.label)
+		if n := len(srv.GetListeningFilters()); (n == 1) != (tc.mode == QueryTimeoutNotice) {
+			t.Errorf("%s: %d filters listening", tc.label, n)
+		}
+
+		conn.Close()
+		srv.Shutdown(context.Background())
+	}
+}
+
+func TestQueryTimeoutClosesReplaced(t *testing.T) {
+	slowStore := &testStorage{
+		queryEvents: func(ctx context.Context, f nostr.Filter) (chan *nostr.Event, error) {
+			ch := make(chan *nostr.Event)
+			go func() {
+				defer close(ch)
+				if slices.Contains(f.Kinds, nostr.KindTextNote) {
+					<-ctx.Done()
+				}
+			}()
+			return ch, nil
+		},
+	}
+	srv, _ := NewServer(&testRelay{storage: slowStore}, WithQueryTimeout(50*time.Millisecond, QueryTimeoutClosed))
+	started := make(chan bool)
+	go srv.Start("127.0.0.1", 0, started)
+	<-started
+	defer srv.Shutdown(context.Background())
+
+	conn := dialTestRelay(t, srv)
+	defer conn.Close()
+	conn.WriteJSON([]any{"REQ", "sub", nostr.Filter{Kinds: []int{nostr.KindProfileMetadata}}})
+	readLabel(t, conn, "EOSE")
+	conn.WriteJSON([]any{"REQ", "sub", nostr.Filter{Kinds: []int{nostr.KindTextNote}}})
+	readLabel(t, conn, "EOSE")
+	readLabel(t, conn, "CLOSED")
+	if n := len(srv.GetListeningFilters()); n != 0 {
+		t.Errorf("%d filters still listening under the closed id", n)
+	}
+}
@@ -0,0 +1,313 @@
+package relayer
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimitMode selects what the server does with a message exceeding one of
+// the limits set with [WithIPRateLimit] or [WithPubkeyRateLimit].
+type RateLimitMode int
+
+const (
+	// RateLimitWait delays the message until the limiters allow it through.
+	RateLimitWait RateLimitMode = iota
+	// RateLimitReject answers the message right away with a "rate-limited:"
+	// OK (for EVENT) or CLOSED (for REQ and COUNT) message.
+	RateLimitReject
+)
+
+// limiter state for keys not seen for this long is dropped.
+const defaultRateLimitIdleTimeout = 10 * time.Minute
+
+type rateLimit struct {
+	rps   rate.Limit
+	burst int
+}
+
+// WithIPRateLimit limits how many messages of type typ ("EVENT", "REQ" or "COUNT")
+// each client IP can send, regardless of how many connections it opens.
+func WithIPRateLimit(typ string, rps rate.Limit, burst int) Option {
+	return func(o *Options) {
+		if o.ipRateLimits == nil {
+			o.ipRateLimits = make(map[string]rateLimit)
+		}
+		o.ipRateLimits[typ] = rateLimit{rps, burst}
+	}
+}
+
+// WithPubkeyRateLimit limits how many messages of type typ ("EVENT", "REQ" or "COUNT")
+// each pubkey can send. The pubkey is the NIP-42 authenticated one or, for
+// unauthenticated EVENT messages, the event author once its signature is verified.
+func WithPubkeyRateLimit(typ string, rps rate.Limit, burst int) Option {
+	return func(o *Options) {
+		if o.pubkeyRateLimits == nil {
+			o.pubkeyRateLimits = make(map[string]rateLimit)
+		}
+		o.pubkeyRateLimits[typ] = rateLimit{rps, burst}
+	}
+}
+
+// WithKindCost makes each EVENT of the given kind take cost tokens from the EVENT
+// limiters instead of 1. Costs larger than a limiter burst are clamped to it.
+func WithKindCost(kind int, cost int) Option {
+	return func(o *Options) {
+		if o.kindCosts == nil {
+			o.kindCosts = make(map[int]int)
+		}
+		o.kindCosts[kind] = cost
+	}
+}
+
+// WithRateLimitMode sets whether rate limited messages are delayed (the default)
+// or rejected.
+func WithRateLimitMode(mode RateLimitMode) Option {
+	return func(o *Options) {
+		o.rateLimitMode = mode
+	}
+}
+
+// WithRateLimitIdleTimeout sets after how long without messages the limiter state
+// of an IP or pubkey is forgotten. Defaults to 10 minutes.
+func WithRateLimitIdleTimeout(d time.Duration) Option {
+	return func(o *Options) {
+		o.rateLimitIdleTimeout = d
+	}
+}
+
+type rateLimiters struct {
+	mode   RateLimitMode
+	costs  map[int]int
+	ip     map[string]*keyedLimiter
+	pubkey map[string]*keyedLimiter
+}
+
+func newRateLimiters(o *Options) *rateLimiters {
+	if len(o.ipRateLimits) == 0 && len(o.pubkeyRateLimits) == 0 {
+		return nil
+	}
+
+	idle := o.rateLimitIdleTimeout
+	if idle <= 0 {
+		idle = defaultRateLimitIdleTimeout
+	}
+
+	rl := &rateLimiters{
+		mode:   o.rateLimitMode,
+		costs:  o.kindCosts,
+		ip:     make(map[string]*keyedLimiter, len(o.ipRateLimits)),
+		pubkey: make(map[string]*keyedLimiter, len(o.pubkeyRateLimits)),
+	}
+	for typ, l := range o.ipRateLimits {
+		rl.ip[typ] = newKeyedLimiter(l, idle)
+	}
+	for typ, l := range o.pubkeyRateLimits {
+		rl.pubkey[typ] = newKeyedLimiter(l, idle)
+	}
+	return rl
+}
+
+func (rl *rateLimiters) kindCost(kind int) int {
+	if rl == nil {
+		return 1
+	}
+	if cost, ok := rl.costs[kind]; ok {
+		return cost
+	}
+	return 1
+}
+
+// allow takes cost tokens from the typ limiters of both ip and pubkey (when not empty).
+// Depending on the mode it either waits for them to be available or gives up
+// immediately, returning false if the message should be rejected.
+func (rl *rateLimiters) allow(ctx context.Context, typ string, ip string, pubkey string, cost int) bool {
+	if rl == nil {
+		return true
+	}
+
+	now := time.Now()
+	reservations := make([]*rate.Reservation, 0, 2)
+	cancel := func() {
+		for _, r := range reservations {
+			r.CancelAt(now)
+		}
+	}
+
+	var delay time.Duration
+	for _, key := range [2]struct {
+		limiters map[string]*keyedLimiter
+		key      string
+	}{{rl.ip, ip}, {rl.pubkey, pubkey}} {
+		kl, ok := key.limiters[typ]
+		if !ok || key.key == "" {
+			continue
+		}
+		lim := kl.get(key.key, now)
+		r := lim.ReserveN(now, min(cost, lim.Burst()))
+		if !r.OK() {
+			cancel()
+			return false
+		}
+		reservations = append(reservations, r)
+		delay = max(delay, r.DelayFrom(now))
+	}
+
+	if delay == 0 {
+		return true
+	}
+	if rl.mode == RateLimitReject {
+		cancel()
+		return false
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		cancel()
+		return false
+	}
+}
+
+type keyedLimiter struct {
+	limit rateLimit
+	idle  time.Duration
+
+	mu        sync.Mutex
+	entries   map[string]*limiterEntry
+	lastSweep time.Time
+}
+
+type limiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newKeyedLimiter(limit rateLimit, idle time.Duration) *keyedLimiter {
+	return &keyedLimiter{
+		limit:     limit,
+		idle:      idle,
+		entries:   make(map[string]*limiterEntry),
+		lastSweep: time.Now(),
+	}
+}
+
+func (kl *keyedLimiter) get(key string, now time.Time) *rate.Limiter {
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+
+	// forget about keys we haven't heard from in a while so memory stays bounded
+	if now.Sub(kl.lastSweep) > kl.idle {
+		for k, entry := range kl.entries {
+			if now.Sub(entry.lastSeen) > kl.idle {
+				delete(kl.entries, k)
+			}
+		}
+		kl.lastSweep = now
+	}
+
+	entry, ok := kl.entries[key]
+	if !ok {
+		entry = &limiterEntry{limiter: rate.NewLimiter(kl.limit.rps, kl.limit.burst)}
+		kl.entries[key] = entry
+	}
+	entry.lastSeen = now
+	return entry.limiter
+}
+
+// WithTrustedProxies makes the server believe the X-Forwarded-For, X-Real-Ip and
+// X-Forwarded-Proto headers of requests coming from proxies, given as IPs or CIDR
+// ranges. These headers are ignored for any other peer, as clients can set them to
+// anything. The client IP is the right-most X-Forwarded-For address that is not a
+// trusted proxy.
+func WithTrustedProxies(proxies ...string) Option {
+	return func(o *Options) {
+		o.trustedProxies = append(o.trustedProxies, proxies...)
+	}
+}
+
+// proxyList is a set of trusted proxy networks.
+type proxyList []*net.IPNet
+
+func parseProxyList(proxies []string) (proxyList, error) {
+	list := make(proxyList, 0, len(proxies))
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, network)
+	}
+	return list, nil
+}
+
+func (pl proxyList) contains(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range pl {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// fromTrustedProxy tells if r was sent by one of the proxies set with WithTrustedProxies.
+func (s *Server) fromTrustedProxy(r *http.Request) bool {
+	return s.trustedProxies.contains(remoteHost(r))
+}
+
+// clientIP returns the IP address of the client that made r, taking the headers
+// set by trusted reverse proxies into account.
+func (s *Server) clientIP(r *http.Request) string {
+	peer := remoteHost(r)
+	if !s.trustedProxies.contains(peer) {
+		return peer
+	}
+
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		// walk back from the closest hop, as only the addresses appended by our own
+		// proxies can be believed
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		client := ""
+		for i := len(hops) - 1; i >= 0; i-- {
+			if hop := strings.TrimSpace(hops[i]); hop != "" {
+				client = hop
+				if !s.trustedProxies.contains(hop) {
+					break
+				}
+			}
+		}
+		if client != "" {
+			return client
+		}
+	}
+	if realIP := r.Header.Get("X-Real-Ip"); realIP != "" {
+		return strings.TrimSpace(realIP)
+	}
+	return peer
+}
+
+func remoteHost(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
@@ -0,0 +1,144 @@
+package relayer
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/nbd-wtf/go-nostr"
+	"golang.org/x/time/rate"
+)
+
+func TestRateLimitersReject(t *testing.T) {
+	rl := newRateLimiters(&Options{
+		ipRateLimits:     map[string]rateLimit{"REQ": {rate.Every(time.Hour), 2}},
+		pubkeyRateLimits: map[string]rateLimit{"REQ": {rate.Every(time.Hour), 1}},
+		rateLimitMode:    RateLimitReject,
+	})
+	ctx := context.Background()
+
+	if !rl.allow(ctx, "REQ", "1.1.1.1", "", 1) {
+		t.Error("first REQ from ip should be allowed")
+	}
+	if !rl.allow(ctx, "REQ", "1.1.1.1", "alice", 1) {
+		t.Error("second REQ from ip should be allowed")
+	}
+	if rl.allow(ctx, "REQ", "1.1.1.1", "", 1) {
+		t.Error("third REQ from ip should be rejected")
+	}
+	if rl.allow(ctx, "REQ", "2.2.2.2", "alice", 1) {
+		t.Error("second REQ from alice should be rejected")
+	}
+	if !rl.allow(ctx, "REQ", "2.2.2.2", "bob", 1) {
+		t.Error("rejected pubkey should not have consumed ip tokens")
+	}
+	if !rl.allow(ctx, "EVENT", "1.1.1.1", "alice", 1) {
+		t.Error("EVENT has no limits and should be allowed")
+	}
+}
+
+func TestRateLimitersIdleExpiry(t *testing.T) {
+	kl := newKeyedLimiter(rateLimit{rate.Every(time.Hour), 1}, time.Minute)
+	now := time.Now()
+	kl.get("a", now)
+	kl.get("b", now.Add(30*time.Second))
+	kl.get("b", now.Add(90*time.Second))
+	if _, ok := kl.entries["a"]; ok {
+		t.Error("idle entry should have been dropped")
+	}
+	if _, ok := kl.entries["b"]; !ok {
+		t.Error("active entry should have been kept")
+	}
+}
+
+func TestRateLimitRejectEvent(t *testing.T) {
+	srv, _ := NewServer(&testRelay{storage: &slicestore.SliceStore{}},
+		WithIPRateLimit("EVENT", rate.Every(time.Hour), 1),
+		WithRateLimitMode(RateLimitReject),
+	)
+	started := make(chan bool)
+	go srv.Start("127.0.0.1", 0, started)
+	<-started
+	defer srv.Shutdown(context.TODO())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	client, err := nostr.RelayConnect(ctx, "ws://"+srv.Addr)
+	if err != nil {
+		t.Fatalf("nostr.RelayConnect: %v", err)
+	}
+	defer client.Close()
+
+	sk := nostr.GeneratePrivateKey()
+	for i := 0; i < 2; i++ {
+		ev := nostr.Event{Kind: nostr.KindTextNote, CreatedAt: nostr.Now(), Content: "test"}
+		ev.Content += strings.Repeat("!", i)
+		ev.Sign(sk)
+		err := client.Publish(ctx, ev)
+		switch {
+		case i == 0 && err != nil:
+			t.Errorf("first publish: %v", err)
+		case i == 1 && (err == nil || !strings.Contains(err.Error(), "rate-limited:")):
+			t.Errorf("second publish: %v; want rate-limited", err)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	srv, err := NewServer(&testRelay{storage: &slicestore.SliceStore{}}, WithTrustedProxies("10.0.0.0/8", "::1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Shutdown(context.Background())
+
+	for _, tc := range []struct {
+		header http.Header
+		remote string
+		want   string
+	}{
+		{http.Header{}, "10.0.0.1:4567", "10.0.0.1"},
+		{http.Header{"X-Forwarded-For": {"1.2.3.4, 10.0.0.1"}}, "10.0.0.1:4567", "1.2.3.4"},
+		{http.Header{"X-Forwarded-For": {"6.6.6.6, 1.2.3.4, 10.0.0.2"}}, "10.0.0.1:4567", "1.2.3.4"},
+		{http.Header{"X-Forwarded-For": {"6.6.6.6"}, "X-Real-Ip": {"6.6.6.6"}}, "1.2.3.4:4567", "1.2.3.4"},
+		{http.Header{"X-Real-Ip": {"5.6.7.8"}}, "10.0.0.1:4567", "5.6.7.8"},
+		{http.Header{"X-Forwarded-For": {"5.6.7.8"}}, "[::1]:80", "5.6.7.8"},
+		{http.Header{}, "[::1]:80", "::1"},
+	} {
+		r := &http.Request{Header: tc.header, RemoteAddr: tc.remote}
+		if got := srv.clientIP(r); got != tc.want {
+			t.Errorf("clientIP(%v, %q) = %q; want %q", tc.header, tc.remote, got, tc.want)
+		}
+	}
+
+	if _, err := NewServer(&testRelay{storage: &slicestore.SliceStore{}}, WithTrustedProxies("nope")); err == nil {
+		t.Error("accepted an invalid trusted proxy")
+	}
+}
+
+func TestPubkeyRateLimitForgedEvents(t *testing.T) {
+	srv, _ := NewServer(&testRelay{storage: &slicestore.SliceStore{}},
+		WithPubkeyRateLimit("EVENT", rate.Every(time.Hour), 1),
+		WithRateLimitMode(RateLimitReject),
+	)
+	defer srv.Shutdown(context.Background())
+	ctx := context.WithValue(context.Background(), AUTH_CONTEXT_KEY, &WebSocket{ip: "1.1.1.1"})
+
+	victim := nostr.GeneratePrivateKey()
+	for i := range 3 {
+		forged := &nostr.Event{Kind: nostr.KindTextNote, CreatedAt: nostr.Now(), Content: strings.Repeat("!", i)}
+		forged.Sign(victim)
+		forged.Sig = strings.Repeat("0", len(forged.Sig))
+		if res := srv.Publish(ctx, forged, PublishOptions{}); res.Prefix() != "invalid" {
+			t.Fatalf("forged event: %+v", res)
+		}
+	}
+
+	evt := &nostr.Event{Kind: nostr.KindTextNote, CreatedAt: nostr.Now(), Content: "real"}
+	evt.Sign(victim)
+	if res := srv.Publish(ctx, evt, PublishOptions{}); !res.Accepted {
+		t.Errorf("forged events used up the author's budget: %+v", res)
+	}
+}
@@ -0,0 +1,396 @@
+package relayer
+
+import (
+	"container/list"
+	"context"
+	"reflect"
+	"sync"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/relayer/v2/internal/storeutil"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// the most author and kind combinations a filter can have to be served by the read cache.
+const maxCachedPairs = 100
+
+// the most stores the read cache keeps entries for at once.
+const maxCachedStores = 16
+
+// WithReadCache keeps recently queried events in memory, up to about maxBytes, to
+// answer the most common lookups without going to the storage: filters with only ids
+// and filters with only authors and replaceable kinds (like profiles and contact
+// lists). Events saved or deleted through the server are kept up to date in the cache;
+// changes made to the storage by other means are not seen until the entries are evicted.
+// Relays returning different stores from Storage get separate entries for each, for up
+// to 16 comparable stores at once; queries to others are not cached. See
+// [Server.ReadCacheStats].
+func WithReadCache(maxBytes int) Option {
+	return func(o *Options) {
+		o.readCacheBytes = maxBytes
+	}
+}
+
+// ReadCacheStats is returned by [Server.ReadCacheStats].
+type ReadCacheStats struct {
+	// Hits and Misses count the ids and author and kind pairs looked up in the cache.
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+
+	Entries int `json:"entries"`
+	Bytes   int `json:"bytes"`
+}
+
+// ReadCacheStats returns the counters of the cache set with [WithReadCache], which are
+// all zero when there is none.
+func (s *Server) ReadCacheStats() ReadCacheStats {
+	if s.readCache == nil {
+		return ReadCacheStats{}
+	}
+	rc := s.readCache
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return ReadCacheStats{Hits: rc.hits, Misses: rc.misses, Entries: len(rc.entries), Bytes: rc.bytes}
+}
+
+// cacheKey is either an event id or an author and replaceable kind pair, in one of
+// the stores known to the cache.
+type cacheKey struct {
+	store  int
+	id     string
+	pubkey string
+	kind   int
+}
+
+type cacheEntry struct {
+	key cacheKey
+	// event is nil for author and kind pairs known to have no event
+	event *nostr.Event
+	size  int
+}
+
+// readCache is an LRU of events bounded by their approximate size in memory.
+// A nil *readCache caches nothing.
+type readCache struct {
+	maxBytes int
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[cacheKey]*list.Element
+	bytes   int
+	hits    int64
+	misses  int64
+
+	// stores the entries belong to by number, see storeLocked
+	stores    map[int]*cachedStore
+	nextStore int
+
+	// the keys storage queries in flight may put in the cache, so those invalidated
+	// while a query runs aren't filled with what may be outdated already
+	fills map[cacheKey]*pendingFill
+}
+
+// cachedStore is a store the cache has entries, pending fills or queries running for,
+// counted in keys. Stores with none left are forgotten.
+type cachedStore struct {
+	store eventstore.Store
+	keys  int
+}
+
+type pendingFill struct {
+	queries int    // how many queries may fill the key
+	version uint64 // incremented when the key is invalidated
+}
+
+func newReadCache(maxBytes int) *readCache {
+	if maxBytes <= 0 {
+		return nil
+	}
+	return &readCache{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  make(map[cacheKey]*list.Element),
+		stores:   make(map[int]*cachedStore),
+		fills:    make(map[cacheKey]*pendingFill),
+	}
+}
+
+// storeLocked returns the number the entries of store are kept under, keeping it until
+// the matching releaseLocked. It returns false for stores that can't be told apart
+// from others and when there are already maxCachedStores, which are not cached.
+func (rc *readCache) storeLocked(store eventstore.Store) (int, bool) {
+	for num, known := range rc.stores {
+		if known.keys == 0 {
+			delete(rc.stores, num)
+		} else if storeutil.SameValue(known.store, store) {
+			known.keys++
+			return num, true
+		}
+	}
+	if typ := reflect.TypeOf(store); typ == nil || !typ.Comparable() || len(rc.stores) >= maxCachedStores {
+		return 0, false
+	}
+	num := rc.nextStore
+	rc.nextStore++
+	rc.stores[num] = &cachedStore{store: store, keys: 1}
+	return num, true
+}
+
+func (rc *readCache) releaseLocked(storeNum int) {
+	rc.stores[storeNum].keys--
+}
+
+// beginFillLocked registers a storage query that may put keys in the cache, returning
+// their current versions. It must be followed by endFillLocked.
+func (rc *readCache) beginFillLocked(keys []cacheKey) map[cacheKey]uint64 {
+	versions := make(map[cacheKey]uint64, len(keys))
+	for _, key := range keys {
+		fill, ok := rc.fills[key]
+		if !ok {
+			fill = &pendingFill{}
+			rc.fills[key] = fill
+			rc.stores[key.store].keys++
+		}
+		fill.queries++
+		versions[key] = fill.version
+	}
+	return versions
+}
+
+// fillLocked puts evt in the cache under key unless key was invalidated since the
+// query started.
+func (rc *readCache) fillLocked(versions map[cacheKey]uint64, key cacheKey, evt *nostr.Event) {
+	if fill, ok := rc.fills[key]; ok && fill.version == versions[key] {
+		rc.putLocked(key, evt)
+	}
+}
+
+func (rc *readCache) endFillLocked(versions map[cacheKey]uint64) {
+	for key := range versions {
+		fill := rc.fills[key]
+		if fill.queries--; fill.queries == 0 {
+			delete(rc.fills, key)
+			rc.releaseLocked(key.store)
+		}
+	}
+}
+
+// query returns the events matching filter, from the cache as much as possible. ok is
+// false if filter is not one the cache can serve.
+func (rc *readCache) query(ctx context.Context, store eventstore.Store, filter nostr.Filter) (events chan *nostr.Event, ok bool, err error) {
+	if rc == nil || filter.Search != "" || len(filter.Tags) > 0 || filter.Since != nil || filter.Until != nil {
+		return nil, false, nil
+	}
+	byIDs := len(filter.IDs) > 0 && filter.Authors == nil && filter.Kinds == nil
+	replaceable := len(filter.IDs) == 0 && len(filter.Authors) > 0 && len(filter.Kinds) > 0 &&
+		len(filter.Authors)*len(filter.Kinds) <= maxCachedPairs && allReplaceable(filter.Kinds)
+	if !byIDs && !replaceable {
+		return nil, false, nil
+	}
+
+	rc.mu.Lock()
+	storeNum, ok := rc.storeLocked(store)
+	rc.mu.Unlock()
+	if !ok {
+		return nil, false, nil
+	}
+	defer func() {
+		rc.mu.Lock()
+		rc.releaseLocked(storeNum)
+		rc.mu.Unlock()
+	}()
+
+	var result []*nostr.Event
+	if byIDs {
+		result, err = rc.queryIDs(ctx, store, storeNum, filter)
+	} else {
+		result, err = rc.queryReplaceable(ctx, store, storeNum, filter)
+	}
+	if err != nil {
+		return nil, true, err
+	}
+
+	events = make(chan *nostr.Event, len(result))
+	for _, evt := range storeutil.Merge([][]*nostr.Event{result}) {
+		events <- evt
+	}
+	close(events)
+	return events, true, nil
+}
+
+func (rc *readCache) queryIDs(ctx context.Context, store eventstore.Store, storeNum int, filter nostr.Filter) ([]*nostr.Event, error) {
+	rc.mu.Lock()
+	var result []*nostr.Event
+	var missing []string
+	var keys []cacheKey
+	for _, id := range filter.IDs {
+		key := cacheKey{store: storeNum, id: id}
+		if entry, ok := rc.getLocked(key); ok {
+			result = append(result, entry.event)
+		} else {
+			missing = append(missing, id)
+			keys = append(keys, key)
+		}
+	}
+	if len(missing) == 0 {
+		rc.mu.Unlock()
+		return result, nil
+	}
+	versions := rc.beginFillLocked(keys)
+	rc.mu.Unlock()
+
+	filter.IDs = missing
+	fetched, err := storeutil.Collect(ctx, store, filter)
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	defer rc.endFillLocked(versions)
+	if err != nil {
+		return nil, err
+	}
+	for _, evt := range fetched {
+		// other events can be replaced or deleted without us knowing their id
+		if nostr.IsRegularKind(evt.Kind) {
+			rc.fillLocked(versions, cacheKey{store: storeNum, id: evt.ID}, evt)
+		}
+	}
+	return append(result, fetched...), nil
+}
+
+func (rc *readCache) queryReplaceable(ctx context.Context, store eventstore.Store, storeNum int, filter nostr.Filter) ([]*nostr.Event, error) {
+	rc.mu.Lock()
+	var result []*nostr.Event
+	var keys []cacheKey
+	complete := true
+	for _, pubkey := range filter.Authors {
+		for _, kind := range filter.Kinds {
+			key := cacheKey{store: storeNum, pubkey: pubkey, kind: kind}
+			keys = append(keys, key)
+			if entry, ok := rc.getLocked(key); !ok {
+				complete = false
+			} else if entry.event != nil {
+				result = append(result, entry.event)
+			}
+		}
+	}
+	if complete {
+		rc.mu.Unlock()
+		return result, nil
+	}
+	versions := rc.beginFillLocked(keys)
+	rc.mu.Unlock()
+
+	// get all of them, so the ones with no event can be cached as such
+	filter.Limit, filter.LimitZero = 0, false
+	fetched, err := storeutil.Collect(ctx, store, filter)
+	if err != nil {
+		rc.mu.Lock()
+		rc.endFillLocked(versions)
+		rc.mu.Unlock()
+		return nil, err
+	}
+	latest := make(map[cacheKey]*nostr.Event, len(fetched))
+	for _, evt := range fetched {
+		key := cacheKey{store: storeNum, pubkey: evt.PubKey, kind: evt.Kind}
+		if prev, ok := latest[key]; !ok || evt.CreatedAt > prev.CreatedAt {
+			latest[key] = evt
+		}
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	defer rc.endFillLocked(versions)
+	result = result[:0]
+	for _, key := range keys {
+		evt := latest[key]
+		rc.fillLocked(versions, key, evt)
+		if evt != nil {
+			result = append(result, evt)
+		}
+	}
+	return result, nil
+}
+
+// invalidate drops what the cache knows about evt, which was just saved or deleted.
+func (rc *readCache) invalidate(evt *nostr.Event) {
+	if rc == nil {
+		return
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	// the store evt was saved to or deleted from isn't known here
+	for storeNum, known := range rc.stores {
+		if known.keys == 0 {
+			delete(rc.stores, storeNum)
+			continue
+		}
+		rc.invalidateLocked(cacheKey{store: storeNum, id: evt.ID})
+		if nostr.IsReplaceableKind(evt.Kind) {
+			rc.invalidateLocked(cacheKey{store: storeNum, pubkey: evt.PubKey, kind: evt.Kind})
+		}
+	}
+}
+
+func (rc *readCache) invalidateLocked(key cacheKey) {
+	rc.removeLocked(key)
+	if fill, ok := rc.fills[key]; ok {
+		fill.version++
+	}
+}
+
+func (rc *readCache) getLocked(key cacheKey) (*cacheEntry, bool) {
+	elem, ok := rc.entries[key]
+	if !ok {
+		rc.misses++
+		return nil, false
+	}
+	rc.hits++
+	rc.order.MoveToFront(elem)
+	return elem.Value.(*cacheEntry), true
+}
+
+func (rc *readCache) putLocked(key cacheKey, evt *nostr.Event) {
+	rc.removeLocked(key)
+	entry := &cacheEntry{key: key, event: evt, size: eventSize(evt)}
+	rc.entries[key] = rc.order.PushFront(entry)
+	rc.bytes += entry.size
+	rc.stores[key.store].keys++
+	for rc.bytes > rc.maxBytes && rc.order.Len() > 0 {
+		rc.removeLocked(rc.order.Back().Value.(*cacheEntry).key)
+	}
+}
+
+func (rc *readCache) removeLocked(key cacheKey) {
+	if elem, ok := rc.entries[key]; ok {
+		rc.order.Remove(elem)
+		delete(rc.entries, key)
+		rc.bytes -= elem.Value.(*cacheEntry).size
+		rc.releaseLocked(key.store)
+	}
+}
+
+// eventSize is roughly how much memory a cache entry for evt takes.
+func eventSize(evt *nostr.Event) int {
+	size := 200 // the entry, the map key and the fixed size fields
+	if evt == nil {
+		return size
+	}
+	size += len(evt.ID) + len(evt.PubKey) + len(evt.Sig) + len(evt.Content)
+	for _, tag := range evt.Tags {
+		size += 24
+		for _, element := range tag {
+			size += 16 + len(element)
+		}
+	}
+	return size
+}
+
+func allReplaceable(kinds []int) bool {
+	for _, kind := range kinds {
+		if !nostr.IsReplaceableKind(kind) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,201 @@
+package relayer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+type countingStore struct {
+	slicestore.SliceStore
+	queries atomic.Int64
+}
+
+func (cs *countingStore) QueryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	cs.queries.Add(1)
+	return cs.SliceStore.QueryEvents(ctx, filter)
+}
+
+func TestReadCache(t *testing.T) {
+	ctx := context.Background()
+	store := &countingStore{}
+	store.Init()
+	srv, _ := NewServer(&testRelay{storage: store}, WithReadCache(1<<20))
+	defer srv.Shutdown(ctx)
+
+	query := func(filter nostr.Filter) []*nostr.Event {
+		t.Helper()
+		var got []*nostr.Event
+		srv.queryStored(ctx, store, nostr.Filters{filter}, func(evt *nostr.Event) bool {
+			got = append(got, evt)
+			return true
+		})
+		return got
+	}
+	expectQueries := func(n int64) {
+		t.Helper()
+		if q := store.queries.Swap(0); q != n {
+			t.Errorf("got %d storage queries, want %d", q, n)
+		}
+	}
+
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	profile := &nostr.Event{Kind: 0, CreatedAt: nostr.Now() - 10, Content: `{"name":"a"}`}
+	profile.Sign(sk)
+	srv.Publish(ctx, profile, PublishOptions{})
+	store.queries.Store(0)
+
+	profiles := nostr.Filter{Authors: []string{pubkey}, Kinds: []int{0, 3}}
+	for i := 0; i < 3; i++ {
+		if got := query(profiles); len(got) != 1 || got[0].ID != profile.ID {
+			t.Fatalf("profile lookup %d: %v", i, got)
+		}
+	}
+	expectQueries(1)
+	if stats := srv.ReadCacheStats(); stats.Hits != 4 || stats.Misses != 2 || stats.Entries != 2 {
+		t.Errorf("stats: %+v", stats)
+	}
+
+	// a new profile replaces the cached one
+	updated := &nostr.Event{Kind: 0, CreatedAt: nostr.Now(), Content: `{"name":"b"}`}
+	updated.Sign(sk)
+	srv.Publish(ctx, updated, PublishOptions{})
+	store.queries.Store(0)
+	if got := query(profiles); len(got) != 1 || got[0].ID != updated.ID {
+		t.Errorf("after update: %v", got)
+	}
+	expectQueries(1)
+
+	// the contact list was cached as missing, until one shows up
+	contacts := &nostr.Event{Kind: 3, CreatedAt: nostr.Now()}
+	contacts.Sign(sk)
+	srv.Publish(ctx, contacts, PublishOptions{})
+	store.queries.Store(0)
+	if got := query(profiles); len(got) != 2 {
+		t.Errorf("after contact list: %v", got)
+	}
+	expectQueries(1)
+
+	note := &nostr.Event{Kind: nostr.KindTextNote, CreatedAt: nostr.Now(), Content: "cached by id"}
+	note.Sign(sk)
+	srv.Publish(ctx, note, PublishOptions{})
+	store.queries.Store(0)
+	byID := nostr.Filter{IDs: []string{note.ID}}
+	query(byID)
+	if got := query(byID); len(got) != 1 || got[0].ID != note.ID {
+		t.Errorf("id lookup: %v", got)
+	}
+	expectQueries(1)
+
+	deletion := &nostr.Event{Kind: 5, CreatedAt: nostr.Now(), Tags: nostr.Tags{{"e", note.ID}}}
+	deletion.Sign(sk)
+	srv.Publish(ctx, deletion, PublishOptions{})
+	store.queries.Store(0)
+	if got := query(byID); len(got) != 0 {
+		t.Errorf("deleted event served: %v", got)
+	}
+	expectQueries(1)
+}
+
+func TestReadCacheMemoryLimit(t *testing.T) {
+	rc := newReadCache(5000)
+	rc.mu.Lock()
+	storeNum, _ := rc.storeLocked(&slicestore.SliceStore{})
+	rc.mu.Unlock()
+	for i := 0; i < 100; i++ {
+		evt := signedNote(strings.Repeat("x", 100))
+		rc.mu.Lock()
+		rc.putLocked(cacheKey{store: storeNum, id: evt.ID}, evt)
+		rc.mu.Unlock()
+	}
+	if rc.bytes > 5000 || len(rc.entries) == 0 || len(rc.entries) != rc.order.Len() {
+		t.Errorf("%d entries taking %d bytes", len(rc.entries), rc.bytes)
+	}
+}
+
+func TestReadCacheKeys(t *testing.T) {
+	ctx := context.Background()
+	rc := newReadCache(1 << 20)
+	first, second := &slicestore.SliceStore{}, &slicestore.SliceStore{}
+	first.Init()
+	second.Init()
+
+	note := signedNote("only in the first store")
+	first.SaveEvent(ctx, note)
+	lookup := func(store eventstore.Store) int {
+		t.Helper()
+		ch, ok, err := rc.query(ctx, store, nostr.Filter{IDs: []string{note.ID}})
+		if !ok || err != nil {
+			t.Fatalf("query not served by the cache: %v", err)
+		}
+		n := 0
+		for range ch {
+			n++
+		}
+		return n
+	}
+	if lookup(first) != 1 || lookup(second) != 0 {
+		t.Error("entries of one store served for another")
+	}
+
+	// an unrelated write while a query runs doesn't keep it from filling the cache
+	rc.mu.Lock()
+	storeNum, _ := rc.storeLocked(first)
+	key := cacheKey{store: storeNum, id: "other"}
+	versions := rc.beginFillLocked([]cacheKey{key, {store: storeNum, id: note.ID}})
+	rc.mu.Unlock()
+	rc.invalidate(signedNote("unrelated"))
+	rc.invalidate(&nostr.Event{ID: "other"})
+	rc.mu.Lock()
+	rc.fillLocked(versions, key, note)
+	rc.fillLocked(versions, cacheKey{store: storeNum, id: note.ID}, note)
+	rc.endFillLocked(versions)
+	rc.releaseLocked(storeNum)
+	_, stale := rc.entries[key]
+	_, fresh := rc.entries[cacheKey{store: storeNum, id: note.ID}]
+	rc.mu.Unlock()
+	if stale || !fresh || len(rc.fills) != 0 {
+		t.Errorf("invalidated key cached: %v, other key cached: %v, %d fills left", stale, fresh, len(rc.fills))
+	}
+}
+
+// freshStorageRelay returns a new value wrapping the same store on every Storage call.
+type freshStorageRelay struct {
+	testRelay
+}
+
+type storeHandle struct {
+	*slicestore.SliceStore
+}
+
+func (fr *freshStorageRelay) Storage(context.Context) eventstore.Store {
+	return &storeHandle{fr.storage.(*slicestore.SliceStore)}
+}
+
+func TestReadCacheFreshStores(t *testing.T) {
+	ctx := context.Background()
+	relay := &freshStorageRelay{testRelay{storage: &slicestore.SliceStore{}}}
+	srv, _ := NewServer(relay, WithReadCache(1<<20))
+	defer srv.Shutdown(ctx)
+
+	for i := 0; i < 100; i++ {
+		note := signedNote(fmt.Sprint(i))
+		srv.Publish(ctx, note, PublishOptions{})
+		srv.queryStored(ctx, relay.Storage(ctx), nostr.Filters{{IDs: []string{note.ID}}}, func(*nostr.Event) bool { return true })
+		srv.queryStored(ctx, relay.Storage(ctx), nostr.Filters{{IDs: []string{"missing"}}}, func(*nostr.Event) bool { return true })
+	}
+
+	rc := srv.readCache
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if len(rc.stores) > maxCachedStores {
+		t.Errorf("%d stores kept", len(rc.stores))
+	}
+}
@@ -0,0 +1,223 @@
+package relayer
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/relayer/v2/internal/storeutil"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// how many events a retention pass asks the storage for at once.
+const retentionPageSize = 500
+
+// RetentionRule says which stored events [WithRetention] deletes. An event is deleted
+// if any of the limits set is exceeded; zero fields are not limits.
+type RetentionRule struct {
+	// Kinds the rule applies to, or all of them if empty. The limits below are counted
+	// for each kind separately.
+	Kinds []int
+
+	// MaxAge deletes events created longer ago than it.
+	MaxAge time.Duration
+	// MaxPerAuthor keeps only the newest events of each author of each kind.
+	MaxPerAuthor int
+	// KeepLatest keeps only the newest events of each kind.
+	KeepLatest int
+}
+
+// RetentionReport describes a retention pass, see [Server.RunRetention].
+type RetentionReport struct {
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+	// Deleted counts the deleted events by kind.
+	Deleted map[int]int `json:"deleted"`
+	// Error is set if the pass stopped because of an error.
+	Error string `json:"error,omitempty"`
+}
+
+// WithRetention deletes stored events according to rules every interval, starting one
+// interval after the server is created, until [Server.Shutdown]. It works with any
+// storage, going through events newest first with QueryEvents and removing them with
+// DeleteEvent, so events sharing a created_at with more events than the storage
+// returns for a single query may be skipped. See also [Server.RunRetention] and
+// [Server.LastRetentionReport].
+func WithRetention(interval time.Duration, rules ...RetentionRule) Option {
+	return func(o *Options) {
+		o.retentionInterval = interval
+		o.retentionRules = rules
+	}
+}
+
+// retention runs the scheduled retention passes and remembers the last report.
+type retention struct {
+	mu sync.Mutex // held during a pass, so passes never overlap
+
+	lastMu sync.Mutex // separate from mu, so the last report can be read during a pass
+	last   *RetentionReport
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func (s *Server) startRetention() {
+	if s.options.retentionInterval <= 0 || len(s.options.retentionRules) == 0 {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.retention.cancel = cancel
+	s.retention.wg.Add(1)
+	go func() {
+		defer s.retention.wg.Done()
+		ticker := time.NewTicker(s.options.retentionInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.RunRetention(ctx, s.options.retentionRules...)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// stopRetention stops the scheduled passes, interrupting a running one.
+func (s *Server) stopRetention() {
+	if s.retention.cancel != nil {
+		s.retention.cancel()
+	}
+	s.retention.wg.Wait()
+}
+
+// RunRetention deletes the stored events that exceed the limits of rules right away,
+// logging and returning what was deleted. It waits for any pass already running.
+func (s *Server) RunRetention(ctx context.Context, rules ...RetentionRule) RetentionReport {
+	s.retention.mu.Lock()
+	defer s.retention.mu.Unlock()
+
+	report := RetentionReport{Start: time.Now(), Deleted: make(map[int]int)}
+	store := s.relay.Storage(ctx)
+	for _, rule := range rules {
+		if err := s.applyRetention(ctx, store, rule, report.Deleted); err != nil {
+			report.Error = err.Error()
+			break
+		}
+	}
+	report.Duration = time.Since(report.Start)
+
+	total := 0
+	for _, n := range report.Deleted {
+		total += n
+	}
+	if report.Error != "" {
+		s.Log.Errorf("retention: deleted %d events before failing: %s", total, report.Error)
+	} else if total > 0 {
+		s.Log.Infof("retention: deleted %d events in %s", total, report.Duration.Round(time.Millisecond))
+	}
+
+	s.retention.lastMu.Lock()
+	s.retention.last = &report
+	s.retention.lastMu.Unlock()
+	return report
+}
+
+// LastRetentionReport returns the report of the last retention pass, if any.
+func (s *Server) LastRetentionReport() (RetentionReport, bool) {
+	s.retention.lastMu.Lock()
+	defer s.retention.lastMu.Unlock()
+	if s.retention.last == nil {
+		return RetentionReport{}, false
+	}
+	return *s.retention.last, true
+}
+
+// applyRetention goes through the events rule applies to, newest first, deleting the
+// ones beyond its limits and counting them in deleted.
+func (s *Server) applyRetention(ctx context.Context, store eventstore.Store, rule RetentionRule, deleted map[int]int) error {
+	if rule.MaxAge <= 0 && rule.MaxPerAuthor <= 0 && rule.KeepLatest <= 0 {
+		return nil
+	}
+
+	var cutoff nostr.Timestamp
+	if rule.MaxAge > 0 {
+		cutoff = nostr.Timestamp(time.Now().Add(-rule.MaxAge).Unix())
+	}
+
+	until := nostr.Now()
+	if rule.MaxPerAuthor <= 0 && rule.KeepLatest <= 0 {
+		// only old events go, no need to count the recent ones
+		until = cutoff - 1
+	}
+
+	type authorKind struct {
+		pubkey string
+		kind   int
+	}
+	perKind := make(map[int]int)
+	perAuthor := make(map[authorKind]int)
+	// events at the until timestamp already seen, as the next page starts there again
+	boundary := make(map[string]bool)
+
+	for {
+		filter := nostr.Filter{Kinds: rule.Kinds, Until: &until, Limit: retentionPageSize}
+		page, err := storeutil.Collect(ctx, store, filter)
+		if err != nil {
+			return err
+		}
+		page = slices.DeleteFunc(storeutil.Merge([][]*nostr.Event{page}), func(evt *nostr.Event) bool {
+			return boundary[evt.ID]
+		})
+		if len(page) == 0 {
+			if len(boundary) == 0 || until == 0 {
+				return nil
+			}
+			// all events at this timestamp were seen, move past it
+			until--
+			clear(boundary)
+			continue
+		}
+
+		for _, evt := range page {
+			if evt.CreatedAt != until {
+				until = evt.CreatedAt
+				clear(boundary)
+			}
+			boundary[evt.ID] = true
+
+			key := authorKind{evt.PubKey, evt.Kind}
+			if (cutoff == 0 || evt.CreatedAt >= cutoff) &&
+				(rule.KeepLatest <= 0 || perKind[evt.Kind] < rule.KeepLatest) &&
+				(rule.MaxPerAuthor <= 0 || perAuthor[key] < rule.MaxPerAuthor) {
+				perKind[evt.Kind]++
+				perAuthor[key]++
+			} else {
+				if err := s.deleteStored(ctx, store, evt); err != nil {
+					return err
+				}
+				deleted[evt.Kind]++
+			}
+		}
+	}
+}
+
+// deleteStored deletes evt from store, calling the AdvancedDeleter hooks and keeping
+// the read cache and the ids of verified events up to date.
+func (s *Server) deleteStored(ctx context.Context, store eventstore.Store, evt *nostr.Event) error {
+	advancedDeleter, _ := store.(AdvancedDeleter)
+	if advancedDeleter != nil {
+		advancedDeleter.BeforeDelete(ctx, evt.ID, evt.PubKey)
+	}
+	if err := store.DeleteEvent(ctx, evt); err != nil {
+		return err
+	}
+	s.readCache.invalidate(evt)
+	s.verified.remove(evt.ID)
+	if advancedDeleter != nil {
+		advancedDeleter.AfterDelete(evt.ID, evt.PubKey)
+	}
+	return nil
+}
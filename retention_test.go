@@ -0,0 +1,156 @@
+package relayer
+
+import (
+	"context"
+	"maps"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/fiatjaf/relayer/v2/internal/storeutil"
+	"github.com/nbd-wtf/go-nostr"
+	"go.uber.org/goleak"
+)
+
+func TestRunRetention(t *testing.T) {
+	ctx := context.Background()
+	// a tiny page size, so passes go through several pages
+	store := &slicestore.SliceStore{MaxLimit: 3}
+	srv, _ := NewServer(&testRelay{storage: store})
+	defer srv.Shutdown(ctx)
+
+	now := nostr.Now()
+	save := func(sk string, kind int, createdAt nostr.Timestamp) *nostr.Event {
+		evt := &nostr.Event{Kind: kind, CreatedAt: createdAt, Content: nostr.GeneratePrivateKey()}
+		evt.Sign(sk)
+		store.SaveEvent(ctx, evt)
+		return evt
+	}
+	alice, bob, carol := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	kept := make(map[string]bool)
+	for i := range 5 {
+		evt := save(alice, 1, now-nostr.Timestamp(i))
+		kept[evt.ID] = i < 2
+	}
+	for range 3 {
+		save(bob, 1, now-100) // all at the same time, filling a page
+	}
+	for i := range 2 {
+		kept[save(carol, 1, now-3*24*60*60-nostr.Timestamp(i)).ID] = false
+	}
+	for i := range 4 {
+		kept[save(carol, 7, now-nostr.Timestamp(i)).ID] = i == 0
+	}
+	kept[save(carol, 30023, now-3*24*60*60).ID] = true
+
+	report := srv.RunRetention(ctx,
+		RetentionRule{Kinds: []int{1}, MaxAge: 24 * time.Hour, MaxPerAuthor: 2},
+		RetentionRule{Kinds: []int{7}, KeepLatest: 1},
+	)
+	if want := map[int]int{1: 6, 7: 3}; !maps.Equal(report.Deleted, want) || report.Error != "" {
+		t.Errorf("report: %+v", report)
+	}
+	if last, ok := srv.LastRetentionReport(); !ok || !maps.Equal(last.Deleted, report.Deleted) {
+		t.Errorf("last report: %+v", last)
+	}
+
+	store.MaxLimit = 100
+	events, _ := storeutil.Collect(ctx, store, nostr.Filter{})
+	left := make(map[string]bool)
+	bobs := 0
+	for _, evt := range events {
+		left[evt.ID] = true
+		if _, ok := kept[evt.ID]; !ok {
+			bobs++
+		}
+	}
+	for id, keep := range kept {
+		if keep != left[id] {
+			t.Errorf("event %s kept: %v, want %v", id, left[id], keep)
+		}
+	}
+	if bobs != 2 {
+		t.Errorf("%d of bob's notes left, want 2", bobs)
+	}
+}
+
+// preloadedStore keeps the events saved before the server initializes it.
+type preloadedStore struct {
+	slicestore.SliceStore
+}
+
+func (*preloadedStore) Init() error { return nil }
+
+func TestRetentionSchedule(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ctx := context.Background()
+	store := &preloadedStore{}
+	store.SliceStore.Init()
+	// saved before passes start, as the slice store isn't safe for concurrent use
+	old := &nostr.Event{Kind: 1, CreatedAt: nostr.Now() - 2*60*60}
+	old.Sign(nostr.GeneratePrivateKey())
+	store.SaveEvent(ctx, old)
+
+	srv, _ := NewServer(&testRelay{storage: store},
+		WithRetention(10*time.Millisecond, RetentionRule{MaxAge: time.Hour}))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if report, ok := srv.LastRetentionReport(); ok && report.Deleted[1] == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no retention pass deleted the old event")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	srv.Shutdown(ctx)
+}
+
+// slowDeleteStore blocks deletions until release is closed.
+type slowDeleteStore struct {
+	slicestore.SliceStore
+	deleting chan struct{}
+	release  chan struct{}
+}
+
+func (s *slowDeleteStore) DeleteEvent(ctx context.Context, evt *nostr.Event) error {
+	close(s.deleting)
+	<-s.release
+	return s.SliceStore.DeleteEvent(ctx, evt)
+}
+
+func TestLastRetentionReportDuringPass(t *testing.T) {
+	ctx := context.Background()
+	store := &slowDeleteStore{deleting: make(chan struct{}), release: make(chan struct{})}
+	store.Init()
+	srv, _ := NewServer(&testRelay{storage: store})
+	defer srv.Shutdown(ctx)
+
+	old := &nostr.Event{Kind: 1, CreatedAt: nostr.Now() - 2*60*60}
+	old.Sign(nostr.GeneratePrivateKey())
+	store.SaveEvent(ctx, old)
+
+	done := make(chan RetentionReport)
+	go func() { done <- srv.RunRetention(ctx, RetentionRule{MaxAge: time.Hour}) }()
+	<-store.deleting
+
+	got := make(chan bool)
+	go func() {
+		_, ok := srv.LastRetentionReport()
+		got <- ok
+	}()
+	select {
+	case ok := <-got:
+		if ok {
+			t.Error("a report before any pass finished")
+		}
+	case <-time.After(time.Second):
+		t.Error("LastRetentionReport blocked by a running pass")
+	}
+	close(store.release)
+	if report := <-done; report.Deleted[1] != 1 {
+		t.Errorf("report: %+v", report)
+	}
+}
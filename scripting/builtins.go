@@ -0,0 +1,297 @@
+package scripting
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/relayer/v2"
+	"github.com/fiatjaf/relayer/v2/internal/storeutil"
+	"github.com/nbd-wtf/go-nostr"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// thread local key holding the context.Context of the call.
+const contextKey = "context"
+
+// query() never returns more events than this.
+const maxQueryResults = 500
+
+func (e *Engine) builtins() starlark.StringDict {
+	return starlark.StringDict{
+		"tag":           starlark.NewBuiltin("tag", builtinTag),
+		"tags":          starlark.NewBuiltin("tags", builtinTags),
+		"matches":       starlark.NewBuiltin("matches", builtinMatches),
+		"query":         starlark.NewBuiltin("query", e.builtinQuery),
+		"shadow_reject": starlark.NewBuiltin("shadow_reject", builtinShadowReject),
+		"now":           starlark.NewBuiltin("now", builtinNow),
+	}
+}
+
+func threadContext(thread *starlark.Thread) context.Context {
+	if ctx, ok := thread.Local(contextKey).(context.Context); ok {
+		return ctx
+	}
+	return context.Background()
+}
+
+func eventTags(b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) ([]string, error) {
+	var (
+		event *starlarkstruct.Struct
+		name  string
+	)
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 2, &event, &name); err != nil {
+		return nil, err
+	}
+	tags, err := event.Attr("tags")
+	if err != nil {
+		return nil, err
+	}
+
+	var values []string
+	iter := starlark.Iterate(tags)
+	defer iter.Done()
+	var tag starlark.Value
+	for iter.Next(&tag) {
+		list, ok := tag.(*starlark.List)
+		if !ok || list.Len() < 2 {
+			continue
+		}
+		if key, _ := starlark.AsString(list.Index(0)); key == name {
+			value, _ := starlark.AsString(list.Index(1))
+			values = append(values, value)
+		}
+	}
+	return values, nil
+}
+
+func builtinTag(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	values, err := eventTags(b, args, kwargs)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return starlark.None, nil
+	}
+	return starlark.String(values[0]), nil
+}
+
+func builtinTags(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	values, err := eventTags(b, args, kwargs)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]starlark.Value, len(values))
+	for i, v := range values {
+		list[i] = starlark.String(v)
+	}
+	return starlark.NewList(list), nil
+}
+
+// how many compiled patterns are kept for matches(), as scripts may build them from
+// event contents.
+const maxCachedRegexps = 256
+
+var (
+	regexpsMu sync.Mutex
+	regexps   = make(map[string]*regexp.Regexp)
+)
+
+// compileRegexp compiles pattern, reusing the compiled patterns of earlier calls.
+func compileRegexp(pattern string) (*regexp.Regexp, error) {
+	regexpsMu.Lock()
+	re, ok := regexps[pattern]
+	regexpsMu.Unlock()
+	if ok {
+		return re, nil
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	regexpsMu.Lock()
+	defer regexpsMu.Unlock()
+	if len(regexps) >= maxCachedRegexps {
+		for old := range regexps {
+			delete(regexps, old)
+			break
+		}
+	}
+	regexps[pattern] = re
+	return re, nil
+}
+
+func builtinMatches(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var pattern, text string
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 2, &pattern, &text); err != nil {
+		return nil, err
+	}
+
+	re, err := compileRegexp(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", b.Name(), err)
+	}
+	return starlark.Bool(re.MatchString(text)), nil
+}
+
+func (e *Engine) builtinQuery(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var filterDict *starlark.Dict
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &filterDict); err != nil {
+		return nil, err
+	}
+	if e.relay == nil {
+		return nil, fmt.Errorf("%s: no relay storage available", b.Name())
+	}
+
+	j, err := json.Marshal(fromStarlark(filterDict))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", b.Name(), err)
+	}
+	var filter nostr.Filter
+	if err := json.Unmarshal(j, &filter); err != nil {
+		return nil, fmt.Errorf("%s: invalid filter: %w", b.Name(), err)
+	}
+	if filter.Limit <= 0 || filter.Limit > maxQueryResults {
+		filter.Limit = maxQueryResults
+	}
+
+	// stops at the deadline of the call even if the storage doesn't
+	ctx := threadContext(thread)
+	events, err := storeutil.Collect(ctx, e.relay.Storage(ctx), filter)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", b.Name(), err)
+	}
+
+	results := make([]starlark.Value, 0, min(len(events), filter.Limit))
+	for _, evt := range events[:min(len(events), filter.Limit)] {
+		results = append(results, eventValue(evt))
+	}
+	return starlark.NewList(results), nil
+}
+
+func builtinShadowReject(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	relayer.ShadowReject(threadContext(thread))
+	return starlark.None, nil
+}
+
+func builtinNow(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	return starlark.MakeInt64(time.Now().Unix()), nil
+}
+
+func eventValue(evt *nostr.Event) starlark.Value {
+	tags := make([]starlark.Value, len(evt.Tags))
+	for i, tag := range evt.Tags {
+		items := make([]starlark.Value, len(tag))
+		for j, item := range tag {
+			items[j] = starlark.String(item)
+		}
+		tags[i] = starlark.NewList(items)
+	}
+
+	s := starlarkstruct.FromStringDict(starlark.String("event"), starlark.StringDict{
+		"id":         starlark.String(evt.ID),
+		"pubkey":     starlark.String(evt.PubKey),
+		"created_at": starlark.MakeInt64(int64(evt.CreatedAt)),
+		"kind":       starlark.MakeInt(evt.Kind),
+		"tags":       starlark.NewList(tags),
+		"content":    starlark.String(evt.Content),
+		"sig":        starlark.String(evt.Sig),
+	})
+	s.Freeze()
+	return s
+}
+
+func connValue(ctx context.Context) starlark.Value {
+	source := "internal"
+	ip, ok := relayer.GetClientIP(ctx)
+	if ok {
+		source = "websocket"
+	}
+	authed, _ := relayer.GetAuthStatus(ctx)
+
+	return starlarkstruct.FromStringDict(starlark.String("conn"), starlark.StringDict{
+		"ip":     starlark.String(ip),
+		"authed": starlark.String(authed),
+		"source": starlark.String(source),
+	})
+}
+
+func filterValue(filter nostr.Filter) starlark.Value {
+	j, _ := json.Marshal(filter)
+	var v any
+	json.Unmarshal(j, &v)
+	return toStarlark(v)
+}
+
+// toStarlark converts values decoded by encoding/json to Starlark values.
+func toStarlark(v any) starlark.Value {
+	switch v := v.(type) {
+	case nil:
+		return starlark.None
+	case bool:
+		return starlark.Bool(v)
+	case float64:
+		if v == float64(int64(v)) {
+			return starlark.MakeInt64(int64(v))
+		}
+		return starlark.Float(v)
+	case string:
+		return starlark.String(v)
+	case []any:
+		list := make([]starlark.Value, len(v))
+		for i, item := range v {
+			list[i] = toStarlark(item)
+		}
+		return starlark.NewList(list)
+	case map[string]any:
+		dict := starlark.NewDict(len(v))
+		for k, item := range v {
+			dict.SetKey(starlark.String(k), toStarlark(item))
+		}
+		return dict
+	default:
+		return starlark.None
+	}
+}
+
+// fromStarlark converts Starlark values to values encoding/json can marshal.
+func fromStarlark(v starlark.Value) any {
+	switch v := v.(type) {
+	case starlark.Bool:
+		return bool(v)
+	case starlark.Int:
+		i, _ := v.Int64()
+		return i
+	case starlark.Float:
+		return float64(v)
+	case starlark.String:
+		return string(v)
+	case starlark.Indexable: // lists and tuples
+		list := make([]any, v.Len())
+		for i := range list {
+			list[i] = fromStarlark(v.Index(i))
+		}
+		return list
+	case *starlark.Dict:
+		m := make(map[string]any, v.Len())
+		for _, item := range v.Items() {
+			if k, ok := starlark.AsString(item[0]); ok {
+				m[k] = fromStarlark(item[1])
+			}
+		}
+		return m
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,275 @@
+// Package scripting implements relay policies as Starlark scripts, so small
+// admission rules can be changed without recompiling the relay.
+//
+// A script may define any of these functions:
+//
+//	def accept_event(event, conn):
+//	    # event has id, pubkey, created_at, kind, tags, content and sig
+//	    # conn has ip, authed and source ("websocket" or "internal")
+//	    return True
+//
+//	def accept_req(id, filters, conn):
+//	    # filters is a list of dicts in NIP-01 format
+//	    return True
+//
+// accept_event accepts the event by returning True or None. It rejects it by returning
+// False, a reason string like "blocked: no links allowed" or a (False, reason) tuple.
+// Missing functions accept everything.
+//
+// Scripts run in a sandbox without access to files or the network. Besides the
+// Starlark builtins they can call:
+//
+//	tag(event, name)       # the first value of the first tag called name, or None
+//	tags(event, name)      # the values of all tags called name
+//	matches(pattern, text) # whether the Go regular expression pattern matches text
+//	query(filter)          # events from the relay storage matching a filter dict
+//	shadow_reject()        # see relayer.ShadowReject
+//	now()                  # the current unix timestamp
+package scripting
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/relayer/v2"
+	"github.com/nbd-wtf/go-nostr"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+const (
+	// how long a single call to a script function may run by default.
+	defaultTimeout = 100 * time.Millisecond
+
+	// how many Starlark computation steps a single call may take by default.
+	defaultMaxSteps = 1_000_000
+
+	// how often the script file is checked for changes.
+	reloadInterval = 2 * time.Second
+)
+
+// Engine runs the policy functions defined in a Starlark script file. Its methods
+// can be used directly as [relayer.Relay.AcceptEvent] and [relayer.ReqAccepter.AcceptReq].
+//
+// The script is reloaded whenever the file changes. If a new version fails to load,
+// the previous one keeps being used.
+type Engine struct {
+	// Timeout and MaxSteps bound the execution of each call. Calls going over them
+	// fail. Default to 100ms and one million steps.
+	Timeout  time.Duration
+	MaxSteps uint64
+
+	// FailOpen makes events and requests be accepted when the script fails,
+	// instead of rejected.
+	FailOpen bool
+
+	// Log defaults to the stdlib logger.
+	Log relayer.Logger
+
+	path  string
+	relay relayer.Relay
+
+	mu      sync.RWMutex
+	globals starlark.StringDict
+	modTime time.Time
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// New loads the script at path and starts watching it for changes.
+// relay is used by the query() builtin and may be nil to disable it.
+// Call Close when done.
+func New(path string, relay relayer.Relay) (*Engine, error) {
+	e := &Engine{
+		Timeout:  defaultTimeout,
+		MaxSteps: defaultMaxSteps,
+		Log:      stdLogger{},
+		path:     path,
+		relay:    relay,
+		done:     make(chan struct{}),
+	}
+	if err := e.Reload(); err != nil {
+		return nil, err
+	}
+
+	e.wg.Add(1)
+	go e.watch()
+
+	return e, nil
+}
+
+// Close stops watching the script file.
+func (e *Engine) Close() {
+	close(e.done)
+	e.wg.Wait()
+}
+
+// Reload loads the script from disk again.
+func (e *Engine) Reload() error {
+	fi, err := os.Stat(e.path)
+	if err != nil {
+		return err
+	}
+	src, err := os.ReadFile(e.path)
+	if err != nil {
+		return err
+	}
+
+	thread := &starlark.Thread{Name: "load " + e.path}
+	thread.SetMaxExecutionSteps(e.maxSteps())
+	timer := time.AfterFunc(e.timeout(), func() { thread.Cancel("timeout") })
+	defer timer.Stop()
+
+	globals, err := starlark.ExecFileOptions(&syntax.FileOptions{}, thread, e.path, src, e.builtins())
+	if err != nil {
+		return fmt.Errorf("failed to load %s: %w", e.path, err)
+	}
+	globals.Freeze()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.globals = globals
+	e.modTime = fi.ModTime()
+	return nil
+}
+
+func (e *Engine) watch() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(reloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			fi, err := os.Stat(e.path)
+			if err != nil {
+				continue
+			}
+			e.mu.RLock()
+			changed := !fi.ModTime().Equal(e.modTime)
+			e.mu.RUnlock()
+			if !changed {
+				continue
+			}
+			if err := e.Reload(); err != nil {
+				e.Log.Errorf("%v", err)
+			} else {
+				e.Log.Infof("reloaded %s", e.path)
+			}
+		case <-e.done:
+			return
+		}
+	}
+}
+
+// AcceptEvent calls the script accept_event function.
+func (e *Engine) AcceptEvent(ctx context.Context, evt *nostr.Event) (bool, string) {
+	res, err := e.call(ctx, "accept_event", starlark.Tuple{eventValue(evt), connValue(ctx)})
+	if err != nil {
+		e.Log.Warningf("accept_event %s: %v", evt.ID, err)
+		if e.FailOpen {
+			return true, ""
+		}
+		return false, "error: policy failed"
+	}
+
+	switch v := res.(type) {
+	case starlark.NoneType:
+		return true, ""
+	case starlark.Bool:
+		if v {
+			return true, ""
+		}
+		return false, "blocked: event blocked by policy"
+	case starlark.String:
+		return false, reason(string(v))
+	case starlark.Tuple:
+		if len(v) == 2 {
+			msg, _ := starlark.AsString(v[1])
+			if v[0].Truth() {
+				return true, ""
+			}
+			return false, reason(msg)
+		}
+	}
+
+	e.Log.Warningf("accept_event %s: unexpected result %s", evt.ID, res)
+	if e.FailOpen {
+		return true, ""
+	}
+	return false, "error: policy failed"
+}
+
+// AcceptReq calls the script accept_req function.
+func (e *Engine) AcceptReq(ctx context.Context, id string, filters nostr.Filters, authedPubkey string) bool {
+	list := make([]starlark.Value, len(filters))
+	for i, filter := range filters {
+		list[i] = filterValue(filter)
+	}
+
+	res, err := e.call(ctx, "accept_req", starlark.Tuple{starlark.String(id), starlark.NewList(list), connValue(ctx)})
+	if err != nil {
+		e.Log.Warningf("accept_req %s: %v", id, err)
+		return e.FailOpen
+	}
+	return res == starlark.None || bool(res.Truth())
+}
+
+// call runs the script function called name, returning None if it isn't defined.
+func (e *Engine) call(ctx context.Context, name string, args starlark.Tuple) (starlark.Value, error) {
+	e.mu.RLock()
+	fn, ok := e.globals[name]
+	e.mu.RUnlock()
+	if !ok {
+		return starlark.None, nil
+	}
+
+	thread := &starlark.Thread{Name: name}
+	thread.SetMaxExecutionSteps(e.maxSteps())
+
+	ctx, cancel := context.WithTimeout(ctx, e.timeout())
+	defer cancel()
+	thread.SetLocal(contextKey, ctx) // so queries made by the script share its deadline
+	stop := context.AfterFunc(ctx, func() { thread.Cancel(ctx.Err().Error()) })
+	defer stop()
+
+	return starlark.Call(thread, fn, args, nil)
+}
+
+func (e *Engine) timeout() time.Duration {
+	if e.Timeout <= 0 {
+		return defaultTimeout
+	}
+	return e.Timeout
+}
+
+func (e *Engine) maxSteps() uint64 {
+	if e.MaxSteps == 0 {
+		return defaultMaxSteps
+	}
+	return e.MaxSteps
+}
+
+// reason makes sure msg has a NIP-01 machine-readable prefix.
+func reason(msg string) string {
+	if msg == "" {
+		return "blocked: event blocked by policy"
+	}
+	if prefix, _, ok := strings.Cut(msg, ": "); ok && !strings.Contains(prefix, " ") {
+		return msg
+	}
+	return "blocked: " + msg
+}
+
+type stdLogger struct{}
+
+func (stdLogger) Infof(format string, v ...any)    { log.Printf(format, v...) }
+func (stdLogger) Warningf(format string, v ...any) { log.Printf(format, v...) }
+func (stdLogger) Errorf(format string, v ...any)   { log.Printf(format, v...) }
@@ -0,0 +1,195 @@
+package scripting
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const linkPolicy = `
+def accept_event(event, conn):
+    if event.kind == 1 and matches(r"https?://", event.content):
+        older = query({"authors": [event.pubkey], "until": event.created_at - 1, "limit": 1})
+        if len(older) == 0:
+            return "blocked: new keys can't post links"
+    if tag(event, "t") == "spam":
+        return (False, "spam is not welcome")
+    if "shadow" in tags(event, "t"):
+        shadow_reject()
+    return True
+
+def accept_req(id, filters, conn):
+    return all([f.get("kinds") != [4] for f in filters])
+`
+
+type relay struct{ store eventstore.Store }
+
+func (r relay) Name() string                                             { return "scripted" }
+func (r relay) Init() error                                              { return nil }
+func (r relay) Storage(context.Context) eventstore.Store                 { return r.store }
+func (r relay) AcceptEvent(context.Context, *nostr.Event) (bool, string) { return true, "" }
+
+func writeScript(t *testing.T, path, src string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func note(sk string, createdAt nostr.Timestamp, content string, tags ...nostr.Tag) *nostr.Event {
+	evt := &nostr.Event{Kind: 1, CreatedAt: createdAt, Content: content, Tags: tags}
+	evt.Sign(sk)
+	return evt
+}
+
+func TestEngine(t *testing.T) {
+	store := &slicestore.SliceStore{}
+	store.Init()
+	path := filepath.Join(t.TempDir(), "policy.star")
+	writeScript(t, path, linkPolicy)
+
+	engine, err := New(path, relay{store})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer engine.Close()
+
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+
+	if ok, msg := engine.AcceptEvent(ctx, note(sk, 1000, "see https://example.com")); ok || msg != "blocked: new keys can't post links" {
+		t.Errorf("link from new key: got %v %q", ok, msg)
+	}
+	store.SaveEvent(ctx, note(sk, 900, "hello"))
+	if ok, msg := engine.AcceptEvent(ctx, note(sk, 1000, "see https://example.com")); !ok {
+		t.Errorf("link from known key rejected: %s", msg)
+	}
+	if ok, msg := engine.AcceptEvent(ctx, note(sk, 1000, "hi", nostr.Tag{"t", "spam"})); ok || msg != "blocked: spam is not welcome" {
+		t.Errorf("spam tag: got %v %q", ok, msg)
+	}
+
+	if engine.AcceptReq(ctx, "sub", nostr.Filters{{Kinds: []int{4}}}, "") {
+		t.Error("kind 4 REQ accepted")
+	}
+	if !engine.AcceptReq(ctx, "sub", nostr.Filters{{Kinds: []int{1}}}, "") {
+		t.Error("kind 1 REQ rejected")
+	}
+
+	// reloading
+	writeScript(t, path, `def accept_event(event, conn): return "blocked: closed for maintenance"`)
+	if err := engine.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if ok, _ := engine.AcceptEvent(ctx, note(sk, 1000, "hello")); ok {
+		t.Error("reloaded policy not applied")
+	}
+	if !engine.AcceptReq(ctx, "sub", nostr.Filters{{Kinds: []int{4}}}, "") {
+		t.Error("missing accept_req should accept everything")
+	}
+
+	writeScript(t, path, `def accept_event(event, conn) syntax error`)
+	if err := engine.Reload(); err == nil {
+		t.Error("Reload of a broken script should fail")
+	}
+	if ok, _ := engine.AcceptEvent(ctx, note(sk, 1000, "hello")); ok {
+		t.Error("previous policy should still be applied after a failed reload")
+	}
+}
+
+func TestEngineLimits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.star")
+	writeScript(t, path, `
+def accept_event(event, conn):
+    for i in range(1000000000):
+        pass
+    return True
+`)
+
+	engine, err := New(path, nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer engine.Close()
+
+	if ok, msg := engine.AcceptEvent(context.Background(), note(nostr.GeneratePrivateKey(), 1000, "x")); ok || msg != "error: policy failed" {
+		t.Errorf("runaway script: got %v %q; want failure", ok, msg)
+	}
+	engine.FailOpen = true
+	if ok, _ := engine.AcceptEvent(context.Background(), note(nostr.GeneratePrivateKey(), 1000, "x")); !ok {
+		t.Error("runaway script with FailOpen should accept")
+	}
+}
+
+// deadlineStore records whether queries come with a deadline.
+type deadlineStore struct {
+	slicestore.SliceStore
+	hadDeadline bool
+}
+
+func (s *deadlineStore) QueryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	_, s.hadDeadline = ctx.Deadline()
+	return s.SliceStore.QueryEvents(ctx, filter)
+}
+
+func TestEngineQueryDeadline(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.star")
+	writeScript(t, path, linkPolicy)
+	store := &deadlineStore{}
+	store.Init()
+
+	engine, err := New(path, relay{store})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer engine.Close()
+
+	engine.AcceptEvent(context.Background(), note(nostr.GeneratePrivateKey(), 1000, "https://example.com"))
+	if !store.hadDeadline {
+		t.Error("query from the script didn't get the script deadline")
+	}
+}
+
+// blockingStore sends nothing on queries until released, ignoring their context.
+type blockingStore struct {
+	slicestore.SliceStore
+	release chan struct{}
+}
+
+func (s *blockingStore) QueryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	ch := make(chan *nostr.Event)
+	go func() {
+		<-s.release
+		close(ch)
+	}()
+	return ch, nil
+}
+
+func TestEngineQueryBlocking(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.star")
+	writeScript(t, path, linkPolicy)
+	store := &blockingStore{release: make(chan struct{})}
+	defer close(store.release)
+
+	engine, err := New(path, relay{store})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer engine.Close()
+
+	done := make(chan struct{})
+	go func() {
+		engine.AcceptEvent(context.Background(), note(nostr.GeneratePrivateKey(), 1000, "https://example.com"))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("script query ran past the deadline of the call")
+	}
+}
@@ -0,0 +1,327 @@
+package relayer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rs/cors"
+)
+
+// how often certificate files given to StartTLS are checked for changes.
+const certCheckInterval = 30 * time.Second
+
+// frontend is the HTTP serving machinery shared by [Server] and [Mux].
+// A single frontend can serve on any number of listeners at the same time,
+// and shutting it down closes all of them. Once shut down it serves no more.
+type frontend struct {
+	// Addr is the address of the first listener the frontend started serving on.
+	Addr string
+
+	handler    http.Handler
+	mu         sync.Mutex
+	httpServer *http.Server
+	done       chan struct{}
+	closed     bool // set by shutdown, even if there was nothing to shut down yet
+}
+
+func newHTTPServer(handler http.Handler, addr string) *http.Server {
+	return &http.Server{
+		Handler:      cors.Default().Handler(handler),
+		Addr:         addr,
+		WriteTimeout: 2 * time.Second,
+		ReadTimeout:  2 * time.Second,
+		IdleTimeout:  30 * time.Second,
+	}
+}
+
+// server returns the http.Server of the frontend, creating it for addr if it is the
+// first one, or http.ErrServerClosed after shutdown.
+func (f *frontend) server(addr string) (*http.Server, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return nil, http.ErrServerClosed
+	}
+	if f.httpServer == nil {
+		f.httpServer = newHTTPServer(f.handler, addr)
+		f.done = make(chan struct{})
+	}
+	if f.Addr == "" {
+		f.Addr = addr
+	}
+	return f.httpServer, nil
+}
+
+// Serve accepts connections on ln until Shutdown is called.
+// It can be called several times with different listeners, concurrently.
+// Called after Shutdown, it closes ln and returns http.ErrServerClosed.
+func (f *frontend) Serve(ln net.Listener, started ...chan bool) error {
+	return f.serveAll([]net.Listener{ln}, started...)
+}
+
+// Start listens on the given TCP host and port and serves on it until Shutdown is called.
+func (f *frontend) Start(host string, port int, started ...chan bool) error {
+	ln, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	return f.Serve(ln, started...)
+}
+
+// StartUnix listens on a unix domain socket at path and serves on it until Shutdown
+// is called. A stale socket file left at path by a previous process is removed first,
+// but a socket something is still listening on is left alone and an error returned.
+func (f *frontend) StartUnix(path string, started ...chan bool) error {
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return fmt.Errorf("%s is in use", path)
+		}
+		os.Remove(path)
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	return f.Serve(ln, started...)
+}
+
+// StartTLS is like Start but serves HTTPS and secure websockets using the given
+// certificate and key files. The files are reloaded from disk whenever they change
+// and whenever the process gets a SIGHUP, so renewed certificates are picked up
+// without a restart.
+func (f *frontend) StartTLS(host string, port int, certFile, keyFile string, started ...chan bool) error {
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	ln, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.server(ln.Addr().String()); err != nil {
+		ln.Close()
+		return err
+	}
+	go reloader.watch(f.done, certCheckInterval)
+
+	ln = tls.NewListener(ln, &tls.Config{
+		GetCertificate: reloader.getCertificate,
+		NextProtos:     []string{"http/1.1"},
+	})
+	return f.Serve(ln, started...)
+}
+
+// StartSystemd serves on all the sockets passed by systemd socket activation.
+// See [SystemdListeners].
+func (f *frontend) StartSystemd(started ...chan bool) error {
+	lns, err := SystemdListeners()
+	if err != nil {
+		return err
+	}
+	if len(lns) == 0 {
+		return errors.New("no sockets passed by systemd")
+	}
+	return f.serveAll(lns, started...)
+}
+
+// serveAll serves on all of lns, only closing started once the server they are
+// served by exists, so Addr is set and Shutdown stops them.
+func (f *frontend) serveAll(lns []net.Listener, started ...chan bool) error {
+	srv, err := f.server(lns[0].Addr().String())
+	if err != nil {
+		for _, ln := range lns {
+			ln.Close()
+		}
+		return err
+	}
+
+	errs := make(chan error, len(lns))
+	for _, ln := range lns {
+		go func() {
+			if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+				errs <- err
+			} else {
+				errs <- nil
+			}
+		}()
+	}
+
+	// notify caller that we're starting
+	for _, started := range started {
+		close(started)
+	}
+
+	var result error
+	for range lns {
+		result = errors.Join(result, <-errs)
+	}
+	return result
+}
+
+// shutdown stops the HTTP server and closes all listeners, and keeps any from being
+// served later.
+func (f *frontend) shutdown(ctx context.Context) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.closed = true
+	if f.httpServer == nil {
+		return
+	}
+	select {
+	case <-f.done:
+	default:
+		close(f.done)
+	}
+	f.httpServer.Shutdown(ctx)
+}
+
+// the first file descriptor passed by systemd, see sd_listen_fds(3).
+const systemdListenFdsStart = 3
+
+// SystemdListeners returns the sockets passed to this process by systemd socket
+// activation, as described by the LISTEN_PID and LISTEN_FDS environment variables,
+// in the order they are listed in the socket unit. The variables are then unset
+// so they are not inherited by child processes.
+//
+// It returns no listeners and no error if the process was not socket activated.
+func SystemdListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	lns := make([]net.Listener, 0, nfds)
+	for i := 0; i < nfds; i++ {
+		name := "LISTEN_FD_" + strconv.Itoa(systemdListenFdsStart+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		file := os.NewFile(uintptr(systemdListenFdsStart+i), name)
+		ln, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return nil, fmt.Errorf("systemd socket %s: %w", name, err)
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
+
+// certReloader keeps a TLS certificate loaded from disk up to date.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
+
+func (cr *certReloader) reload() error {
+	modTime, err := cr.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %w", err)
+	}
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.cert = &cert
+	cr.modTime = modTime
+	return nil
+}
+
+func (cr *certReloader) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{cr.certFile, cr.keyFile} {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (cr *certReloader) changed() bool {
+	modTime, err := cr.lastModified()
+	if err != nil {
+		return false
+	}
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return !modTime.Equal(cr.modTime)
+}
+
+// watch reloads the certificate on SIGHUP or when its files change, until done is closed.
+// Failed reloads keep the previous certificate.
+func (cr *certReloader) watch(done chan struct{}, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hup:
+			cr.reload()
+		case <-ticker.C:
+			if cr.changed() {
+				cr.reload()
+			}
+		case <-done:
+			return
+		}
+	}
+}
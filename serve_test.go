@@ -0,0 +1,207 @@
+package relayer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/eventstore/slicestore"
+	"go.uber.org/goleak"
+)
+
+func TestServeMultipleListeners(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	srv, _ := NewServer(&testRelay{name: "multi", storage: &slicestore.SliceStore{}})
+
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock := filepath.Join(t.TempDir(), "relay.sock")
+	unixReady := make(chan bool)
+	done := make(chan error, 2)
+	go func() { done <- srv.Serve(tcpLn) }()
+	go func() { done <- srv.StartUnix(sock, unixReady) }()
+	<-unixReady
+	if err := srv.StartUnix(sock); err == nil {
+		t.Error("took over a socket in use")
+	}
+
+	if resp, err := http.Get("http://" + tcpLn.Addr().String()); err != nil {
+		t.Errorf("GET over tcp: %v", err)
+	} else {
+		resp.Body.Close()
+	}
+
+	unixClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+		},
+	}}
+	if resp, err := unixClient.Get("http://relay/"); err != nil {
+		t.Errorf("GET over unix socket: %v", err)
+	} else {
+		resp.Body.Close()
+	}
+	unixClient.CloseIdleConnections()
+
+	srv.Shutdown(context.TODO())
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("serve: %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("serve didn't return after shutdown")
+		}
+	}
+	if _, err := os.Stat(sock); !os.IsNotExist(err) {
+		t.Errorf("unix socket file still exists after shutdown: %v", err)
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCert(t, certFile, keyFile, "first")
+
+	cr, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("newCertReloader: %v", err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go cr.watch(done, 10*time.Millisecond)
+
+	// make sure the modification time changes even on coarse filesystems
+	time.Sleep(20 * time.Millisecond)
+	writeTestCert(t, certFile, keyFile, "second")
+	later := time.Now().Add(time.Second)
+	os.Chtimes(certFile, later, later)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		cert, _ := cr.getCertificate(nil)
+		if leaf, _ := x509.ParseCertificate(cert.Certificate[0]); leaf.Subject.CommonName == "second" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("certificate was not reloaded after the files changed")
+}
+
+func TestStartTLS(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCert(t, certFile, keyFile, "127.0.0.1")
+
+	srv, _ := NewServer(&testRelay{name: "tls", storage: &slicestore.SliceStore{}})
+	started := make(chan bool)
+	go srv.StartTLS("127.0.0.1", 0, certFile, keyFile, started)
+	<-started
+	defer srv.Shutdown(context.TODO())
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	defer client.CloseIdleConnections()
+	resp, err := client.Get("https://" + srv.Addr)
+	if err != nil {
+		t.Fatalf("GET over tls: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestSystemdListenersNotActivated(t *testing.T) {
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "1")
+	if lns, err := SystemdListeners(); err != nil || lns != nil {
+		t.Errorf("SystemdListeners() = %v, %v; want nothing for another pid", lns, err)
+	}
+}
+
+func writeTestCert(t *testing.T, certFile, keyFile, commonName string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600)
+}
+
+func TestServeAfterShutdown(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	srv, _ := NewServer(&testRelay{storage: &slicestore.SliceStore{}})
+	srv.Shutdown(context.Background())
+
+	done := make(chan error, 1)
+	go func() { done <- srv.Start("127.0.0.1", 0) }()
+	select {
+	case err := <-done:
+		if err != http.ErrServerClosed {
+			t.Errorf("start after shutdown: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("serving after shutdown")
+	}
+}
+
+func TestServeAllStarted(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	srv, _ := NewServer(&testRelay{storage: &slicestore.SliceStore{}})
+
+	var lns []net.Listener
+	for range 2 {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		lns = append(lns, ln)
+	}
+	started := make(chan bool)
+	done := make(chan error, 1)
+	go func() { done <- srv.serveAll(lns, started) }()
+
+	// shutting down right after start, before serving began, must still stop it
+	<-started
+	if srv.Addr != lns[0].Addr().String() {
+		t.Errorf("address %q once started, want %q", srv.Addr, lns[0].Addr())
+	}
+	srv.Shutdown(context.Background())
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("serve: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("serve didn't return after shutdown")
+	}
+}
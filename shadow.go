@@ -0,0 +1,187 @@
+package relayer
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// EventPolicy decides whether an event is accepted, with the same semantics as
+// [Relay.AcceptEvent]. [WritePolicyPlugin.AcceptEvent] and Relay.AcceptEvent itself
+// are EventPolicies.
+type EventPolicy func(ctx context.Context, evt *nostr.Event) (bool, string)
+
+// how many would-be-rejected events are kept as samples for each policy.
+const shadowSamples = 20
+
+// ShadowPolicies runs policies in shadow (dry-run) mode: they are evaluated and
+// their decisions are logged and counted, but every event is accepted anyway.
+// This makes it safe to roll out new rules and look at what they would do first.
+//
+// Every [Server] has one, see [Server.Shadow], [WithShadowAdmission] and
+// [WithShadowReportPath].
+type ShadowPolicies struct {
+	log Logger
+
+	mu       sync.Mutex
+	policies map[string]*shadowStats
+}
+
+type shadowStats struct {
+	evaluated   int64
+	wouldReject int64
+	reasons     map[string]int64
+	samples     []ShadowSample
+}
+
+// ShadowReport is what a policy running in shadow mode would have done so far.
+type ShadowReport struct {
+	Evaluated       int64            `json:"evaluated"`
+	WouldReject     int64            `json:"would_reject"`
+	WouldRejectRate float64          `json:"would_reject_rate"`
+	Reasons         map[string]int64 `json:"reasons"`
+	// Samples holds the most recent events that would have been rejected, newest first.
+	Samples []ShadowSample `json:"samples"`
+}
+
+// ShadowSample is an event a policy in shadow mode would have rejected.
+type ShadowSample struct {
+	Time   time.Time    `json:"time"`
+	Reason string       `json:"reason"`
+	Event  *nostr.Event `json:"event"`
+}
+
+// NewShadowPolicies returns an empty ShadowPolicies logging would-be rejections to log,
+// which may be nil.
+func NewShadowPolicies(log Logger) *ShadowPolicies {
+	return &ShadowPolicies{
+		log:      log,
+		policies: make(map[string]*shadowStats),
+	}
+}
+
+// Wrap returns a policy that evaluates policy, records its decision under name and
+// then accepts the event regardless. Calls to [ShadowReject] made by policy are
+// recorded as rejections with the "shadowReject" reason instead of taking effect.
+func (sp *ShadowPolicies) Wrap(name string, policy EventPolicy) EventPolicy {
+	sp.mu.Lock()
+	if _, ok := sp.policies[name]; !ok {
+		sp.policies[name] = &shadowStats{reasons: make(map[string]int64)}
+	}
+	sp.mu.Unlock()
+
+	return func(ctx context.Context, evt *nostr.Event) (bool, string) {
+		adm := &admission{}
+		ok, reason := policy(context.WithValue(ctx, admissionContextKey{}, adm), evt)
+		if ok && adm.shadowRejected {
+			ok, reason = false, "shadowReject"
+		}
+		if !ok && reason == "" {
+			reason = "blocked: event blocked by relay"
+		}
+		sp.record(name, evt, ok, reason)
+		return true, ""
+	}
+}
+
+func (sp *ShadowPolicies) record(name string, evt *nostr.Event, ok bool, reason string) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	stats := sp.policies[name]
+	stats.evaluated++
+	if ok {
+		return
+	}
+
+	stats.wouldReject++
+	stats.reasons[reason]++
+	if len(stats.samples) == shadowSamples {
+		copy(stats.samples, stats.samples[1:])
+		stats.samples = stats.samples[:shadowSamples-1]
+	}
+	stats.samples = append(stats.samples, ShadowSample{Time: time.Now(), Reason: reason, Event: evt})
+
+	if sp.log != nil {
+		sp.log.Infof("shadow policy %s would reject %s: %s", name, evt.ID, reason)
+	}
+}
+
+// Report returns the current statistics of every policy wrapped so far, by name.
+func (sp *ShadowPolicies) Report() map[string]ShadowReport {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	report := make(map[string]ShadowReport, len(sp.policies))
+	for name, stats := range sp.policies {
+		r := ShadowReport{
+			Evaluated:   stats.evaluated,
+			WouldReject: stats.wouldReject,
+			Reasons:     make(map[string]int64, len(stats.reasons)),
+			Samples:     make([]ShadowSample, len(stats.samples)),
+		}
+		if stats.evaluated > 0 {
+			r.WouldRejectRate = float64(stats.wouldReject) / float64(stats.evaluated)
+		}
+		for reason, n := range stats.reasons {
+			r.Reasons[reason] = n
+		}
+		copy(r.Samples, stats.samples)
+		sort.Slice(r.Samples, func(i, j int) bool { return r.Samples[i].Time.After(r.Samples[j].Time) })
+		report[name] = r
+	}
+	return report
+}
+
+// ServeHTTP responds with the JSON encoded [ShadowPolicies.Report], or only the report
+// of the policy given in the "policy" query parameter.
+func (sp *ShadowPolicies) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	report := sp.Report()
+	if name := r.URL.Query().Get("policy"); name != "" {
+		single, ok := report[name]
+		if !ok {
+			http.Error(w, "unknown policy", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(single)
+		return
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// Shadow returns the ShadowPolicies of this server, which holds the decisions of the
+// relay admission path when [WithShadowAdmission] is used and can wrap any other policy.
+func (s *Server) Shadow() *ShadowPolicies {
+	return s.shadow
+}
+
+// WithShadowPolicies makes the server use sp instead of creating its own, so policies
+// wrapped by the relay before the server exists show up in its report.
+func WithShadowPolicies(sp *ShadowPolicies) Option {
+	return func(o *Options) {
+		o.shadowPolicies = sp
+	}
+}
+
+// WithShadowAdmission runs [Relay.AcceptEvent] in shadow mode under the name "relay":
+// its decisions are recorded but all events are accepted.
+func WithShadowAdmission() Option {
+	return func(o *Options) {
+		o.shadowAdmission = true
+	}
+}
+
+// WithShadowReportPath serves the shadow policies report at path on [Server.Router],
+// to the admins given to [WithAdmin] only, authenticated like the admin API.
+func WithShadowReportPath(path string) Option {
+	return func(o *Options) {
+		o.shadowReportPath = path
+	}
+}
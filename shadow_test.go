@@ -0,0 +1,95 @@
+package relayer
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestShadowAdmission(t *testing.T) {
+	store := &slicestore.SliceStore{}
+	rl := &testRelay{
+		storage: store,
+		acceptEvent: func(_ context.Context, evt *nostr.Event) (bool, string) {
+			if strings.Contains(evt.Content, "spam") {
+				return false, "blocked: no spam"
+			}
+			return true, ""
+		},
+	}
+	admin := nostr.GeneratePrivateKey()
+	adminPubkey, _ := nostr.GetPublicKey(admin)
+	srv, err := NewServer(rl, WithShadowAdmission(), WithShadowReportPath("/shadow"), WithAdmin("/admin", adminPubkey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Shutdown(context.Background())
+
+	ctx := context.Background()
+	spam := signedNote("buy spam")
+	if ok, msg := srv.AddEvent(ctx, signedNote("hello")); !ok {
+		t.Errorf("note rejected in shadow mode: %s", msg)
+	}
+	// the package-level AddEvent goes through the same admission
+	if ok, msg := AddEvent(ContextWithServer(ctx, srv), rl, spam); !ok {
+		t.Errorf("spam rejected in shadow mode: %s", msg)
+	}
+	if n, _ := store.CountEvents(ctx, nostr.Filter{}); n != 2 {
+		t.Errorf("stored %d events; want 2", n)
+	}
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/shadow?policy=relay", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("unsigned report request: got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, adminRequest(admin, "GET", "/shadow?policy=relay", ""))
+	var report ShadowReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("report: %v: %s", err, w.Body)
+	}
+	if report.Evaluated != 2 || report.WouldReject != 1 || report.WouldRejectRate != 0.5 {
+		t.Errorf("report: %+v", report)
+	}
+	if report.Reasons["blocked: no spam"] != 1 {
+		t.Errorf("reasons: %v", report.Reasons)
+	}
+	if len(report.Samples) != 1 || report.Samples[0].Event.ID != spam.ID {
+		t.Errorf("samples: %+v", report.Samples)
+	}
+}
+
+func TestShadowPoliciesWrap(t *testing.T) {
+	sp := NewShadowPolicies(nil)
+	policy := sp.Wrap("quiet", func(ctx context.Context, evt *nostr.Event) (bool, string) {
+		ShadowReject(ctx)
+		return true, ""
+	})
+
+	// the shadow rejection must not leak into the real admission
+	adm := &admission{}
+	ctx := context.WithValue(context.Background(), admissionContextKey{}, adm)
+	for i := 0; i < shadowSamples+5; i++ {
+		if ok, _ := policy(ctx, signedNote("hi")); !ok {
+			t.Fatal("shadowed policy rejected an event")
+		}
+	}
+	if adm.shadowRejected {
+		t.Error("shadowed ShadowReject took effect")
+	}
+
+	report := sp.Report()["quiet"]
+	if report.WouldReject != shadowSamples+5 || report.Reasons["shadowReject"] != shadowSamples+5 {
+		t.Errorf("report: %+v", report)
+	}
+	if len(report.Samples) != shadowSamples {
+		t.Errorf("kept %d samples; want %d", len(report.Samples), shadowSamples)
+	}
+}
@@ -4,16 +4,14 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"net"
 	"net/http"
 	"os"
-	"strconv"
 	"sync"
 	"time"
 
 	"github.com/fasthttp/websocket"
+	"github.com/fiatjaf/relayer/v2/internal/storeutil"
 	"github.com/nbd-wtf/go-nostr"
-	"github.com/rs/cors"
 	"golang.org/x/time/rate"
 )
 
@@ -25,7 +23,10 @@ import (
 // See their respective doc comments.
 //
 // The basic usage is to call Start or StartConf, which starts serving immediately.
-// For a more fine-grained control, use NewServer.
+// Serve, StartUnix, StartTLS and StartSystemd serve on other kinds of listeners, and a
+// single Server can serve on several of them at once.
+// For a more fine-grained control, use NewServer. To serve several relays from the same
+// listener, see [Mux].
 // See [basic/main.go], [whitelisted/main.go], [expensive/main.go] and [rss-bridge/main.go]
 // for example implementations.
 //
@@ -40,14 +41,60 @@ type Server struct {
 
 	relay Relay
 
+	limiters *rateLimiters
+
+	// see WithTrustedProxies
+	trustedProxies proxyList
+
+	// signature checks and the ids of recently accepted events
+	verifier *verifier
+	verified *idCache
+
+	// see WithWriteBatching and WithReadCache
+	batcher   *writeBatcher
+	readCache *readCache
+
+	// shadow mode policies and the policy used for admission, which is either
+	// Relay.AcceptEvent or its shadowed version
+	shadow      *ShadowPolicies
+	acceptEvent EventPolicy
+
 	// keep a connection reference to all connected clients for Server.Shutdown
-	clientsMu sync.Mutex
-	clients   map[*websocket.Conn]struct{}
+	clientsMu     sync.Mutex
+	clients       map[*websocket.Conn]*WebSocket
+	connections   int
+	ipConnections map[string]int
+
+	// live subscriptions, with the distinct filters they use and the changes to those
+	// not yet delivered to WatchFilters watchers; watchersMu is always taken after
+	// listenersMu
+	listenersMu      sync.Mutex
+	listeners        map[subscriber]map[string]*Listener
+	pendingListeners map[*WebSocket]map[string]int
+	filterIndex      *filterIndex
+	filterChanges    []FilterChange
+	watchersMu       sync.Mutex
+	watchers         map[*filterWatcher]struct{}
+
+	// see Server.Ban and WithAbuseDetection
+	bans  *banList
+	abuse *abuseTracker
+
+	// see WithRetention
+	retention retention
+
+	// NIP-98 events already used with the admin API
+	nip98 nip98Replays
 
-	// in case you call Server.Start
-	Addr       string
-	serveMux   *http.ServeMux
-	httpServer *http.Server
+	// in-flight message handlers, waited for by Server.Shutdown
+	inflightMu sync.RWMutex
+	inflight   sync.WaitGroup
+	closing    bool
+
+	serveMux *http.ServeMux
+
+	// Start, StartTLS, StartUnix, StartSystemd and Serve; see also Addr
+	frontend
 }
 
 func (s *Server) Router() *http.ServeMux {
@@ -63,11 +110,47 @@ func NewServer(relay Relay, opts ...Option) (*Server, error) {
 	}
 
 	srv := &Server{
-		Log:      defaultLogger(relay.Name() + ": "),
-		relay:    relay,
-		clients:  make(map[*websocket.Conn]struct{}),
-		serveMux: &http.ServeMux{},
-		options:  options,
+		Log:              defaultLogger(relay.Name() + ": "),
+		relay:            relay,
+		clients:          make(map[*websocket.Conn]*WebSocket),
+		ipConnections:    make(map[string]int),
+		bans:             newBanList(),
+		abuse:            newAbuseTracker(options.abuse),
+		listeners:        make(map[subscriber]map[string]*Listener),
+		pendingListeners: make(map[*WebSocket]map[string]int),
+		filterIndex:      newFilterIndex(),
+		watchers:         make(map[*filterWatcher]struct{}),
+		serveMux:         &http.ServeMux{},
+		options:          options,
+		limiters:         newRateLimiters(options),
+		verifier:         newVerifier(options.verifyWorkers),
+		verified:         newIDCache(options.verifiedCacheSize),
+		batcher:          newWriteBatcher(options.batchSize, options.batchDelay),
+		readCache:        newReadCache(options.readCacheBytes),
+	}
+	srv.frontend.handler = srv
+
+	srv.shadow = options.shadowPolicies
+	if srv.shadow == nil {
+		srv.shadow = NewShadowPolicies(srv.Log)
+	}
+	srv.acceptEvent = relay.AcceptEvent
+	if options.shadowAdmission {
+		srv.acceptEvent = srv.shadow.Wrap("relay", relay.AcceptEvent)
+	}
+	if options.shadowReportPath != "" {
+		srv.serveMux.Handle(options.shadowReportPath, srv.adminOnly(srv.shadow.ServeHTTP))
+	}
+	if options.adminPath != "" {
+		srv.registerAdmin()
+	}
+	trustedProxies, err := parseProxyList(options.trustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("trusted proxies: %w", err)
+	}
+	srv.trustedProxies = trustedProxies
+	if err := srv.loadBans(); err != nil {
+		return nil, fmt.Errorf("bans: %w", err)
 	}
 
 	if storage := relay.Storage(context.Background()); storage != nil {
@@ -81,18 +164,53 @@ func NewServer(relay Relay, opts ...Option) (*Server, error) {
 		return nil, fmt.Errorf("relay init: %w", err)
 	}
 
+	srv.startRetention()
+
 	// start listening from events from other sources, if any
 	if inj, ok := relay.(Injector); ok {
 		go func() {
 			for event := range inj.InjectEvents() {
-				notifyListeners(&event)
+				srv.notifyListeners(&event)
 			}
 		}()
 	}
 
+	serversMu.Lock()
+	servers[srv] = struct{}{}
+	serversMu.Unlock()
+
 	return srv, nil
 }
 
+// servers created by NewServer and not shut down yet, used only by the package-level
+// [AddEvent] and the deprecated [BroadcastEvent] and [GetListeningFilters].
+var (
+	serversMu sync.Mutex
+	servers   = make(map[*Server]struct{})
+)
+
+func runningServers() []*Server {
+	serversMu.Lock()
+	defer serversMu.Unlock()
+
+	list := make([]*Server, 0, len(servers))
+	for s := range servers {
+		list = append(list, s)
+	}
+	return list
+}
+
+// relayServers returns the running servers of relay.
+func relayServers(relay Relay) []*Server {
+	var list []*Server
+	for _, s := range runningServers() {
+		if storeutil.SameValue(s.relay, relay) {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
 // ServeHTTP implements http.Handler interface.
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Header.Get("Upgrade") == "websocket" {
@@ -104,55 +222,97 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (s *Server) Start(host string, port int, started ...chan bool) error {
-	addr := net.JoinHostPort(host, strconv.Itoa(port))
-	ln, err := net.Listen("tcp", addr)
-	if err != nil {
-		return err
-	}
+// Shutdown stops the server gracefully:
+//
+//  1. the HTTP server stops accepting new connections and new messages from
+//     connected clients are ignored;
+//  2. every open subscription gets a CLOSED message with a "shutting-down:" reason
+//     and every client gets a websocket close frame with code 1001 (going away);
+//  3. Shutdown waits for in-flight messages (event saves, queries and so on) to
+//     be handled, for as long as ctx allows, and then closes all connections
+//     and in-process subscriptions;
+//  4. scheduled retention passes are stopped, see [WithRetention];
+//  5. if the relay is ShutdownAware, its OnShutdown is called with ctx as is,
+//     and finally the relay storage is closed.
+//
+// Note that the steps above may take some time and so the context deadline,
+// if any, may have been shortened by the time OnShutdown is called.
+func (s *Server) Shutdown(ctx context.Context) {
+	s.inflightMu.Lock()
+	s.closing = true
+	s.inflightMu.Unlock()
 
-	s.Addr = ln.Addr().String()
-	s.httpServer = &http.Server{
-		Handler:      cors.Default().Handler(s),
-		Addr:         addr,
-		WriteTimeout: 2 * time.Second,
-		ReadTimeout:  2 * time.Second,
-		IdleTimeout:  30 * time.Second,
-	}
+	serversMu.Lock()
+	delete(servers, s)
+	serversMu.Unlock()
 
-	// notify caller that we're starting
-	for _, started := range started {
-		close(started)
+	s.frontend.shutdown(ctx)
+
+	s.clientsMu.Lock()
+	clients := make(map[*websocket.Conn]*WebSocket, len(s.clients))
+	for conn, ws := range s.clients {
+		clients[conn] = ws
 	}
+	s.clientsMu.Unlock()
 
-	if err := s.httpServer.Serve(ln); err == http.ErrServerClosed {
-		return nil
-	} else if err != nil {
-		return err
-	} else {
-		return nil
+	closeMessage := websocket.FormatCloseMessage(websocket.CloseGoingAway, "relay is shutting down")
+	for conn, ws := range clients {
+		for _, id := range s.listenerIds(ws) {
+			ws.WriteJSON(nostr.ClosedEnvelope{SubscriptionID: id, Reason: "shutting-down: relay is shutting down"})
+		}
+		conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
 	}
-}
 
-// Shutdown sends a websocket close control message to all connected clients.
-//
-// If the relay is ShutdownAware, Shutdown calls its OnShutdown, passing the context as is.
-// Note that the HTTP server make some time to shutdown and so the context deadline,
-// if any, may have been shortened by the time OnShutdown is called.
-func (s *Server) Shutdown(ctx context.Context) {
-	s.httpServer.Shutdown(ctx)
+	drained := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		s.Log.Warningf("shutdown: gave up waiting for in-flight messages: %v", ctx.Err())
+	}
 
 	s.clientsMu.Lock()
-	defer s.clientsMu.Unlock()
-	for conn := range s.clients {
-		conn.WriteControl(websocket.CloseMessage, nil, time.Now().Add(time.Second))
+	closed := make([]*WebSocket, 0, len(s.clients))
+	for conn, ws := range s.clients {
 		conn.Close()
 		delete(s.clients, conn)
+		closed = append(closed, ws)
+	}
+	s.connections = 0
+	clear(s.ipConnections)
+	s.clientsMu.Unlock()
+
+	for _, ws := range closed {
+		s.removeListener(ws)
 	}
+	s.closeLocalSubscriptions()
+	s.closeFilterWatchers()
+	s.stopRetention()
+	s.verifier.close()
 
 	if f, ok := s.relay.(ShutdownAware); ok {
 		f.OnShutdown(ctx)
 	}
+
+	if storage := s.relay.Storage(ctx); storage != nil {
+		storage.Close()
+	}
+}
+
+// trackInflight registers a message about to be handled, so Shutdown can wait
+// for it. It returns false if the server is shutting down and the message
+// should be dropped instead; otherwise the caller must call s.inflight.Done().
+func (s *Server) trackInflight() bool {
+	s.inflightMu.RLock()
+	defer s.inflightMu.RUnlock()
+	if s.closing {
+		return false
+	}
+	s.inflight.Add(1)
+	return true
 }
 
 type Option func(*Options)
@@ -160,10 +320,57 @@ type Option func(*Options)
 type Options struct {
 	perConnectionLimiter *rate.Limiter
 	skipEventFunc        func(*nostr.Event) bool
+
+	ipRateLimits         map[string]rateLimit
+	pubkeyRateLimits     map[string]rateLimit
+	kindCosts            map[int]int
+	rateLimitMode        RateLimitMode
+	rateLimitIdleTimeout time.Duration
+	trustedProxies       []string
+
+	maxConnections      int
+	maxConnectionsPerIP int
+	maxSubscriptions    int
+	maxFilters          int
+	maxLimit            int
+	maxFilterIDs        int
+	maxFilterAuthors    int
+	maxFilterTagValues  int
+
+	queryTimeout       time.Duration
+	queryTimeoutMode   QueryTimeoutMode
+	slowQueryThreshold time.Duration
+
+	queryBudget   *QueryBudget
+	costEstimator CostEstimator
+
+	eventLimits EventLimits
+	kindRules   map[int][]KindRule
+
+	verifyWorkers     int
+	verifiedCacheSize int
+
+	batchSize  int
+	batchDelay time.Duration
+
+	readCacheBytes int
+
+	shadowPolicies   *ShadowPolicies
+	shadowAdmission  bool
+	shadowReportPath string
+
+	adminPath    string
+	adminPubkeys []string
+
+	banStore BanStore
+	abuse    *AbuseConfig
+
+	retentionInterval time.Duration
+	retentionRules    []RetentionRule
 }
 
 func DefaultOptions() *Options {
-	return &Options{}
+	return &Options{maxLimit: defaultMaxLimit}
 }
 
 func WithPerConnectionLimiter(rps rate.Limit, burst int) Option {
@@ -2,14 +2,16 @@ package relayer
 
 import (
 	"context"
-	"errors"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/coder/websocket"
 	"github.com/fiatjaf/eventstore/slicestore"
-	"github.com/gobwas/ws/wsutil"
 	"github.com/nbd-wtf/go-nostr"
 	"go.uber.org/goleak"
 )
@@ -109,11 +111,51 @@ func TestServerShutdownWebsocket(t *testing.T) {
 
 	// wait for the client to receive a "connection close"
 	time.Sleep(1 * time.Second)
-	err = client.ConnectionError
-	if e := errors.Unwrap(err); e != nil {
-		err = e
+	if status := websocket.CloseStatus(client.ConnectionError); status != websocket.StatusGoingAway {
+		t.Errorf("client.ConnectionError: %v; want close status %v", client.ConnectionError, websocket.StatusGoingAway)
 	}
-	if _, ok := err.(wsutil.ClosedError); !ok {
-		t.Errorf("client.ConnectionError: %v (%T); want wsutil.ClosedError", err, err)
+}
+
+func TestServerShutdownDrainsInflight(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	saving := make(chan struct{})
+	var saved, closed atomic.Bool
+	srv := startTestRelay(t, &testRelay{storage: &testStorage{
+		saveEvent: func(context.Context, *nostr.Event) error {
+			close(saving)
+			time.Sleep(300 * time.Millisecond)
+			saved.Store(true)
+			return nil
+		},
+		close: func() { closed.Store(true) },
+	}})
+
+	conn := dialTestRelay(t, srv)
+	defer conn.Close()
+
+	conn.WriteJSON([]any{"REQ", "sub", nostr.Filter{}})
+	readLabel(t, conn, "EOSE")
+
+	ev := nostr.Event{Kind: nostr.KindTextNote, CreatedAt: nostr.Now(), Content: "test"}
+	ev.Sign(nostr.GeneratePrivateKey())
+	conn.WriteJSON([]any{"EVENT", ev})
+	<-saving
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	srv.Shutdown(ctx)
+
+	if !saved.Load() {
+		t.Error("shutdown didn't wait for the in-flight save")
+	}
+	if !closed.Load() {
+		t.Error("shutdown didn't close the storage")
+	}
+
+	msg := readLabel(t, conn, "CLOSED")
+	var reason string
+	json.Unmarshal(msg[2], &reason)
+	if !strings.HasPrefix(reason, "shutting-down:") {
+		t.Errorf("CLOSED reason %q; want shutting-down prefix", reason)
 	}
 }
@@ -0,0 +1,205 @@
+package relayer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// eose is sent on channels returned by Server.Subscribe with SubscribeReplay once all
+// stored events have been sent.
+var eose = &nostr.Event{}
+
+// IsEOSE tells if evt, received from a channel returned by [Server.Subscribe] with
+// [SubscribeReplay], marks the end of the stored events.
+func IsEOSE(evt *nostr.Event) bool {
+	return evt == eose
+}
+
+// how many events an in-process subscription can hold before sends start blocking.
+const defaultSubscribeBuffer = 100
+
+// SubscribeOption configures [Server.Subscribe].
+type SubscribeOption func(*subscribeOptions)
+
+type subscribeOptions struct {
+	replay bool
+	buffer int
+}
+
+// SubscribeReplay makes the subscription first get the stored events matching its
+// filters, as REQ does for websocket clients, followed by an event for which [IsEOSE] is true.
+func SubscribeReplay() SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.replay = true
+	}
+}
+
+// SubscribeBuffer sets the size of the channel returned by [Server.Subscribe].
+// Defaults to 100.
+func SubscribeBuffer(n int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.buffer = n
+	}
+}
+
+// Subscribe registers an in-process live subscription for filters next to the ones
+// of websocket clients, for bots and bridges running in the same binary as the relay.
+// Every event broadcast by this server that matches filters is sent on the returned
+// channel.
+//
+// Like websocket clients, a subscriber that doesn't take an event within 10 seconds is
+// dropped and its channel closed. The channel is also closed when ctx is done, when the
+// returned function is called and when the server shuts down.
+func (s *Server) Subscribe(ctx context.Context, filters nostr.Filters, opts ...SubscribeOption) (<-chan *nostr.Event, func()) {
+	options := subscribeOptions{buffer: defaultSubscribeBuffer}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	sub := &localSubscriber{
+		ch:   make(chan *nostr.Event, options.buffer),
+		done: make(chan struct{}),
+	}
+	cancel := func() {
+		sub.stop()
+		s.listenersMu.Lock()
+		s.unlistenAllLocked(sub)
+		s.unlockListeners()
+		sub.close()
+	}
+
+	if !s.trackInflight() {
+		// shutting down
+		sub.drop()
+		return sub.ch, func() {}
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			cancel()
+		case <-sub.done:
+		}
+	}()
+
+	go func() {
+		defer s.inflight.Done()
+
+		if options.replay {
+			send := func(event *nostr.Event) bool {
+				if err := sub.send("", event); err != nil {
+					sub.drop()
+					return false
+				}
+				return true
+			}
+			if store := s.relay.Storage(ctx); store != nil {
+				s.queryStored(ctx, store, filters, send)
+			}
+			if !send(eose) {
+				return
+			}
+		}
+
+		s.listenersMu.Lock()
+		defer s.unlockListeners()
+		s.inflightMu.RLock()
+		closing := s.closing
+		s.inflightMu.RUnlock()
+		if closing {
+			sub.drop()
+		} else if !sub.stopped() {
+			s.listenLocked(sub, "", filters)
+		}
+	}()
+
+	return sub.ch, cancel
+}
+
+// closeLocalSubscriptions drops every in-process subscription, for Server.Shutdown.
+func (s *Server) closeLocalSubscriptions() {
+	s.listenersMu.Lock()
+	defer s.unlockListeners()
+
+	for sub := range s.listeners {
+		if ls, ok := sub.(*localSubscriber); ok {
+			s.unlistenAllLocked(sub)
+			ls.drop()
+		}
+	}
+}
+
+var (
+	errSubscriptionClosed = errors.New("subscription closed")
+	errSlowSubscriber     = errors.New("in-process subscriber too slow")
+)
+
+// localSubscriber is a subscription created by Server.Subscribe.
+type localSubscriber struct {
+	ch       chan *nostr.Event
+	done     chan struct{}
+	stopOnce sync.Once
+
+	// guards sends on ch and closing it
+	mu     sync.Mutex
+	closed bool
+}
+
+func (ls *localSubscriber) send(_ string, evt *nostr.Event) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	if ls.closed || ls.stopped() {
+		return errSubscriptionClosed
+	}
+
+	select {
+	case ls.ch <- evt:
+		return nil
+	default:
+	}
+
+	timer := time.NewTimer(writeWait)
+	defer timer.Stop()
+	select {
+	case ls.ch <- evt:
+		return nil
+	case <-ls.done:
+		return errSubscriptionClosed
+	case <-timer.C:
+		return errSlowSubscriber
+	}
+}
+
+func (ls *localSubscriber) drop() {
+	ls.stop()
+	ls.close()
+}
+
+// stop makes pending and future sends fail.
+func (ls *localSubscriber) stop() {
+	ls.stopOnce.Do(func() { close(ls.done) })
+}
+
+func (ls *localSubscriber) stopped() bool {
+	select {
+	case <-ls.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (ls *localSubscriber) close() {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	if !ls.closed {
+		ls.closed = true
+		close(ls.ch)
+	}
+}
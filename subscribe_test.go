@@ -0,0 +1,128 @@
+package relayer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/fiatjaf/relayer/v2/internal/storeutil"
+	"github.com/nbd-wtf/go-nostr"
+	"go.uber.org/goleak"
+)
+
+func receive(t *testing.T, ch <-chan *nostr.Event) *nostr.Event {
+	t.Helper()
+	select {
+	case evt, ok := <-ch:
+		if !ok {
+			t.Fatal("subscription closed")
+		}
+		return evt
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for event")
+		return nil
+	}
+}
+
+func TestServerSubscribe(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	store := &slicestore.SliceStore{}
+	srv, err := NewServer(&testRelay{storage: store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Shutdown(context.Background())
+
+	ctx := context.Background()
+	stored := signedNote("stored")
+	srv.AddEvent(ctx, stored)
+
+	ch, cancel := srv.Subscribe(ctx, nostr.Filters{{Kinds: []int{nostr.KindTextNote}}}, SubscribeReplay())
+	if evt := receive(t, ch); evt.ID != stored.ID {
+		t.Errorf("replayed %s; want %s", evt.ID, stored.ID)
+	}
+	if evt := receive(t, ch); !IsEOSE(evt) {
+		t.Errorf("got %v after stored events; want EOSE", evt)
+	}
+
+	// live events only arrive after the subscription is registered
+	for len(srv.GetListeningFilters()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	live := signedNote("live")
+	AddEvent(ContextWithServer(ctx, srv), srv.relay, live)
+	srv.AddEvent(ctx, &nostr.Event{Kind: nostr.KindReaction, CreatedAt: nostr.Now()})
+	if evt := receive(t, ch); evt.ID != live.ID {
+		t.Errorf("got %s; want live event %s", evt.ID, live.ID)
+	}
+
+	cancel()
+	if _, ok := <-ch; ok {
+		t.Error("got an event after cancel")
+	}
+	if n := len(srv.GetListeningFilters()); n != 0 {
+		t.Errorf("%d filters left after cancel", n)
+	}
+}
+
+func TestAddEventWithoutServerContext(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ctx := context.Background()
+	relay := &testRelay{storage: &slicestore.SliceStore{}}
+	var subs []<-chan *nostr.Event
+	for range 2 {
+		srv, err := NewServer(relay)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer srv.Shutdown(ctx)
+		ch, cancel := srv.Subscribe(ctx, nostr.Filters{{Kinds: []int{nostr.KindTextNote}}})
+		defer cancel()
+		for len(srv.GetListeningFilters()) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		subs = append(subs, ch)
+	}
+
+	live := signedNote("live")
+	if ok, msg := AddEvent(ctx, relay, live); !ok {
+		t.Fatalf("rejected: %s", msg)
+	}
+	for i, ch := range subs {
+		if evt := receive(t, ch); evt.ID != live.ID {
+			t.Errorf("server %d sent %s; want %s", i, evt.ID, live.ID)
+		}
+	}
+	if events, _ := storeutil.Collect(ctx, relay.storage, nostr.Filter{}); len(events) != 1 {
+		t.Errorf("%d events stored, want 1", len(events))
+	}
+}
+
+func TestServerSubscribeClosedOnShutdown(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	srv, err := NewServer(&testRelay{storage: &slicestore.SliceStore{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, _ := srv.Subscribe(ctx, nostr.Filters{{}})
+	for len(srv.GetListeningFilters()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	srv.Shutdown(context.Background())
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Error("got an event on shutdown")
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("subscription not closed on shutdown")
+	}
+}
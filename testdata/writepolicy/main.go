@@ -0,0 +1,57 @@
+// Command writepolicy is a write policy plugin used by the tests of
+// relayer.WritePolicyPlugin. Its decision depends on the event content.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+type request struct {
+	Event struct {
+		ID      string `json:"id"`
+		Content string `json:"content"`
+	} `json:"event"`
+	SourceType string `json:"sourceType"`
+	SourceInfo string `json:"sourceInfo"`
+	Authed     string `json:"authed"`
+}
+
+type response struct {
+	ID     string `json:"id"`
+	Action string `json:"action"`
+	Msg    string `json:"msg,omitempty"`
+}
+
+func main() {
+	scanner := bufio.NewScanner(os.Stdin)
+	out := json.NewEncoder(os.Stdout)
+	for scanner.Scan() {
+		var req request
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			fmt.Fprintln(os.Stderr, "bad input:", err)
+			continue
+		}
+
+		resp := response{ID: req.Event.ID, Action: "accept"}
+		switch {
+		case req.Event.Content == "crash":
+			os.Exit(1)
+		case req.Event.Content == "slow":
+			time.Sleep(time.Second)
+		case req.Event.Content == "whoami":
+			resp.Action = "reject"
+			resp.Msg = fmt.Sprintf("blocked: %s %s %s", req.SourceType, req.SourceInfo, req.Authed)
+		case strings.Contains(req.Event.Content, "spam"):
+			resp.Action = "reject"
+			resp.Msg = "blocked: no spam"
+		case strings.Contains(req.Event.Content, "shadow"):
+			resp.Action = "shadowReject"
+		}
+		out.Encode(resp)
+	}
+}
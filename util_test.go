@@ -2,8 +2,11 @@ package relayer
 
 import (
 	"context"
+	"encoding/json"
 	"testing"
+	"time"
 
+	"github.com/fasthttp/websocket"
 	"github.com/fiatjaf/eventstore"
 	"github.com/nbd-wtf/go-nostr"
 )
@@ -22,7 +25,7 @@ type testRelay struct {
 	storage     eventstore.Store
 	init        func() error
 	onShutdown  func(context.Context)
-	acceptEvent func(*nostr.Event) (bool, string)
+	acceptEvent func(context.Context, *nostr.Event) (bool, string)
 }
 
 func (tr *testRelay) Name() string                             { return tr.name }
@@ -43,7 +46,7 @@ func (tr *testRelay) OnShutdown(ctx context.Context) {
 
 func (tr *testRelay) AcceptEvent(ctx context.Context, e *nostr.Event) (bool, string) {
 	if fn := tr.acceptEvent; fn != nil {
-		return fn(e)
+		return fn(ctx, e)
 	}
 	return true, ""
 }
@@ -105,3 +108,38 @@ func (st *testStorage) ReplaceEvent(ctx context.Context, e *nostr.Event) error {
 	}
 	return nil
 }
+
+// dialTestRelay opens a raw websocket connection to srv, for tests that need
+// to look at exact protocol messages.
+func dialTestRelay(t *testing.T, srv *Server) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+srv.Addr, nil)
+	if err != nil {
+		t.Fatalf("dial %s: %v", srv.Addr, err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	return conn
+}
+
+// readMessage reads the next nostr message from conn, decoding it as a JSON array.
+func readMessage(t *testing.T, conn *websocket.Conn) []json.RawMessage {
+	t.Helper()
+	var msg []json.RawMessage
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatalf("read message: %v", err)
+	}
+	return msg
+}
+
+// readLabel reads messages from conn until one with the given label shows up.
+func readLabel(t *testing.T, conn *websocket.Conn, label string) []json.RawMessage {
+	t.Helper()
+	for {
+		msg := readMessage(t, conn)
+		var typ string
+		json.Unmarshal(msg[0], &typ)
+		if typ == label {
+			return msg
+		}
+	}
+}
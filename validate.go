@@ -0,0 +1,108 @@
+package relayer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// EventLimits are the structural limits checked on every event going through
+// [Server.Publish]. Zero fields are not checked.
+type EventLimits struct {
+	// MaxPast and MaxFuture bound how far created_at can be from the current time.
+	MaxPast   time.Duration
+	MaxFuture time.Duration
+
+	// MaxContentLength is the maximum length of the content, in bytes.
+	MaxContentLength int
+	// MaxTags is the maximum number of tags.
+	MaxTags int
+	// MaxTagElementLength is the maximum length of each string in a tag, in bytes.
+	MaxTagElementLength int
+}
+
+// WithEventLimits rejects events exceeding limits with an "invalid:" reason. The limits
+// are also reported in the NIP-11 limitation object.
+func WithEventLimits(limits EventLimits) Option {
+	return func(o *Options) {
+		o.eventLimits = limits
+	}
+}
+
+// KindRule checks events of a given kind, returning an error describing what is wrong
+// with the event, if anything. See [WithKindRule].
+type KindRule func(evt *nostr.Event) error
+
+// WithKindRule adds a rule checked on every event of kind going through
+// [Server.Publish], after the [EventLimits]. Events breaking it are rejected with
+// "invalid: " followed by the error message. Several rules can be added for a kind.
+//
+// These rules are always in place: addressable events must have a d tag and kind 0
+// content must be a JSON object.
+func WithKindRule(kind int, rule KindRule) Option {
+	return func(o *Options) {
+		if o.kindRules == nil {
+			o.kindRules = make(map[int][]KindRule)
+		}
+		o.kindRules[kind] = append(o.kindRules[kind], rule)
+	}
+}
+
+// validateEvent checks evt against the event limits and kind rules, returning an
+// "invalid:" reason if it breaks any of them.
+func (s *Server) validateEvent(evt *nostr.Event) string {
+	limits := s.options.eventLimits
+
+	if limits.MaxPast > 0 || limits.MaxFuture > 0 {
+		d := time.Since(evt.CreatedAt.Time())
+		if limits.MaxPast > 0 && d > limits.MaxPast {
+			return "invalid: created_at is too far in the past"
+		}
+		if limits.MaxFuture > 0 && -d > limits.MaxFuture {
+			return "invalid: created_at is too far in the future"
+		}
+	}
+	if limits.MaxContentLength > 0 && len(evt.Content) > limits.MaxContentLength {
+		return fmt.Sprintf("invalid: content is too long (max %d bytes)", limits.MaxContentLength)
+	}
+	if limits.MaxTags > 0 && len(evt.Tags) > limits.MaxTags {
+		return fmt.Sprintf("invalid: too many tags (max %d)", limits.MaxTags)
+	}
+	if limits.MaxTagElementLength > 0 {
+		for _, tag := range evt.Tags {
+			for _, element := range tag {
+				if len(element) > limits.MaxTagElementLength {
+					return fmt.Sprintf("invalid: tag element is too long (max %d bytes)", limits.MaxTagElementLength)
+				}
+			}
+		}
+	}
+
+	if nostr.IsAddressableKind(evt.Kind) {
+		if d := evt.Tags.GetFirst([]string{"d", ""}); d == nil {
+			return "invalid: addressable event has no d tag"
+		}
+	}
+	if evt.Kind == nostr.KindProfileMetadata {
+		if err := checkMetadata(evt); err != nil {
+			return "invalid: " + err.Error()
+		}
+	}
+	for _, rule := range s.options.kindRules[evt.Kind] {
+		if err := rule(evt); err != nil {
+			return "invalid: " + err.Error()
+		}
+	}
+	return ""
+}
+
+func checkMetadata(evt *nostr.Event) error {
+	var metadata map[string]any
+	if err := json.Unmarshal([]byte(evt.Content), &metadata); err != nil || metadata == nil {
+		return errors.New("kind 0 content must be a JSON object")
+	}
+	return nil
+}
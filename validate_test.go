@@ -0,0 +1,86 @@
+package relayer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestEventValidation(t *testing.T) {
+	ctx := context.Background()
+	srv, _ := NewServer(&testRelay{storage: &slicestore.SliceStore{}},
+		WithEventLimits(EventLimits{
+			MaxPast:             time.Hour,
+			MaxFuture:           time.Minute,
+			MaxContentLength:    10,
+			MaxTags:             2,
+			MaxTagElementLength: 70,
+		}),
+		WithKindRule(nostr.KindReaction, func(evt *nostr.Event) error {
+			if evt.Tags.GetFirst([]string{"e", ""}) == nil {
+				return errors.New("reaction without e tag")
+			}
+			return nil
+		}),
+	)
+	defer srv.Shutdown(ctx)
+
+	for _, tc := range []struct {
+		name   string
+		event  nostr.Event
+		reason string
+	}{
+		{"valid", nostr.Event{Kind: 1, Content: "hello"}, ""},
+		{"old", nostr.Event{Kind: 1, CreatedAt: nostr.Now() - 7200}, "invalid: created_at is too far in the past"},
+		{"future", nostr.Event{Kind: 1, CreatedAt: nostr.Now() + 600}, "invalid: created_at is too far in the future"},
+		{"long content", nostr.Event{Kind: 1, Content: "hello world"}, "invalid: content is too long (max 10 bytes)"},
+		{"many tags", nostr.Event{Kind: 1, Tags: nostr.Tags{{"t", "a"}, {"t", "b"}, {"t", "c"}}}, "invalid: too many tags (max 2)"},
+		{"long tag", nostr.Event{Kind: 1, Tags: nostr.Tags{{"t", strings.Repeat("a", 71)}}}, "invalid: tag element is too long (max 70 bytes)"},
+		{"addressable with d", nostr.Event{Kind: 30023, Tags: nostr.Tags{{"d", ""}}}, ""},
+		{"addressable without d", nostr.Event{Kind: 30023}, "invalid: addressable event has no d tag"},
+		{"metadata", nostr.Event{Kind: 0, Content: `{"a":1}`}, ""},
+		{"broken metadata", nostr.Event{Kind: 0, Content: `{"name"`}, "invalid: kind 0 content must be a JSON object"},
+		{"kind rule", nostr.Event{Kind: nostr.KindReaction, Content: "+"}, "invalid: reaction without e tag"},
+	} {
+		evt := tc.event
+		if evt.CreatedAt == 0 {
+			evt.CreatedAt = nostr.Now()
+		}
+		evt.Sign(nostr.GeneratePrivateKey())
+		res := srv.Publish(ctx, &evt, PublishOptions{})
+		if res.Reason != tc.reason || res.Accepted != (tc.reason == "") {
+			t.Errorf("%s: got %+v, want reason %q", tc.name, res, tc.reason)
+		}
+	}
+
+	// events added directly are held to the same rules
+	long := &nostr.Event{Kind: 1, CreatedAt: nostr.Now(), Content: "hello world"}
+	long.Sign(nostr.GeneratePrivateKey())
+	if ok, reason := AddEvent(ContextWithServer(ctx, srv), srv.relay, long); ok || reason != "invalid: content is too long (max 10 bytes)" {
+		t.Errorf("AddEvent: got %v %q", ok, reason)
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept", "application/nostr+json")
+	srv.ServeHTTP(w, r)
+	var info struct {
+		Limitation struct {
+			MaxContentLength    int   `json:"max_content_length"`
+			MaxEventTags        int   `json:"max_event_tags"`
+			CreatedAtLowerLimit int64 `json:"created_at_lower_limit"`
+			CreatedAtUpperLimit int64 `json:"created_at_upper_limit"`
+		} `json:"limitation"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &info)
+	if l := info.Limitation; l.MaxContentLength != 10 || l.MaxEventTags != 2 || l.CreatedAtLowerLimit != 3600 || l.CreatedAtUpperLimit != 60 {
+		t.Errorf("NIP-11 limitation: %s", w.Body)
+	}
+}
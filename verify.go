@@ -0,0 +1,200 @@
+package relayer
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"runtime"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// how many accepted event ids are remembered by default, see WithVerifiedCacheSize.
+const defaultVerifiedCacheSize = 65536
+
+// WithVerifyWorkers sets how many goroutines verify event ids and signatures, which
+// defaults to the number of CPUs. Events wait in a queue for a free worker, so floods
+// of events don't take more CPU than that from the rest of the relay.
+func WithVerifyWorkers(n int) Option {
+	return func(o *Options) {
+		o.verifyWorkers = n
+	}
+}
+
+// WithVerifiedCacheSize sets how many ids of recently accepted regular events are
+// remembered, so that when they are sent again they can be answered with "duplicate:"
+// right away, without verifying their signature or touching the storage. Ids are
+// forgotten when their events are deleted. Defaults to 65536; a negative size disables
+// the cache.
+func WithVerifiedCacheSize(n int) Option {
+	return func(o *Options) {
+		o.verifiedCacheSize = n
+	}
+}
+
+// verifier checks event ids and signatures on a fixed number of worker goroutines,
+// started with the first verification and stopped by close.
+type verifier struct {
+	workers int
+	jobs    chan verifyJob
+	done    chan struct{}
+	wg      sync.WaitGroup
+	start   sync.Once
+	stop    sync.Once
+}
+
+type verifyJob struct {
+	evt    *nostr.Event
+	result chan verifyResult // buffered, so workers never wait for callers that gave up
+}
+
+type verifyResult struct {
+	reason  string
+	offense Offense
+}
+
+func newVerifier(workers int) *verifier {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	return &verifier{
+		workers: workers,
+		jobs:    make(chan verifyJob, workers),
+		done:    make(chan struct{}),
+	}
+}
+
+// verify returns a rejection reason if evt has a wrong id or signature, waiting for a
+// worker to check it. offense is set when the client is to blame.
+func (v *verifier) verify(ctx context.Context, evt *nostr.Event) (reason string, offense Offense) {
+	v.start.Do(func() {
+		v.wg.Add(v.workers)
+		for range v.workers {
+			go v.work()
+		}
+	})
+
+	job := verifyJob{evt: evt, result: make(chan verifyResult, 1)}
+	select {
+	case v.jobs <- job:
+	case <-ctx.Done():
+		return "error: gave up waiting to verify the event", ""
+	case <-v.done:
+		return "error: relay is shutting down", ""
+	}
+	select {
+	case res := <-job.result:
+		return res.reason, res.offense
+	case <-ctx.Done():
+		return "error: gave up waiting to verify the event", ""
+	case <-v.done:
+		return "error: relay is shutting down", ""
+	}
+}
+
+func (v *verifier) work() {
+	defer v.wg.Done()
+	for {
+		select {
+		case job := <-v.jobs:
+			reason, offense := checkEvent(job.evt)
+			job.result <- verifyResult{reason, offense}
+		case <-v.done:
+			return
+		}
+	}
+}
+
+// close stops the workers, making verifications waiting for them fail.
+func (v *verifier) close() {
+	v.stop.Do(func() { close(v.done) })
+	v.wg.Wait()
+}
+
+// checkEvent returns a rejection reason if evt has a wrong id or signature.
+func checkEvent(evt *nostr.Event) (reason string, offense Offense) {
+	// check id
+	hash := sha256.Sum256(evt.Serialize())
+	if id := hex.EncodeToString(hash[:]); id != evt.ID {
+		return "invalid: event id is computed incorrectly", OffenseInvalidID
+	}
+
+	// check signature
+	if ok, err := evt.CheckSignature(); err != nil {
+		return "error: failed to verify signature", ""
+	} else if !ok {
+		return "invalid: signature is invalid", OffenseInvalidSignature
+	}
+	return "", ""
+}
+
+// idCache is a fixed-size set of event ids that forgets the least recently used ones.
+// A nil *idCache is an always empty cache.
+type idCache struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List
+	ids   map[string]*list.Element
+}
+
+func newIDCache(size int) *idCache {
+	if size < 0 {
+		return nil
+	}
+	if size == 0 {
+		size = defaultVerifiedCacheSize
+	}
+	return &idCache{
+		size:  size,
+		order: list.New(),
+		ids:   make(map[string]*list.Element, size),
+	}
+}
+
+func (c *idCache) contains(id string) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.ids[id]
+	if ok {
+		c.order.MoveToFront(elem)
+	}
+	return ok
+}
+
+func (c *idCache) add(id string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.ids[id]; ok {
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.ids[id] = c.order.PushFront(id)
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.ids, oldest.Value.(string))
+	}
+}
+
+func (c *idCache) remove(id string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.ids[id]; ok {
+		c.order.Remove(elem)
+		delete(c.ids, id)
+	}
+}
@@ -0,0 +1,150 @@
+package relayer
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/nbd-wtf/go-nostr"
+	"go.uber.org/goleak"
+)
+
+func TestIDCache(t *testing.T) {
+	c := newIDCache(2)
+	c.add("a")
+	c.add("b")
+	c.contains("a") // a is now more recent than b
+	c.add("c")
+	if !c.contains("a") || c.contains("b") || !c.contains("c") {
+		t.Errorf("wrong id evicted: %v", c.ids)
+	}
+
+	c.remove("a")
+	if c.contains("a") {
+		t.Error("removed id still there")
+	}
+
+	var disabled *idCache
+	disabled.add("a")
+	if disabled.contains("a") {
+		t.Error("nil cache remembered an id")
+	}
+}
+
+func TestVerifierPool(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ctx := context.Background()
+	v := newVerifier(2)
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			evt := signedNote("hello")
+			if i%2 == 1 {
+				evt.Sig = evt.Sig[:len(evt.Sig)-2] + "00"
+			}
+			if reason, offense := v.verify(ctx, evt); (reason == "") != (i%2 == 0) || (offense != "") != (i%2 == 1) {
+				t.Errorf("event %d: %q, %q", i, reason, offense)
+			}
+		}()
+	}
+	wg.Wait()
+
+	v.close()
+	if reason, _ := v.verify(ctx, signedNote("late")); reason == "" {
+		t.Error("verified an event after close")
+	}
+}
+
+func TestPublishDuplicateFastPath(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name      string
+		cacheSize int
+		duplicate bool
+	}{
+		{"cached", 0, true},
+		{"not cached", -1, false},
+	} {
+		srv, _ := NewServer(&testRelay{storage: &slicestore.SliceStore{}}, WithVerifiedCacheSize(tc.cacheSize))
+
+		note := signedNote("hello")
+		if res := srv.Publish(ctx, note, PublishOptions{}); !res.Accepted {
+			t.Fatalf("%s: %+v", tc.name, res)
+		}
+
+		// a known id is answered before looking at the signature at all
+		resent := *note
+		resent.Sig = note.Sig[:len(note.Sig)-2] + "00"
+		res := srv.Publish(ctx, &resent, PublishOptions{})
+		if res.Duplicate != tc.duplicate || res.Prefix() != map[bool]string{true: "duplicate", false: "invalid"}[tc.duplicate] {
+			t.Errorf("%s: resent event: %+v", tc.name, res)
+		}
+		srv.Shutdown(ctx)
+	}
+}
+
+func TestPublishFastPathForgets(t *testing.T) {
+	ctx := context.Background()
+	srv, _ := NewServer(&testRelay{storage: &slicestore.SliceStore{}})
+	defer srv.Shutdown(ctx)
+
+	sk := nostr.GeneratePrivateKey()
+	note := &nostr.Event{Kind: nostr.KindTextNote, CreatedAt: nostr.Now(), Content: "deleted"}
+	note.Sign(sk)
+	srv.Publish(ctx, note, PublishOptions{})
+	deletion := &nostr.Event{Kind: 5, CreatedAt: nostr.Now(), Tags: nostr.Tags{{"e", note.ID}}}
+	deletion.Sign(sk)
+	srv.Publish(ctx, deletion, PublishOptions{})
+	if res := srv.Publish(ctx, note, PublishOptions{}); res.Duplicate {
+		t.Errorf("deleted event answered as duplicate: %+v", res)
+	}
+
+	banned := signedNote("banned")
+	srv.Publish(ctx, banned, PublishOptions{})
+	srv.Ban(Ban{Type: BanTypePubkey, Value: banned.PubKey})
+	if res := srv.Publish(ctx, banned, PublishOptions{}); res.Accepted {
+		t.Errorf("event by a banned pubkey accepted from the cache: %+v", res)
+	}
+}
+
+func benchmarkPublish(b *testing.B, opts []Option, events []*nostr.Event) {
+	ctx := context.Background()
+	srv, _ := NewServer(&testRelay{storage: &slicestore.SliceStore{}}, opts...)
+	defer srv.Shutdown(ctx)
+	for _, evt := range events {
+		srv.Publish(ctx, evt, PublishOptions{})
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			srv.Publish(ctx, events[i%len(events)], PublishOptions{})
+			i++
+		}
+	})
+}
+
+// BenchmarkPublishResent floods the server with events it already has, as happens
+// when many clients broadcast the same events to every relay they know.
+func BenchmarkPublishResent(b *testing.B) {
+	events := make([]*nostr.Event, 1000)
+	for i := range events {
+		events[i] = signedNote("resent")
+	}
+
+	b.Run("cached", func(b *testing.B) {
+		benchmarkPublish(b, nil, events)
+	})
+	b.Run("uncached", func(b *testing.B) {
+		benchmarkPublish(b, []Option{WithVerifiedCacheSize(-1)}, events)
+	})
+	b.Run("uncached-1-worker", func(b *testing.B) {
+		benchmarkPublish(b, []Option{WithVerifiedCacheSize(-1), WithVerifyWorkers(1)}, events)
+	})
+}
@@ -2,29 +2,58 @@ package relayer
 
 import (
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/fasthttp/websocket"
+	"github.com/nbd-wtf/go-nostr"
 	"golang.org/x/time/rate"
 )
 
 type WebSocket struct {
-	conn  *websocket.Conn
-	mutex sync.Mutex
+	conn        *websocket.Conn
+	mutex       sync.Mutex
+	id          string
+	ip          string
+	userAgent   string
+	connectedAt time.Time
+
+	// counters shown by the admin API
+	messagesReceived atomic.Int64
+	eventsReceived   atomic.Int64
+	eventsSent       atomic.Int64
 
 	// nip42
 	challenge string
+	authMu    sync.RWMutex
 	authed    string
 	limiter   *rate.Limiter
 }
 
+// WriteJSON writes any as a JSON message, failing if the client doesn't take it
+// within writeWait.
 func (ws *WebSocket) WriteJSON(any interface{}) error {
 	ws.mutex.Lock()
 	defer ws.mutex.Unlock()
+	ws.conn.SetWriteDeadline(time.Now().Add(writeWait))
 	return ws.conn.WriteJSON(any)
 }
 
+// WriteMessage writes a raw message, failing if the client doesn't take it
+// within writeWait.
 func (ws *WebSocket) WriteMessage(t int, b []byte) error {
 	ws.mutex.Lock()
 	defer ws.mutex.Unlock()
+	ws.conn.SetWriteDeadline(time.Now().Add(writeWait))
 	return ws.conn.WriteMessage(t, b)
 }
+
+func (ws *WebSocket) send(id string, evt *nostr.Event) error {
+	ws.eventsSent.Add(1)
+	return ws.WriteJSON(nostr.EventEnvelope{SubscriptionID: &id, Event: *evt})
+}
+
+// drop closes the connection; the reader then cleans everything else up.
+func (ws *WebSocket) drop() {
+	ws.conn.Close()
+}